@@ -0,0 +1,148 @@
+package algo
+
+import (
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Runes that the algorithms lowercase to a different rune than the other
+// runes they fold with, like the long s (which stays itself) and s
+var (
+	caseFoldOnce  sync.Once
+	caseFoldTable map[rune]rune
+)
+
+// CaseFold returns the rune that r is compared as when case is ignored with
+// simple case folding: all runes that unicode.SimpleFold cycles through fold
+// to the same rune, which is the lowercase rune of the cycle if there is one.
+// For most runes this is the same as unicode.ToLower, but not for ſ, ς, the
+// Kelvin sign and a few more.
+func CaseFold(r rune) rune {
+	if r < utf8.RuneSelf {
+		if r >= 'A' && r <= 'Z' {
+			return r + 32
+		}
+		return r
+	}
+	caseFoldOnce.Do(buildCaseFoldTable)
+	if folded, found := caseFoldTable[r]; found {
+		return folded
+	}
+	return unicode.ToLower(r)
+}
+
+// TurkishCaseFold is CaseFold with the Turkish and Azerbaijani rules for the
+// dotted and the dotless i: I folds to ı, and İ to i
+func TurkishCaseFold(r rune) rune {
+	switch r {
+	case 'I':
+		return 'ı'
+	case 'İ':
+		return 'i'
+	}
+	return CaseFold(r)
+}
+
+// buildCaseFoldTable collects the runes whose CaseFold is not their
+// lowercase rune. The folded rune is the lowercase of the lowest rune of the
+// cycle, which is the same for all runes of the cycle.
+func buildCaseFoldTable() {
+	caseFoldTable = make(map[rune]rune)
+	for _, caseRange := range unicode.CaseRanges {
+		for r := rune(caseRange.Lo); r <= rune(caseRange.Hi); r++ {
+			lowest := r
+			for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+				if f < lowest {
+					lowest = f
+				}
+			}
+			if folded := unicode.ToLower(lowest); folded != unicode.ToLower(r) {
+				caseFoldTable[r] = folded
+			}
+		}
+	}
+}
+
+// fullCaseFolds are the runes that fold to more than one rune with full case
+// folding (the F entries of CaseFolding.txt), except for İ, which folds to i
+// as with simple case folding, so that it matches an i without a combining
+// dot
+var fullCaseFolds = map[rune][]rune{
+	0x00DF: {0x0073, 0x0073},         // ß
+	0x0149: {0x02BC, 0x006E},         // ŉ
+	0x01F0: {0x006A, 0x030C},         // ǰ
+	0x0390: {0x03B9, 0x0308, 0x0301}, // ΐ
+	0x03B0: {0x03C5, 0x0308, 0x0301}, // ΰ
+	0x0587: {0x0565, 0x0582},         // և
+	0x1E96: {0x0068, 0x0331},         // ẖ
+	0x1E97: {0x0074, 0x0308},         // ẗ
+	0x1E98: {0x0077, 0x030A},         // ẘ
+	0x1E99: {0x0079, 0x030A},         // ẙ
+	0x1E9A: {0x0061, 0x02BE},         // ẚ
+	0x1E9E: {0x0073, 0x0073},         // ẞ
+	0x1F50: {0x03C5, 0x0313},         // ὐ
+	0x1F52: {0x03C5, 0x0313, 0x0300}, // ὒ
+	0x1F54: {0x03C5, 0x0313, 0x0301}, // ὔ
+	0x1F56: {0x03C5, 0x0313, 0x0342}, // ὖ
+	0x1FB2: {0x1F70, 0x03B9},         // ᾲ
+	0x1FB3: {0x03B1, 0x03B9},         // ᾳ
+	0x1FB4: {0x03AC, 0x03B9},         // ᾴ
+	0x1FB6: {0x03B1, 0x0342},         // ᾶ
+	0x1FB7: {0x03B1, 0x0342, 0x03B9}, // ᾷ
+	0x1FBC: {0x03B1, 0x03B9},         // ᾼ
+	0x1FC2: {0x1F74, 0x03B9},         // ῂ
+	0x1FC3: {0x03B7, 0x03B9},         // ῃ
+	0x1FC4: {0x03AE, 0x03B9},         // ῄ
+	0x1FC6: {0x03B7, 0x0342},         // ῆ
+	0x1FC7: {0x03B7, 0x0342, 0x03B9}, // ῇ
+	0x1FCC: {0x03B7, 0x03B9},         // ῌ
+	0x1FD2: {0x03B9, 0x0308, 0x0300}, // ῒ
+	0x1FD3: {0x03B9, 0x0308, 0x0301}, // ΐ
+	0x1FD6: {0x03B9, 0x0342},         // ῖ
+	0x1FD7: {0x03B9, 0x0308, 0x0342}, // ῗ
+	0x1FE2: {0x03C5, 0x0308, 0x0300}, // ῢ
+	0x1FE3: {0x03C5, 0x0308, 0x0301}, // ΰ
+	0x1FE4: {0x03C1, 0x0313},         // ῤ
+	0x1FE6: {0x03C5, 0x0342},         // ῦ
+	0x1FE7: {0x03C5, 0x0308, 0x0342}, // ῧ
+	0x1FF2: {0x1F7C, 0x03B9},         // ῲ
+	0x1FF3: {0x03C9, 0x03B9},         // ῳ
+	0x1FF4: {0x03CE, 0x03B9},         // ῴ
+	0x1FF6: {0x03C9, 0x0342},         // ῶ
+	0x1FF7: {0x03C9, 0x0342, 0x03B9}, // ῷ
+	0x1FFC: {0x03C9, 0x03B9},         // ῼ
+	0xFB00: {0x0066, 0x0066},         // ﬀ
+	0xFB01: {0x0066, 0x0069},         // ﬁ
+	0xFB02: {0x0066, 0x006C},         // ﬂ
+	0xFB03: {0x0066, 0x0066, 0x0069}, // ﬃ
+	0xFB04: {0x0066, 0x0066, 0x006C}, // ﬄ
+	0xFB05: {0x0073, 0x0074},         // ﬅ
+	0xFB06: {0x0073, 0x0074},         // ﬆ
+	0xFB13: {0x0574, 0x0576},         // ﬓ
+	0xFB14: {0x0574, 0x0565},         // ﬔ
+	0xFB15: {0x0574, 0x056B},         // ﬕ
+	0xFB16: {0x057E, 0x0576},         // ﬖ
+	0xFB17: {0x0574, 0x056D},         // ﬗ
+}
+
+func init() {
+	// The Greek letters with ypogegrammeni or prosgegrammeni: ᾀ to ᾇ and ᾈ
+	// to ᾏ fold to ἀ to ἇ followed by ι, and likewise for the eta and omega
+	for base, folded := range map[rune]rune{0x1F80: 0x1F00, 0x1F90: 0x1F20, 0x1FA0: 0x1F60} {
+		for i := rune(0); i < 8; i++ {
+			fullCaseFolds[base+i] = []rune{folded + i, 0x03B9}
+			fullCaseFolds[base+8+i] = []rune{folded + i, 0x03B9}
+		}
+	}
+}
+
+// FullCaseFold returns the runes that r folds to with full case folding, if
+// that is more than one rune, like ss for ß and fi for the ﬁ ligature, or nil
+// if r folds to a single rune, which is CaseFold(r)
+func FullCaseFold(r rune) []rune {
+	if r < utf8.RuneSelf {
+		return nil
+	}
+	return fullCaseFolds[r]
+}
@@ -0,0 +1,85 @@
+package algo
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/reinhrst/fzf-lib/util"
+)
+
+// AllChars is the CharMask of a text that may contain any character
+const AllChars = ^uint64(0)
+
+// charBits maps ASCII characters to a bit of a CharMask. Letters share their
+// bit with the other case, and digits have their own bits; the other
+// characters share the remaining bits.
+var charBits [utf8.RuneSelf]uint64
+
+func init() {
+	other := 0
+	for i := range charBits {
+		c := byte(i)
+		switch {
+		case c >= 'a' && c <= 'z':
+			charBits[i] = 1 << (c - 'a')
+		case c >= 'A' && c <= 'Z':
+			charBits[i] = 1 << (c - 'A')
+		case c >= '0' && c <= '9':
+			charBits[i] = 1 << (26 + c - '0')
+		default:
+			charBits[i] = 1 << (36 + other%28)
+			other++
+		}
+	}
+}
+
+// CharMask returns a 64-bit signature of the characters in the text. A
+// pattern can only match the text if the bits of all its characters (see
+// RunesMask) are set. Non-ASCII characters set the bits of the ASCII
+// characters they match after lowercasing or case folding, and
+// normalization or decomposition, the way the algorithms compare them.
+func CharMask(text *util.Chars) uint64 {
+	if text.IsBytes() {
+		return bytesMask(text.Bytes())
+	}
+	var mask uint64
+	var scratch [4]rune
+	for _, r := range text.ToRunes() {
+		if r < utf8.RuneSelf {
+			mask |= charBits[r]
+			continue
+		}
+		lower := unicode.To(unicode.LowerCase, r)
+		folded := CaseFold(r)
+		for _, char := range [...]rune{normalizeRune(r), lower, normalizeRune(lower), folded, normalizeRune(folded)} {
+			if char < utf8.RuneSelf {
+				mask |= charBits[char]
+			}
+		}
+		for _, char := range FullCaseFold(r) {
+			if char < utf8.RuneSelf {
+				mask |= charBits[char]
+			}
+		}
+		decomposed, _ := Decompose(scratch[:0], r, true)
+		for _, char := range decomposed {
+			if char < utf8.RuneSelf {
+				mask |= charBits[char]
+			}
+		}
+	}
+	return mask
+}
+
+// RunesMask returns the bits that must be set in the CharMask of a text for
+// the pattern to match it. Non-ASCII runes are left out, as they may match
+// ASCII characters of the text after normalization.
+func RunesMask(pattern []rune) uint64 {
+	var mask uint64
+	for _, r := range pattern {
+		if r < utf8.RuneSelf {
+			mask |= charBits[r]
+		}
+	}
+	return mask
+}
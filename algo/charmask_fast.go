@@ -0,0 +1,27 @@
+// +build amd64 arm64
+
+package algo
+
+import "unsafe"
+
+// bytesMask returns the CharMask of an ASCII text. The text is read a word at
+// a time, which both architectures allow at any alignment.
+func bytesMask(bytes []byte) uint64 {
+	var mask uint64
+	i := 0
+	for ; i <= len(bytes)-8; i += 8 {
+		word := *(*uint64)(unsafe.Pointer(&bytes[i]))
+		mask |= charBits[word&0x7f] |
+			charBits[word>>8&0x7f] |
+			charBits[word>>16&0x7f] |
+			charBits[word>>24&0x7f] |
+			charBits[word>>32&0x7f] |
+			charBits[word>>40&0x7f] |
+			charBits[word>>48&0x7f] |
+			charBits[word>>56&0x7f]
+	}
+	for ; i < len(bytes); i++ {
+		mask |= charBits[bytes[i]&0x7f]
+	}
+	return mask
+}
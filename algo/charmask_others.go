@@ -0,0 +1,12 @@
+// +build !amd64,!arm64
+
+package algo
+
+// bytesMask returns the CharMask of an ASCII text
+func bytesMask(bytes []byte) uint64 {
+	var mask uint64
+	for _, b := range bytes {
+		mask |= charBits[b&0x7f]
+	}
+	return mask
+}
@@ -0,0 +1,83 @@
+package algo
+
+import (
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	foldOnce  sync.Once
+	foldTable map[rune]rune
+)
+
+// FoldRune returns a representative of all runes that r may be compared equal
+// to by the algorithms, whether they lowercase (or case fold, also the
+// Turkish way) and/or normalize the runes or not. That is, two runes can only
+// match if they have the same FoldRune. Full case folding, where a rune
+// matches several, is not covered.
+func FoldRune(r rune) rune {
+	if r < utf8.RuneSelf {
+		if r >= 'A' && r <= 'Z' {
+			return r + 32
+		}
+		return r
+	}
+	foldOnce.Do(buildFoldTable)
+	if folded, found := foldTable[r]; found {
+		return folded
+	}
+	return r
+}
+
+// buildFoldTable groups the runes that are connected by lowercasing, case
+// folding or normalization, and maps every rune of a group to its lowest rune (which is
+// the lowercase letter for groups with an ASCII letter)
+func buildFoldTable() {
+	parent := make(map[rune]rune)
+	var find func(r rune) rune
+	find = func(r rune) rune {
+		p, found := parent[r]
+		if !found || p == r {
+			return r
+		}
+		root := find(p)
+		parent[r] = root
+		return root
+	}
+	union := func(a rune, b rune) {
+		a, b = find(a), find(b)
+		if a > b {
+			a, b = b, a
+		}
+		if a != b {
+			parent[b] = a
+		}
+	}
+	connect := func(r rune) {
+		union(r, unicode.To(unicode.LowerCase, r))
+		union(r, unicode.SimpleFold(r))
+		union(r, normalizeRune(r))
+	}
+	// Turkish case folding
+	union('I', 'ı')
+	for _, caseRange := range unicode.CaseRanges {
+		for r := rune(caseRange.Lo); r <= rune(caseRange.Hi); r++ {
+			connect(r)
+		}
+	}
+	for r := range normalized {
+		connect(r)
+	}
+
+	foldTable = make(map[rune]rune, len(parent))
+	for r := range parent {
+		root := find(r)
+		if root >= 'A' && root <= 'Z' {
+			root += 32
+		}
+		if r >= utf8.RuneSelf && root != r {
+			foldTable[r] = root
+		}
+	}
+}
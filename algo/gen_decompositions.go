@@ -0,0 +1,85 @@
+// +build ignore
+
+// This program generates decompositions.go. It needs golang.org/x/text:
+//
+//	go run gen_decompositions.go > decompositions.go
+
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+func main() {
+	// The marks that are left out are the nonspacing marks that precomposed
+	// characters decompose to
+	marks := make(map[rune]bool)
+	for r := rune(utf8.RuneSelf); r <= unicode.MaxRune; r++ {
+		if skip(r) {
+			continue
+		}
+		for _, d := range norm.NFKD.String(string(r)) {
+			if unicode.Is(unicode.Mn, d) {
+				marks[d] = true
+			}
+		}
+	}
+	strip := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if marks[r] {
+				return -1
+			}
+			return r
+		}, s)
+	}
+
+	var canonical, compatibility strings.Builder
+	for r := rune(utf8.RuneSelf); r <= unicode.MaxRune; r++ {
+		if skip(r) {
+			continue
+		}
+		nfd := strip(norm.NFD.String(string(r)))
+		nfkd := strip(norm.NFKD.String(string(r)))
+		if nfd != string(r) {
+			fmt.Fprintf(&canonical, "\t0x%04X: %+q,\n", r, nfd)
+		}
+		if nfkd != nfd {
+			fmt.Fprintf(&compatibility, "\t0x%04X: %+q,\n", r, nfkd)
+		}
+	}
+
+	source := fmt.Sprintf(`// Code generated by gen_decompositions.go; DO NOT EDIT.
+
+package algo
+
+// canonicalDecompositions maps runes to their canonical decomposition (NFD),
+// without the nonspacing marks. The marks themselves map to nothing.
+var canonicalDecompositions = map[rune]string{
+%s}
+
+// compatibilityDecompositions maps runes to their compatibility
+// decomposition (NFKD), without the nonspacing marks, where it differs from
+// the canonical one
+var compatibilityDecompositions = map[rune]string{
+%s}
+`, canonical.String(), compatibility.String())
+	formatted, err := format.Source([]byte(source))
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(formatted)
+}
+
+// skip returns true for the runes that are not decomposed: the Hangul
+// syllables, which would decompose to their letters, and invalid runes
+func skip(r rune) bool {
+	return r >= 0xAC00 && r <= 0xD7A3 || !utf8.ValidRune(r)
+}
@@ -3,6 +3,8 @@
 
 package algo
 
+import "unicode/utf8"
+
 var normalized map[rune]rune = map[rune]rune{
 	0x00E1: 'a', //  WITH ACUTE, LATIN SMALL LETTER
 	0x0103: 'a', //  WITH BREVE, LATIN SMALL LETTER
@@ -490,3 +492,27 @@ func NormalizeRunes(runes []rune) []rune {
 	}
 	return ret
 }
+
+// Decompose appends the runes that r decomposes to, without diacritics, to
+// dst: its canonical decomposition (NFD), or if compatibility is true, its
+// compatibility decomposition (NFKD). The nonspacing marks that are left out
+// decompose to nothing. Returns false if r has no decomposition.
+func Decompose(dst []rune, r rune, compatibility bool) ([]rune, bool) {
+	if r < utf8.RuneSelf {
+		return dst, false
+	}
+	decomposition, found := "", false
+	if compatibility {
+		decomposition, found = compatibilityDecompositions[r]
+	}
+	if !found {
+		decomposition, found = canonicalDecompositions[r]
+	}
+	if !found {
+		return dst, false
+	}
+	for _, d := range decomposition {
+		dst = append(dst, d)
+	}
+	return dst, true
+}
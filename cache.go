@@ -1,23 +1,67 @@
 package fzf
 
-import "sync"
+import (
+	"container/list"
+	"sync"
+	"unsafe"
 
-// queryCache associates strings to lists of items
-type queryCache map[string][]Result
+	"github.com/reinhrst/fzf-lib/util"
+)
 
-// ChunkCache associates Chunk and query string to lists of items
+// queryCache associates cache keys of patterns to cache entries
+type queryCache map[string]*list.Element
+
+// cacheEntry is a single chunk/query combination kept in the LRU list
+type cacheEntry struct {
+	chunk *Chunk
+	key   string
+	list  []Result
+	size  int
+}
+
+// ChunkCache associates Chunk and pattern to lists of items.
+// When a budget is set, the least recently used chunk/query combinations are
+// evicted once the approximate memory used by the cached lists exceeds it.
 type ChunkCache struct {
-	mutex sync.Mutex
-	cache map[*Chunk]*queryCache
+	mutex  sync.Mutex
+	cache  map[*Chunk]queryCache
+	lru    *list.List
+	budget int
+	size   int
+
+	lookups   cacheCounters
+	narrowing cacheCounters
 }
 
-// NewChunkCache returns a new ChunkCache
-func NewChunkCache() ChunkCache {
-	return ChunkCache{sync.Mutex{}, make(map[*Chunk]*queryCache)}
+// NewChunkCache returns a new ChunkCache. A budget of 0 or less means the
+// cache is unbounded.
+func NewChunkCache(budget int) ChunkCache {
+	return ChunkCache{
+		mutex:  sync.Mutex{},
+		cache:  make(map[*Chunk]queryCache),
+		lru:    list.New(),
+		budget: budget}
+}
+
+// cacheEntrySize returns the approximate number of bytes that a cache entry
+// keeps alive
+func cacheEntrySize(key string, list []Result) int {
+	size := int(unsafe.Sizeof(cacheEntry{})) + len(key) +
+		cap(list)*int(unsafe.Sizeof(Result{}))
+	for _, result := range list {
+		if result.positions != nil {
+			size += cap(*result.positions) * int(unsafe.Sizeof(int(0)))
+		}
+		if result.morePoints != nil {
+			size += int(unsafe.Sizeof(*result.morePoints))
+		}
+	}
+	return size
 }
 
 // Add adds the list to the cache
-func (cc *ChunkCache) Add(chunk *Chunk, key string, list []Result) {
+func (cc *ChunkCache) Add(chunk *Chunk, pattern *Pattern, list []Result) {
+	key := pattern.CacheKey()
 	if len(key) == 0 || !chunk.IsFull() || len(list) > queryCacheMax {
 		return
 	}
@@ -27,14 +71,64 @@ func (cc *ChunkCache) Add(chunk *Chunk, key string, list []Result) {
 
 	qc, ok := cc.cache[chunk]
 	if !ok {
-		cc.cache[chunk] = &queryCache{}
-		qc = cc.cache[chunk]
+		qc = make(queryCache)
+		cc.cache[chunk] = qc
+	}
+	if elem, found := qc[key]; found {
+		cc.remove(elem)
+	}
+	entry := &cacheEntry{chunk, key, list, cacheEntrySize(key, list)}
+	qc[key] = cc.lru.PushFront(entry)
+	cc.size += entry.size
+	cc.evict()
+}
+
+// evict drops the least recently used entries until the cache fits within its
+// budget. Unsynchronized; should be called with the mutex held.
+func (cc *ChunkCache) evict() {
+	if cc.budget <= 0 {
+		return
+	}
+	for cc.size > cc.budget && cc.lru.Len() > 0 {
+		cc.remove(cc.lru.Back())
+	}
+}
+
+// remove deletes a single entry from the cache. Unsynchronized; should be
+// called with the mutex held.
+func (cc *ChunkCache) remove(elem *list.Element) {
+	entry := cc.lru.Remove(elem).(*cacheEntry)
+	cc.size -= entry.size
+	qc := cc.cache[entry.chunk]
+	delete(qc, entry.key)
+	if len(qc) == 0 {
+		delete(cc.cache, entry.chunk)
+	}
+}
+
+// Forget drops the cached lists of the chunk
+func (cc *ChunkCache) Forget(chunk *Chunk) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	for _, elem := range cc.cache[chunk] {
+		cc.remove(elem)
+	}
+}
+
+// lookup returns the cached list for the chunk and the key, marking it as
+// recently used. Unsynchronized; should be called with the mutex held.
+func (cc *ChunkCache) lookup(qc queryCache, key string) ([]Result, bool) {
+	elem, found := qc[key]
+	if !found {
+		return nil, false
 	}
-	(*qc)[key] = list
+	cc.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).list, true
 }
 
 // Lookup is called to lookup ChunkCache
-func (cc *ChunkCache) Lookup(chunk *Chunk, key string) []Result {
+func (cc *ChunkCache) Lookup(chunk *Chunk, pattern *Pattern) []Result {
+	key := pattern.CacheKey()
 	if len(key) == 0 || !chunk.IsFull() {
 		return nil
 	}
@@ -44,15 +138,25 @@ func (cc *ChunkCache) Lookup(chunk *Chunk, key string) []Result {
 
 	qc, ok := cc.cache[chunk]
 	if ok {
-		list, ok := (*qc)[key]
+		list, ok := cc.lookup(qc, key)
 		if ok {
+			cc.lookups.count(true)
 			return list
 		}
 	}
+	cc.lookups.count(false)
 	return nil
 }
 
-func (cc *ChunkCache) Search(chunk *Chunk, key string) []Result {
+// Search returns the items of the chunk that may match the pattern, based on
+// the cached results of weaker patterns. E.g. the results of "foo" can be
+// reused for "fooo", "foo bar" and "foo !test". When multiple weaker patterns
+// are cached (e.g. "foo" and "bar" for "foo bar"), their results are
+// intersected. Returns nil if nothing is known about the chunk. The weaker
+// patterns are looked up by the keys of Pattern.narrowingKeys, so the cost
+// doesn't depend on the number of cached entries.
+func (cc *ChunkCache) Search(chunk *Chunk, pattern *Pattern) []Result {
+	key := pattern.CacheKey()
 	if len(key) == 0 || !chunk.IsFull() {
 		return nil
 	}
@@ -62,20 +166,142 @@ func (cc *ChunkCache) Search(chunk *Chunk, key string) []Result {
 
 	qc, ok := cc.cache[chunk]
 	if !ok {
+		cc.narrowing.count(false)
 		return nil
 	}
 
-	for idx := 1; idx < len(key); idx++ {
-		// [---------| ] | [ |---------]
-		// [--------|  ] | [  |--------]
-		// [-------|   ] | [   |-------]
-		prefix := key[:len(key)-idx]
-		suffix := key[idx:]
-		for _, substr := range [2]string{prefix, suffix} {
-			if cached, found := (*qc)[substr]; found {
-				return cached
-			}
+	var space []Result
+	for _, weaker := range pattern.narrowingKeys {
+		list, found := cc.lookup(qc, weaker)
+		if !found {
+			continue
+		}
+		if space == nil {
+			space = list
+		} else {
+			space = intersectResults(space, list)
+		}
+		if len(space) == 0 {
+			break
 		}
 	}
-	return nil
+	cc.narrowing.count(space != nil)
+	return space
+}
+
+// intersectResults returns the results of the first list whose items also
+// appear in the second list, keeping the order of the first list
+func intersectResults(first []Result, second []Result) []Result {
+	items := make(map[*Item]bool, len(second))
+	for _, result := range second {
+		items[result.item] = true
+	}
+	ret := make([]Result, 0, util.Min(len(first), len(second)))
+	for _, result := range first {
+		if items[result.item] {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+// Clear removes all entries from the cache
+func (cc *ChunkCache) Clear() {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	cc.cache = make(map[*Chunk]queryCache)
+	cc.lru.Init()
+	cc.size = 0
+}
+
+// Len returns the number of chunk/query combinations in the cache
+func (cc *ChunkCache) Len() int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.lru.Len()
+}
+
+// Size returns the approximate number of bytes kept alive by the cache
+func (cc *ChunkCache) Size() int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.size
+}
+
+// Stats returns the counters of exact lookups and of prefix/suffix narrowing
+func (cc *ChunkCache) Stats() (CacheStats, CacheStats) {
+	lookups := cc.lookups.stats()
+	cc.mutex.Lock()
+	lookups.Entries = cc.lru.Len()
+	lookups.Bytes = cc.size
+	cc.mutex.Unlock()
+	return lookups, cc.narrowing.stats()
+}
+
+// PatternCache associates needles to parsed Patterns. It keeps at most a
+// fixed number of Patterns, evicting the least recently used one, and is
+// safe for concurrent use.
+type PatternCache struct {
+	mutex    sync.Mutex
+	cache    map[string]*list.Element
+	lru      *list.List
+	max      int
+	counters cacheCounters
+}
+
+// NewPatternCache returns a new PatternCache holding at most max Patterns. A
+// max of 0 or less means the cache is unbounded.
+func NewPatternCache(max int) *PatternCache {
+	return &PatternCache{
+		cache: make(map[string]*list.Element),
+		lru:   list.New(),
+		max:   max}
+}
+
+// Lookup returns the Pattern for the needle, or nil if it is not cached
+func (pc *PatternCache) Lookup(needle string) *Pattern {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	elem, found := pc.cache[needle]
+	pc.counters.count(found)
+	if !found {
+		return nil
+	}
+	pc.lru.MoveToFront(elem)
+	return elem.Value.(*Pattern)
+}
+
+// Add adds the Pattern to the cache
+func (pc *PatternCache) Add(needle string, pattern *Pattern) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if elem, found := pc.cache[needle]; found {
+		elem.Value = pattern
+		pc.lru.MoveToFront(elem)
+		return
+	}
+	pc.cache[needle] = pc.lru.PushFront(pattern)
+	for pc.max > 0 && pc.lru.Len() > pc.max {
+		oldest := pc.lru.Remove(pc.lru.Back()).(*Pattern)
+		delete(pc.cache, oldest.originalText)
+	}
+}
+
+// Clear removes all Patterns from the cache
+func (pc *PatternCache) Clear() {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.cache = make(map[string]*list.Element)
+	pc.lru.Init()
+}
+
+// Stats returns the counters of the cache
+func (pc *PatternCache) Stats() CacheStats {
+	stats := pc.counters.stats()
+	pc.mutex.Lock()
+	stats.Entries = pc.lru.Len()
+	pc.mutex.Unlock()
+	return stats
 }
@@ -1,11 +1,24 @@
 package fzf
 
-import "sync"
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/reinhrst/fzf-lib/util"
+)
 
 // Chunk is a list of Items whose size has the upper limit of chunkSize
 type Chunk struct {
 	items [chunkSize]Item
 	count int
+	// Length of the longest item in the chunk, used to size the slabs
+	maxLength int
+	// Union of the algo.CharMask of the items, to skip the chunk at once
+	charMask uint64
+	// The items with a transliterated text, which the index doesn't cover
+	transliterated itemSet
+	// The *chunkIndex of a full chunk, once it is built
+	index atomic.Value
 }
 
 // ItemBuilder is a closure type that builds Item object from byte array
@@ -28,12 +41,46 @@ func NewChunkList(trans ItemBuilder) *ChunkList {
 
 func (c *Chunk) push(trans ItemBuilder, data []byte) bool {
 	if trans(&c.items[c.count], data) {
+		c.added(c.count)
 		c.count++
 		return true
 	}
 	return false
 }
 
+// added updates the chunk for the item at idx, which is added to it
+func (c *Chunk) added(idx int) {
+	item := &c.items[idx]
+	c.maxLength = util.Max(c.maxLength, item.matchLength())
+	c.charMask |= item.charMask
+	if item.transliterated() {
+		c.transliterated.add(idx)
+	}
+}
+
+// transform returns the chunk with its items transformed by t. The chunk is
+// copied, keeping its index, if that changes any of its items, as the items
+// of a snapshot are shared.
+func (c *Chunk) transform(t *itemTransforms) *Chunk {
+	transformed := c
+	for idx := 0; idx < c.count; idx++ {
+		texts := t.texts(&c.items[idx].text)
+		if texts == nil {
+			continue
+		}
+		if transformed == c {
+			transformed = &Chunk{items: c.items, count: c.count, maxLength: c.maxLength,
+				charMask: c.charMask, transliterated: c.transliterated}
+			if index := c.getIndex(); index != nil {
+				transformed.setIndex(index)
+			}
+		}
+		transformed.items[idx].setTexts(texts)
+		transformed.added(idx)
+	}
+	return transformed
+}
+
 // IsFull returns true if the Chunk is full
 func (c *Chunk) IsFull() bool {
 	return c.count == chunkSize
@@ -64,6 +111,60 @@ func (cl *ChunkList) Push(data []byte) bool {
 	return ret
 }
 
+// chunkOf returns the chunk of the item with the given index, or nil if there
+// is no such item
+func (cl *ChunkList) chunkOf(index int) *Chunk {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if index < 0 || index/chunkSize >= len(cl.chunks) {
+		return nil
+	}
+	if chunk := cl.chunks[index/chunkSize]; index%chunkSize < chunk.count {
+		return chunk
+	}
+	return nil
+}
+
+// weightList holds the weights of the items by index, in blocks of chunkSize
+// that are only allocated once a weight in them is set. The chunks of the
+// items can be shared between Fzf objects, so the weights are kept apart.
+type weightList struct {
+	mutex sync.Mutex
+	// The []*[chunkSize]int32 blocks; only replaced, never modified, so it
+	// can be read without locking
+	blocks atomic.Value
+}
+
+// get returns the weight of the item with the given index
+func (wl *weightList) get(index int32) int32 {
+	blocks, _ := wl.blocks.Load().([]*[chunkSize]int32)
+	if block := int(index) / chunkSize; block < len(blocks) && blocks[block] != nil {
+		return atomic.LoadInt32(&blocks[block][int(index)%chunkSize])
+	}
+	return 0
+}
+
+// set sets the weight of the item with the given index
+func (wl *weightList) set(index int32, weight int32) {
+	wl.mutex.Lock()
+	defer wl.mutex.Unlock()
+
+	blocks, _ := wl.blocks.Load().([]*[chunkSize]int32)
+	block := int(index) / chunkSize
+	if block >= len(blocks) || blocks[block] == nil {
+		if weight == 0 {
+			return
+		}
+		grown := make([]*[chunkSize]int32, util.Max(len(blocks), block+1))
+		copy(grown, blocks)
+		grown[block] = new([chunkSize]int32)
+		wl.blocks.Store(grown)
+		blocks = grown
+	}
+	atomic.StoreInt32(&blocks[block][int(index)%chunkSize], weight)
+}
+
 // Clear clears the data
 func (cl *ChunkList) Clear() {
 	cl.mutex.Lock()
@@ -78,8 +179,8 @@ func (cl *ChunkList) Snapshot() ([]*Chunk, int) {
 	ret := make([]*Chunk, len(cl.chunks))
 	copy(ret, cl.chunks)
 
-	// Duplicate the last chunk
-	if cnt := len(ret); cnt > 0 {
+	// Duplicate the last chunk, unless it is full and thus won't change
+	if cnt := len(ret); cnt > 0 && !ret[cnt-1].IsFull() {
 		newChunk := *ret[cnt-1]
 		ret[cnt-1] = &newChunk
 	}
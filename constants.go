@@ -15,15 +15,28 @@ const (
 	// Capacity of each chunk
 	chunkSize int = 100
 
-	// Pre-allocated memory slices to minimize GC
-	slab16Size int = 100 * 1024 // 200KB * 32 = 12.8MB
-	slab32Size int = 2048       // 8KB * 32 = 256KB
+	// Maximum size of the pooled memory slices to minimize GC. The slabs are
+	// sized to the longest item and needle, so they are usually smaller.
+	slab16Size int = 100 * 1024 // 200KB per scanning goroutine
+	slab32Size int = 2048       // 8KB per scanning goroutine
 
 	// Do not cache results of low selectivity queries
 	queryCacheMax int = chunkSize / 5
 
+	// Default approximate memory budget of the ChunkCache
+	defaultCacheBudget int = 64 * 1024 * 1024 // 64MB
+
+	// Maximum number of parsed needles kept per Fzf instance
+	patternCacheMax int = 1000
+
 	// Not to cache mergers with large lists
 	mergerCacheMax int = 100000
+
+	// Items longer than this are not added to the n-gram index, but are
+	// always scanned
+	indexMaxLength int = 1000
+	// Minimum length of a fuzzy term to look up its characters in the index
+	indexMinFuzzyLength int = 4
 )
 
 // fzf events
@@ -2,6 +2,9 @@ package fzf
 
 import (
 	"fmt"
+	"sync"
+	"time"
+
 	"github.com/reinhrst/fzf-lib/algo"
 	"github.com/reinhrst/fzf-lib/util"
 )
@@ -16,10 +19,18 @@ type Options struct {
 	// CaseRespect, CaseIgnore or CaseSmart
 	// CaseSmart matches case insensitive if the needle is all lowercase, else case sensitive
 	CaseMode Case
-	// set to False to get fzf --literal behaviour:
+	// How characters are compared when case is ignored: FoldLower (the
+	// default), FoldSimple or FoldFull, optionally combined with FoldTurkish.
+	// Positions always refer to the characters of the item, also when a
+	// character matched several characters of the needle.
+	CaseFolding CaseFolding
+	// set to NormalizeNone to get fzf --literal behaviour:
 	// "Do not normalize latin script letters for matching."
-	Normalize bool
-	// Array with options from {ByScore, ByLength, ByBegin, ByEnd}.
+	// NormalizeDiacritics and NormalizeCompatibility also normalize the letters
+	// of other scripts, and compatibility characters like ligatures.
+	Normalize Normalization
+	// Array with options from {ByScore, ByLength, ByBegin, ByEnd, ByIndex,
+	// ByIndexDesc, ByPathDepth}, or CustomCriterion(i) for CustomCriteria[i].
 	// Matches will first be sorted by the first element, ties will be sorted by
 	// second element, etc.
 	// ByScore: Each match is scored (see algo file for more info), higher score
@@ -27,20 +38,80 @@ type Options struct {
 	// ByLength: Shorter match wins
 	// ByBegin: Match closer to begin of string wins
 	// ByEnd: Match closer to end of string wins
+	// ByIndex: Item that was added first wins, regardless of Tac
+	// ByIndexDesc: Item that was added last wins, regardless of Tac
+	// ByPathDepth: Item with fewer path separators (/ or \) wins
+	// CustomCriterion(i): Lower rank from CustomCriteria[i] wins
+	//
+	// Only the first 8 criteria are used.
 	//
 	// If all methods give equal score (including when the Sort slice is empty),
 	// the result is sorted by HayIndex, the order in which they appeared in
-	// the input.
+	// the input (reversed if Tac is set).
 	Sort []Criterion
+	// The functions of the criteria CustomCriterion(0), CustomCriterion(1),
+	// and so on, which rank a match. They are called for every match, from
+	// the goroutines that scan the haystack, so they must be safe for
+	// concurrent use, and fast. Since matches are cached, the rank of an item
+	// must not change during the lifetime of an Fzf object.
+	CustomCriteria []func(SortInfo) int32
+	// If true, the input order is reversed, like fzf --tac: matches that rank
+	// the same, and all items for an empty needle, are returned last added
+	// first. HayIndex is not affected, and neither are ByBegin and ByEnd,
+	// which are about the position of the match within the item.
+	Tac bool
+	// Approximate number of bytes the per-chunk result cache, and the cache
+	// of the results per needle, may each use before the least recently used
+	// entries are evicted. 0 means unbounded.
+	CacheBudget int
+	// Maximum number of goroutines that scan the haystack at the same time
+	// for a single search. 0 means the number of CPUs. The haystack is
+	// divided into a number of partitions proportional to this value.
+	Parallelism int
+	// If set, the scanning is done by the workers of this pool, which can be
+	// shared between many Fzf objects to cap the total number of goroutines
+	// doing work. If nil, each search starts its own goroutines.
+	Pool *WorkerPool
+	// If more than 0, a SearchResult contains at most this many (best)
+	// matches. Only these are sorted; the others can be requested with
+	// Fzf.Page.
+	Limit int
+	// If true, a new Search interrupts the search that is still running, whose
+	// result is then never sent. If false, the running search is finished first.
+	Preempt bool
+	// If true, the Positions of every match are computed during the search.
+	// If false, they are left empty, which makes searching 5-10% faster;
+	// MatchResult.ComputePositions then gives them for a single match.
+	WithPositions bool
+	// If true, an n-gram index of the haystack is built in the background
+	// (by Parallelism goroutines), which speeds up searches for exact, prefix,
+	// suffix and equal terms, and long fuzzy terms, on large haystacks. It
+	// takes a few times the memory of the haystack itself. It is not used with
+	// FoldFull, NormalizeDiacritics or NormalizeCompatibility.
+	Index bool
+	// Combines the score of a match with the weight of its item (see
+	// Fzf.SetWeight) into the score that ByScore sorts by. If nil, the
+	// weight is added to the score. It is called for every match, from the
+	// goroutines that scan the haystack.
+	WeightFormula func(score int, weight int32) int
+	// If set, the items are also matched in the form that it transliterates
+	// them to, so that with TransliterateCyrillic moskva matches Москва. That
+	// form is case folded and normalized like the items themselves, and the
+	// positions refer to the characters of the item. Items are transliterated
+	// when they are added, and the Index is not used for those that change.
+	Transliterate Transliterator
 }
 
 func DefaultOptions() Options {
 	return Options{
-		Extended:  true,
-		Fuzzy:     true,
-		CaseMode:  CaseSmart,
-		Normalize: true,
-		Sort:      []Criterion{ByScore, ByLength},
+		Extended:      true,
+		Fuzzy:         true,
+		CaseMode:      CaseSmart,
+		Normalize:     NormalizeLatin,
+		Sort:          []Criterion{ByScore, ByLength},
+		CacheBudget:   defaultCacheBudget,
+		Preempt:       true,
+		WithPositions: true,
 	}
 }
 
@@ -48,38 +119,206 @@ type SearchResult struct {
 	Needle        string
 	SearchOptions Options
 	Matches       []MatchResult
+	// Total number of matches, which is more than len(Matches) if the number
+	// of matches exceeds Options.Limit
+	Total int
+	// True if the search was stopped by Fzf.Cancel; there are no Matches
+	Cancelled bool
 }
 
 type MatchResult struct {
-	Key       string
-	HayIndex  int32
+	Key      string
+	HayIndex int32
+	// The score of the match, without the weight of the item
 	Score     int
 	Positions []int
+	// The weight of the item; see Fzf.SetWeight
+	Weight int32
+
+	item    *Item
+	pattern *Pattern
+}
+
+// KeyBytes returns the Key as a byte slice, without copying it. For ASCII
+// keys this is the slice that the haystack item is matched against, which
+// shares the memory of the haystack string; it must not be modified.
+func (r MatchResult) KeyBytes() []byte {
+	if r.item != nil && r.item.text.IsBytes() {
+		return r.item.text.Bytes()
+	}
+	return util.StringBytes(r.Key)
+}
+
+// KeyRunes returns the Key as a slice of runes, which is what Positions
+// index. For non-ASCII keys this is the slice that the haystack item is
+// matched against, which saves a copy; it must not be modified.
+func (r MatchResult) KeyRunes() []rune {
+	if r.item != nil {
+		return r.item.text.ToRunes()
+	}
+	return []rune(r.Key)
+}
+
+// ComputePositions returns the positions of the matched characters in the
+// Key. They are computed now if the search was done without
+// Options.WithPositions.
+func (r MatchResult) ComputePositions() []int {
+	if r.Positions != nil || r.pattern == nil || r.pattern.IsEmpty() {
+		return r.Positions
+	}
+	// Without a slab the algorithms allocate what they need
+	if _, _, pos := r.pattern.MatchItem(r.item, true, nil); pos != nil {
+		return *pos
+	}
+	return nil
+}
+
+// Grapheme is a grapheme cluster of the Key of a MatchResult: a character as
+// users perceive it, like a letter with its combining marks, a flag, or an
+// emoji with its modifiers
+type Grapheme struct {
+	// Index of the first rune in the runes of the Key, which Positions index,
+	// and the number of runes
+	Rune  int
+	Runes int
+	// Offset in the Key in bytes, and in UTF-16 code units for JavaScript
+	Byte  int
+	UTF16 int
+	// Column on a terminal, and the number of columns it takes
+	Column int
+	Width  int
+	// True if any of its runes is in the Positions of the match
+	Matched bool
+}
+
+// Graphemes returns the grapheme clusters of the Key, so that a UI can
+// highlight whole characters and align columns. The positions are computed
+// if needed, like ComputePositions does.
+func (r MatchResult) Graphemes() []Grapheme {
+	runes := r.KeyRunes()
+	starts := util.GraphemeStarts(runes)
+	graphemes := make([]Grapheme, len(starts))
+	bytes := util.ByteOffsets(runes, starts)
+	utf16 := util.UTF16Offsets(runes, starts)
+	column := 0
+	for idx, start := range starts {
+		end := len(runes)
+		if idx+1 < len(starts) {
+			end = starts[idx+1]
+		}
+		width := util.GraphemeWidth(runes[start:end])
+		graphemes[idx] = Grapheme{
+			Rune: start, Runes: end - start, Byte: bytes[idx], UTF16: utf16[idx],
+			Column: column, Width: width}
+		column += width
+	}
+	for _, cluster := range util.GraphemeIndexes(runes, r.ComputePositions()) {
+		if cluster < len(graphemes) {
+			graphemes[cluster].Matched = true
+		}
+	}
+	return graphemes
+}
+
+// GraphemePositions returns the indexes in Graphemes of the grapheme clusters
+// that contain the positions, in ascending order, so that a cluster is
+// highlighted as a whole
+func (r MatchResult) GraphemePositions() []int {
+	var positions []int
+	for idx, grapheme := range r.Graphemes() {
+		if grapheme.Matched {
+			positions = append(positions, idx)
+		}
+	}
+	return positions
+}
+
+// UTF16Positions returns the positions as offsets in the Key in UTF-16 code
+// units, the way JavaScript strings index them, in the order of
+// ComputePositions
+func (r MatchResult) UTF16Positions() []int {
+	return util.UTF16Offsets(r.KeyRunes(), r.ComputePositions())
+}
+
+// BytePositions returns the positions as byte offsets in the Key, in the order
+// of ComputePositions
+func (r MatchResult) BytePositions() []int {
+	return util.ByteOffsets(r.KeyRunes(), r.ComputePositions())
 }
 
 type Fzf struct {
 	eventBox      *util.EventBox
 	matcher       *Matcher
 	chunkList     *ChunkList
-	slab          *util.Slab
 	resultChannel chan SearchResult
+	// Closed by End, which stops the loop; the loop then closes the result
+	// channel, as it may be sending on it
+	quit chan struct{}
+
+	patternCache *PatternCache
+	// The weights of the items, which are not kept in the items, as
+	// snapshots share those
+	weights     *weightList
+	searchStats searchStats
+	limit       int
+	preempt     bool
+
+	// Signals the indexer that items were added; nil if there is no index
+	indexRequests chan struct{}
+	indexWorkers  int
+
+	// The strings of the haystack, so that the keys of the matches don't
+	// have to be rebuilt from the items. The items are matched in the memory
+	// of the strings, so it isn't copied.
+	keysMutex sync.Mutex
+	keys      keyList
+	// Set by End, under keysMutex; items are no longer added afterwards
+	ended bool
+
+	// The merger of the last result sent on the result channel
+	mergerMutex sync.Mutex
+	lastMerger  *Merger
 }
 
-// Creates a new Fzf object, with the given haystack and the given options
-func New(hayStack []string, opts Options) *Fzf {
-	var itemIndex int32
-	var chunkList = NewChunkList(func(item *Item, data []byte) bool {
-		item.text = util.ToChars(data)
+// keyList holds the original strings of the items from HayIndex offset on
+type keyList struct {
+	offset int
+	keys   []string
+}
+
+// key returns the original string of the item, or a new one if it is not in
+// the list
+func (kl keyList) key(item *Item) string {
+	if index := int(item.Index()) - kl.offset; index >= 0 && index < len(kl.keys) {
+		return kl.keys[index]
+	}
+	return item.text.ToString()
+}
+
+// newChunkList returns a ChunkList that indexes the items in the order in
+// which they are pushed, and transforms them with transforms (if not nil)
+func newChunkList(transforms *itemTransforms) *ChunkList {
+	return newChunkListFrom(nil, transforms)
+}
+
+// newChunkListFrom returns a ChunkList that starts with the given chunks, and
+// indexes the items that are pushed after them in order
+func newChunkListFrom(chunks []*Chunk, transforms *itemTransforms) *ChunkList {
+	itemIndex := int32(CountItems(chunks))
+	chunkList := NewChunkList(func(item *Item, data []byte) bool {
+		item.setText(data)
+		item.setTexts(transforms.texts(&item.text))
 		item.text.Index = itemIndex
 		itemIndex++
 		return true
 	})
+	chunkList.chunks = append(chunkList.chunks, chunks...)
+	return chunkList
+}
 
-	for _, hayStraw := range hayStack {
-		chunkList.Push([]byte(hayStraw))
-	}
-
-	eventBox := util.NewEventBox()
+// newPatternBuilder returns a function that builds Patterns for needles
+// according to the options, using the given cache
+func newPatternBuilder(opts Options, weightOf func(int32) int32, patternCache *PatternCache) func(string) *Pattern {
 	forward := true
 	for _, cri := range opts.Sort {
 		if cri == ByEnd {
@@ -90,30 +329,70 @@ func New(hayStack []string, opts Options) *Fzf {
 			break
 		}
 	}
-	patternCache := make(map[string]*Pattern)
-	patternBuilder := func(needle string) *Pattern {
+	return func(needle string) *Pattern {
 		return BuildPattern(
 			opts.Fuzzy, algo.FuzzyMatchV2, opts.Extended,
-			opts.CaseMode, opts.Normalize, forward, needle, opts.Sort,
-			&patternCache)
+			opts.CaseMode, opts.CaseFolding, opts.Normalize, forward, needle, opts.Sort,
+			opts.CustomCriteria, opts.WithPositions, opts.WeightFormula, weightOf, patternCache)
 	}
-	matcher := NewMatcher(patternBuilder, true, false, eventBox)
+}
+
+// Creates a new Fzf object, with the given haystack and the given options
+func New(hayStack []string, opts Options) *Fzf {
+	fzf := newFzf(newChunkList(newItemTransforms(opts.CaseFolding, opts.Normalize, opts.Transliterate)), opts)
+	fzf.Append(hayStack)
+	fzf.start()
+	return fzf
+}
+
+// newFzf returns a new Fzf object that searches the items of the ChunkList.
+// The keys of the items that are already there are rebuilt from the items.
+func newFzf(chunkList *ChunkList, opts Options) *Fzf {
+	eventBox := util.NewEventBox()
+	patternCache := NewPatternCache(patternCacheMax)
+	weights := &weightList{}
+	patternBuilder := newPatternBuilder(opts, weights.get, patternCache)
+	matcher := NewMatcher(patternBuilder, true, opts.Tac, opts.CacheBudget,
+		opts.Parallelism, opts.Pool, opts.Limit, eventBox)
 	resultChannel := make(chan SearchResult)
 
 	fzf := &Fzf{
-		eventBox,
-		matcher,
-		chunkList,
-		util.MakeSlab(slab16Size, slab32Size),
-		resultChannel,
+		eventBox:      eventBox,
+		matcher:       matcher,
+		chunkList:     chunkList,
+		resultChannel: resultChannel,
+		quit:          make(chan struct{}),
+		patternCache:  patternCache,
+		weights:       weights,
+		limit:         opts.Limit,
+		preempt:       opts.Preempt,
+	}
+	_, fzf.keys.offset = chunkList.Snapshot()
+	if opts.Index {
+		fzf.indexRequests = make(chan struct{}, 1)
+		fzf.indexWorkers = opts.Parallelism
+		if fzf.indexWorkers <= 0 {
+			fzf.indexWorkers = numCPU()
+		}
 	}
-	fzf.start()
 	return fzf
 }
 
 func (fzf *Fzf) start() {
 	go fzf.loop()
 	go fzf.matcher.Loop()
+	if fzf.indexRequests != nil {
+		go fzf.index()
+	}
+}
+
+// index builds the indexes of the chunks that were filled since the last time
+// it was signalled
+func (fzf *Fzf) index() {
+	for range fzf.indexRequests {
+		chunks, _ := fzf.chunkList.Snapshot()
+		indexChunks(chunks, fzf.indexWorkers)
+	}
 }
 
 func (fzf *Fzf) GetResultChannel() <-chan SearchResult {
@@ -121,15 +400,18 @@ func (fzf *Fzf) GetResultChannel() <-chan SearchResult {
 }
 
 func (fzf *Fzf) loop() {
+	defer close(fzf.resultChannel)
 	for {
 		var merger *Merger
+		var scanTime time.Duration
 		var progress = false
 		quit := false
 		fzf.eventBox.Wait(func(events *util.Events) {
 			for evt, val := range *events {
 				switch evt {
 				case EvtSearchFin:
-					merger = val.(*Merger)
+					fin := val.(searchFin)
+					merger, scanTime = fin.merger, fin.scanTime
 				case EvtSearchProgress:
 					// log.Println("search progress, ignoring for now")
 					progress = true
@@ -148,35 +430,198 @@ func (fzf *Fzf) loop() {
 			break
 		}
 
-		var matchResults []MatchResult
-		for i := 0; i < merger.Length(); i++ {
-			result := merger.Get(i)
-			item := result.item
-			pos := result.positions
-			score := result.score
-			matchResults = append(matchResults, MatchResult{
-				Key:       item.text.ToString(),
-				HayIndex:  item.Index(),
-				Score:     score,
-				Positions: *pos,
-			})
+		if merger.cancelled {
+			if !fzf.send(SearchResult{Needle: merger.pattern.originalText, Cancelled: true}) {
+				break
+			}
+			continue
 		}
 
+		count := merger.Length()
+		if fzf.limit > 0 {
+			count = util.Min(count, fzf.limit)
+		}
+		timings := SearchTimings{Scan: scanTime}
+		fzf.mergerMutex.Lock()
+		fzf.lastMerger = merger
+		matchResults := matchResults(merger, fzf.snapshotKeys(), 0, count, &timings)
+		fzf.mergerMutex.Unlock()
+		fzf.searchStats.add(timings)
+
 		result := SearchResult{
 			Needle:  merger.pattern.originalText,
 			Matches: matchResults,
+			Total:   merger.Length(),
+		}
+		if !fzf.send(result) {
+			break
 		}
-		fzf.resultChannel <- result
 	}
 }
 
+// send sends the result on the result channel, and returns false if End is
+// called instead of it being received
+func (fzf *Fzf) send(result SearchResult) bool {
+	select {
+	case fzf.resultChannel <- result:
+		return true
+	case <-fzf.quit:
+		return false
+	}
+}
+
+// matchResults returns the results from..to of the merger as MatchResults,
+// with the keys taken from the keyList
+func matchResults(merger *Merger, keys keyList, from int, to int, timings *SearchTimings) []MatchResult {
+	startedAt := time.Now()
+	results := make([]Result, to-from)
+	for i := range results {
+		results[i] = merger.Get(from + i)
+	}
+	timings.Merge = time.Since(startedAt)
+
+	startedAt = time.Now()
+	var matchResults []MatchResult
+	for _, result := range results {
+		item := result.item
+		var positions []int
+		if result.positions != nil {
+			positions = *result.positions
+		}
+		matchResults = append(matchResults, MatchResult{
+			Key:       keys.key(item),
+			HayIndex:  item.Index(),
+			Score:     result.score,
+			Positions: positions,
+			Weight:    merger.pattern.itemWeight(item),
+			item:      item,
+			pattern:   merger.pattern,
+		})
+	}
+	timings.Convert = time.Since(startedAt)
+	return matchResults
+}
+
+// Page returns count matches starting at offset, of the most recent
+// SearchResult sent on the result channel. This is the way to get the matches
+// beyond Options.Limit; they are only sorted once they are asked for.
+func (fzf *Fzf) Page(offset int, count int) []MatchResult {
+	fzf.mergerMutex.Lock()
+	defer fzf.mergerMutex.Unlock()
+	if fzf.lastMerger == nil {
+		return nil
+	}
+	to := util.Min(offset+count, fzf.lastMerger.Length())
+	if offset < 0 || offset >= to {
+		return nil
+	}
+	var timings SearchTimings
+	return matchResults(fzf.lastMerger, fzf.snapshotKeys(), offset, to, &timings)
+}
+
+// Append adds items to the end of the haystack. Items get a HayIndex that
+// continues from the items that were already there. Searches that were done
+// before can reuse their results for all but the newly added items. After
+// End, Append does nothing.
+func (fzf *Fzf) Append(hayStack []string) {
+	fzf.AppendWeighted(hayStack, nil)
+}
+
+// AppendWeighted adds items with the given weights to the end of the haystack,
+// like Append. weights must be as long as hayStack, or nil for weight 0;
+// otherwise nothing is added, and an error is returned.
+func (fzf *Fzf) AppendWeighted(hayStack []string, weights []int32) error {
+	if weights != nil && len(weights) != len(hayStack) {
+		return fmt.Errorf("%d weights for %d items", len(weights), len(hayStack))
+	}
+	fzf.keysMutex.Lock()
+	defer fzf.keysMutex.Unlock()
+	if fzf.ended {
+		return nil
+	}
+	index := int32(fzf.keys.offset + len(fzf.keys.keys))
+	fzf.keys.keys = append(fzf.keys.keys, hayStack...)
+	for idx, hayStraw := range hayStack {
+		if weights != nil {
+			fzf.weights.set(index+int32(idx), weights[idx])
+		}
+		fzf.chunkList.Push(util.StringBytes(hayStraw))
+	}
+	fzf.requestIndex()
+	return nil
+}
+
+// SetWeight sets the weight of the item with the given HayIndex, which raises
+// (or, if negative, lowers) its rank with ByScore; see Options.WeightFormula.
+// Items start with weight 0, unless added by AppendWeighted. Searches after
+// the change don't reuse the earlier results for the chunk of the item.
+// Returns false if there is no such item.
+func (fzf *Fzf) SetWeight(hayIndex int32, weight int32) bool {
+	chunk := fzf.chunkList.chunkOf(int(hayIndex))
+	if chunk == nil {
+		return false
+	}
+	fzf.weights.set(hayIndex, weight)
+	fzf.matcher.Invalidate(chunk)
+	return true
+}
+
+// requestIndex signals the indexer, if there is one, to index the chunks that
+// are full
+func (fzf *Fzf) requestIndex() {
+	if fzf.indexRequests != nil {
+		select {
+		case fzf.indexRequests <- struct{}{}:
+		default:
+			// The indexer is signalled already
+		}
+	}
+}
+
+// snapshotKeys returns the keys of the items added so far. Append never
+// changes the keys that are already there, so the slice can be read without
+// holding the lock.
+func (fzf *Fzf) snapshotKeys() keyList {
+	fzf.keysMutex.Lock()
+	defer fzf.keysMutex.Unlock()
+	return fzf.keys
+}
+
 func (fzf *Fzf) Search(needle string) {
 	snapshot, _ := fzf.chunkList.Snapshot()
-	fzf.matcher.Reset(snapshot, needle, false, false, true, false)
+	fzf.matcher.Reset(snapshot, needle, fzf.preempt, false, true, false)
+}
+
+// Cancel stops the search that is running (or about to start). Instead of its
+// result, a SearchResult with Cancelled set is sent on the result channel.
+// If no search is running, nothing is sent.
+func (fzf *Fzf) Cancel() {
+	fzf.matcher.Cancel()
+}
+
+// Stats returns the cache counters and search timings collected so far
+func (fzf *Fzf) Stats() Stats {
+	var stats Stats
+	stats.ChunkCache, stats.ChunkCacheNarrowing, stats.MergerCache = fzf.matcher.Stats()
+	stats.PatternCache = fzf.patternCache.Stats()
+	fzf.searchStats.fill(&stats)
+	return stats
+}
+
+// ClearPatternCache forgets all parsed needles
+func (fzf *Fzf) ClearPatternCache() {
+	fzf.patternCache.Clear()
 }
 
 func (fzf *Fzf) End() {
-	fzf.matcher.reqBox.Set(EvtQuit, nil)
+	fzf.matcher.reqBox.Set(reqQuit, nil)
 	fzf.eventBox.Set(EvtQuit, nil)
-	close(fzf.resultChannel)
+	// Appending after End must not signal the closed indexer
+	fzf.keysMutex.Lock()
+	fzf.ended = true
+	if fzf.indexRequests != nil {
+		close(fzf.indexRequests)
+	}
+	fzf.keysMutex.Unlock()
+	close(fzf.quit)
 }
@@ -2,11 +2,20 @@ package fzf
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"reflect"
+	"runtime"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/reinhrst/fzf-lib/algo"
+	"github.com/reinhrst/fzf-lib/util"
 )
 
 var hayStack = []string{
@@ -27,6 +36,50 @@ func searchHayStack(opts Options, needles []string) []SearchResult {
 	return results
 }
 
+// readQuotes returns the text of the quotes fixture
+func readQuotes() string {
+	quoteBytes, err := os.ReadFile("testdata/quotes.txt")
+	if err != nil {
+		panic(err)
+	}
+	return string(quoteBytes)
+}
+
+// loadQuotes returns the lines of the quotes fixture
+func loadQuotes() []string {
+	return strings.Split(readQuotes(), "\n")
+}
+
+// checkPositions checks that the needle matches the item with the options at
+// the expected positions, as returned by positions (or the Positions of the
+// match if it is nil), or that it doesn't match if expected is nil
+func checkPositions(t *testing.T, opts Options, needle string, item string, expected []int,
+	positions func(MatchResult) []int) {
+	t.Helper()
+	matches := Filter([]string{item}, needle, opts)
+	if expected == nil {
+		if len(matches) != 0 {
+			t.Errorf("Expected %q not to match %q (folding %d, normalization %d)",
+				needle, item, opts.CaseFolding, opts.Normalize)
+		}
+		return
+	}
+	if len(matches) != 1 {
+		t.Errorf("Expected %q to match %q (folding %d, normalization %d)",
+			needle, item, opts.CaseFolding, opts.Normalize)
+		return
+	}
+	got := matches[0].Positions
+	if positions != nil {
+		got = positions(matches[0])
+	}
+	got = append([]int(nil), got...)
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected positions %v for %q in %q, got %v", expected, needle, item, got)
+	}
+}
+
 func TestSearch(t *testing.T) {
 	result := searchHayStack(DefaultOptions(), []string{`pe a`})[0]
 	if len(result.Matches) != 4 {
@@ -145,3 +198,1281 @@ func BenchmarkQuotes(b *testing.B) {
 			func(b *testing.B) { benchmarkQuotes(nr_quotes, b) })
 	}
 }
+
+// BenchmarkSortResults sorts the matches of a needle that most quotes match,
+// many with equal points, with the default criteria
+func BenchmarkSortResults(b *testing.B) {
+	quotes := loadQuotes()
+	for len(quotes) < 1<<16 {
+		quotes = append(quotes, quotes...)
+	}
+	myFzf := New(quotes, DefaultOptions())
+	defer myFzf.End()
+	pattern := myFzf.matcher.patternBuilder(`e`)
+	chunks, _ := myFzf.chunkList.Snapshot()
+	var results []Result
+	for _, chunk := range chunks {
+		for idx := 0; idx < chunk.count; idx++ {
+			if match, _, _ := pattern.MatchItem(&chunk.items[idx], false, nil); match != nil {
+				results = append(results, *match)
+			}
+		}
+	}
+	sorted := make([]Result, len(results))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(sorted, results)
+		sortResults(sorted, false)
+	}
+}
+
+func TestChunkCacheEviction(t *testing.T) {
+	chunks := make([]*Chunk, 3)
+	for i := range chunks {
+		chunks[i] = &Chunk{count: chunkSize}
+	}
+	patternCache := NewPatternCache(0)
+	foo := BuildPattern(true, nil, true, CaseSmart, FoldLower, NormalizeLatin, true, `foo`, nil, nil, true, nil, nil, patternCache)
+	food := BuildPattern(true, nil, true, CaseSmart, FoldLower, NormalizeLatin, true, `food`, nil, nil, true, nil, nil, patternCache)
+	list := []Result{{item: &chunks[0].items[0], positions: &[]int{}}}
+	budget := 2 * cacheEntrySize(foo.CacheKey(), list)
+	cache := NewChunkCache(budget)
+	cache.Add(chunks[0], foo, list)
+	cache.Add(chunks[1], foo, list)
+	// Touch the first entry, so that the second one is the least recently used
+	if cache.Lookup(chunks[0], foo) == nil {
+		t.Errorf("Expected cache hit for first chunk")
+	}
+	cache.Add(chunks[2], foo, list)
+	if cache.Len() != 2 || cache.Size() > budget {
+		t.Errorf("Cache exceeds budget: %d entries, %d/%d bytes", cache.Len(), cache.Size(), budget)
+	}
+	if cache.Lookup(chunks[1], foo) != nil {
+		t.Errorf("Expected least recently used entry to be evicted")
+	}
+	if cache.Search(chunks[0], food) == nil {
+		t.Errorf("Expected search to narrow down using cached entry")
+	}
+}
+
+func BenchmarkChunkCacheSearch(b *testing.B) {
+	chunk := &Chunk{count: chunkSize}
+	list := []Result{{item: &chunk.items[0]}}
+	patternCache := NewPatternCache(0)
+	build := func(needle string) *Pattern {
+		return BuildPattern(true, nil, true, CaseSmart, FoldLower, NormalizeLatin, true, needle, nil, nil, true, nil, nil, patternCache)
+	}
+	// The results of many earlier searches are cached for the chunk
+	cache := NewChunkCache(0)
+	for i := 0; i < 1000; i++ {
+		cache.Add(chunk, build(fmt.Sprintf("query%d", i)), list)
+	}
+	cache.Add(chunk, build(`life`), list)
+	pattern := build(`life 'is !the`)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if cache.Search(chunk, pattern) == nil {
+			b.Fatal("Expected the cached results of life to be used")
+		}
+	}
+}
+
+func TestPatternNarrows(t *testing.T) {
+	patternCache := NewPatternCache(0)
+	build := func(needle string) *Pattern {
+		return BuildPattern(true, nil, true, CaseSmart, FoldLower, NormalizeLatin, true, needle, nil, nil, true, nil, nil, patternCache)
+	}
+	tables := []struct {
+		needle  string
+		weaker  string
+		narrows bool
+	}{
+		{`foo`, `fo`, true},
+		{`foo`, `oo`, true},
+		{`fxoxo`, `foo`, true},
+		{`foo !test`, `foo`, true},
+		{`foo 'bar`, `'bar`, true},
+		{`foo 'bar`, `ba`, false},
+		{`foo 'bar`, `ar foo`, false},
+		{`^foo`, `'oo`, true},
+		{`^foo`, `fo`, false},
+		{`foo$`, `oo$`, true},
+		{`^foo$`, `^fo`, true},
+		{`foo | bar`, `foo`, false},
+		{`foo`, `foo | bar`, true},
+		{`!test`, `!testing`, true},
+		{`!testing`, `!test`, false},
+		{`Foo`, `fo`, false},
+		{`fo`, `foo`, false},
+	}
+	for _, table := range tables {
+		pattern := build(table.needle)
+		weaker := build(table.weaker)
+		if narrows := pattern.narrows(weaker.cacheTermSets); narrows != table.narrows {
+			t.Errorf("Expected %q narrows %q to be %v", table.weaker, table.needle, table.narrows)
+		}
+	}
+	if build(`foo bar`).CacheKey() != build(`bar  foo`).CacheKey() {
+		t.Errorf("Expected cache key to be independent of term order")
+	}
+	// The weaker patterns that the cache looks up
+	keys := map[string]bool{}
+	for _, key := range build(`foo 'bar !baz`).narrowingKeys {
+		keys[key] = true
+	}
+	for _, weaker := range []string{`foo`, `fo`, `'bar`, `'ba`, `!baz`, `foo 'ar !baz`, `foo !baz`} {
+		if !keys[build(weaker).CacheKey()] {
+			t.Errorf("Expected %q to be looked up for %q", weaker, `foo 'bar !baz`)
+		}
+	}
+	for _, stronger := range []string{`foo 'bar !ba`, `!ba`, `food`} {
+		if keys[build(stronger).CacheKey()] {
+			t.Errorf("Unexpected lookup of %q for %q", stronger, `foo 'bar !baz`)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	myFzf := New(hayStack, DefaultOptions())
+	for _, needle := range []string{`pe`, `pe`} {
+		myFzf.Search(needle)
+		<-myFzf.GetResultChannel()
+	}
+	stats := myFzf.Stats()
+	myFzf.End()
+	if stats.Searches != 2 {
+		t.Errorf("Expected 2 searches, got %d", stats.Searches)
+	}
+	if stats.PatternCache.Hits != 1 || stats.PatternCache.Misses != 1 || stats.PatternCache.Entries != 1 {
+		t.Errorf("Unexpected pattern cache stats: %+v", stats.PatternCache)
+	}
+	if stats.MergerCache.Hits != 1 || stats.MergerCache.Misses != 1 || stats.MergerCache.Entries != 1 {
+		t.Errorf("Unexpected merger cache stats: %+v", stats.MergerCache)
+	}
+	if stats.LastSearch.Scan != 0 || stats.TotalSearch.Scan == 0 {
+		t.Errorf("Expected only the first search to scan, got %+v", stats)
+	}
+}
+
+func TestMergerCacheBudget(t *testing.T) {
+	items := make([]string, 100)
+	for i := range items {
+		items[i] = fmt.Sprintf("item %d", i)
+	}
+	opts := DefaultOptions()
+	opts.CacheBudget = 2 * len(items) * int(unsafe.Sizeof(Result{}))
+	myFzf := New(items, opts)
+	defer myFzf.End()
+	for i := 0; i < 100; i++ {
+		myFzf.Search(fmt.Sprintf("i%d", i))
+		<-myFzf.GetResultChannel()
+		myFzf.Append([]string{fmt.Sprintf("appended %d", i)})
+	}
+	stats := myFzf.Stats().MergerCache
+	if stats.Bytes > opts.CacheBudget || stats.Entries >= 100 {
+		t.Errorf("Expected the merger cache to stay within %d bytes, got %+v", opts.CacheBudget, stats)
+	}
+}
+
+func TestPatternCacheEviction(t *testing.T) {
+	cache := NewPatternCache(2)
+	build := func(needle string) *Pattern {
+		return BuildPattern(true, nil, true, CaseSmart, FoldLower, NormalizeLatin, true, needle, nil, nil, true, nil, nil, cache)
+	}
+	foo := build(`foo`)
+	build(`bar`)
+	if build(`foo`) != foo {
+		t.Errorf("Expected cached pattern for foo")
+	}
+	build(`baz`)
+	if cache.Lookup(`bar`) != nil || cache.Lookup(`foo`) != foo {
+		t.Errorf("Expected least recently used pattern to be evicted")
+	}
+	cache.Clear()
+	if stats := cache.Stats(); stats.Entries != 0 {
+		t.Errorf("Expected empty cache after Clear, got %+v", stats)
+	}
+}
+
+func rankings(result SearchResult) [][2]int {
+	ret := make([][2]int, len(result.Matches))
+	for idx, match := range result.Matches {
+		ret[idx] = [2]int{int(match.HayIndex), match.Score}
+	}
+	return ret
+}
+
+func TestCachedSearchConsistency(t *testing.T) {
+	quotes := loadQuotes()
+	needles := []string{`l`, `li`, `lif`, `life`, `life !the`, `life 'is`,
+		`'is`, `life 'is !the`, `ife`, `life | love`, `^The`, `^The life`}
+	cachedFzf := New(quotes, DefaultOptions())
+	defer cachedFzf.End()
+	for _, needle := range needles {
+		cachedFzf.Search(needle)
+		cached := <-cachedFzf.GetResultChannel()
+		uncachedFzf := New(quotes, DefaultOptions())
+		uncachedFzf.Search(needle)
+		uncached := <-uncachedFzf.GetResultChannel()
+		uncachedFzf.End()
+		// Positions of equally scoring alignments may differ, depending on
+		// what is left in the slab, so only compare the ranking
+		if !reflect.DeepEqual(rankings(cached), rankings(uncached)) {
+			t.Errorf("Cached results for %q differ: %d vs %d matches",
+				needle, len(cached.Matches), len(uncached.Matches))
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	quotes := loadQuotes()
+	for _, sortCriteria := range [][]Criterion{{ByScore, ByLength}, {}} {
+		opts := DefaultOptions()
+		opts.Sort = sortCriteria
+		appendingFzf := New(quotes[:150], opts)
+		for _, end := range []int{150, 230, 999, 1000, len(quotes)} {
+			_, count := appendingFzf.chunkList.Snapshot()
+			appendingFzf.Append(quotes[count:end])
+			for _, needle := range []string{`life`, `'is !the`} {
+				appendingFzf.Search(needle)
+				appended := <-appendingFzf.GetResultChannel()
+				freshFzf := New(quotes[:end], opts)
+				freshFzf.Search(needle)
+				fresh := <-freshFzf.GetResultChannel()
+				freshFzf.End()
+				if !reflect.DeepEqual(rankings(appended), rankings(fresh)) {
+					t.Errorf("Results for %q after appending up to %d differ: %d vs %d matches",
+						needle, end, len(appended.Matches), len(fresh.Matches))
+				}
+			}
+		}
+		appendingFzf.End()
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	quotes := loadQuotes()
+	pool := NewWorkerPool(2)
+	defer pool.Close()
+
+	expected := New(quotes, DefaultOptions())
+	expected.Search(`life`)
+	expectedResult := <-expected.GetResultChannel()
+	expected.End()
+
+	opts := DefaultOptions()
+	opts.Pool = pool
+	opts.Parallelism = 1
+	results := make(chan SearchResult)
+	for i := 0; i < 4; i++ {
+		go func() {
+			myFzf := New(quotes, opts)
+			myFzf.Search(`life`)
+			results <- <-myFzf.GetResultChannel()
+			myFzf.End()
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if result := <-results; !reflect.DeepEqual(rankings(result), rankings(expectedResult)) {
+			t.Errorf("Results using the pool differ: %d vs %d matches",
+				len(result.Matches), len(expectedResult.Matches))
+		}
+	}
+
+	// Without a pool, a search starts Parallelism goroutines, not one for each
+	// slice of the chunks
+	opts = DefaultOptions()
+	opts.Parallelism = 2
+	myFzf := New(quotes, opts)
+	defer myFzf.End()
+	var mostGoroutines int64
+	myFzf.matcher.chunkHook = func(*Chunk) {
+		goroutines := int64(runtime.NumGoroutine())
+		for most := atomic.LoadInt64(&mostGoroutines); goroutines > most; most = atomic.LoadInt64(&mostGoroutines) {
+			if atomic.CompareAndSwapInt64(&mostGoroutines, most, goroutines) {
+				break
+			}
+		}
+	}
+	before := runtime.NumGoroutine()
+	myFzf.Search(`life`)
+	<-myFzf.GetResultChannel()
+	if started := int(atomic.LoadInt64(&mostGoroutines)) - before; started > opts.Parallelism {
+		t.Errorf("Expected at most %d goroutines for the search, got %d", opts.Parallelism, started)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(DefaultOptions(), time.Hour)
+	defer registry.Close()
+	registry.Add(`fruit`, hayStack)
+	registry.Add(`other`, []string{`pineapple`})
+	if _, running := registry.Len(); running != 0 {
+		t.Errorf("Expected no running instances before searching, got %d", running)
+	}
+	result, err := registry.Search(`fruit`, `'pe`)
+	if err != nil || len(result.Matches) != 3 {
+		t.Errorf("Expected 3 results, got %d (%v)", len(result.Matches), err)
+	}
+	registry.Append(`fruit`, []string{`peach`})
+	result, _ = registry.Search(`fruit`, `'pe`)
+	if len(result.Matches) != 4 {
+		t.Errorf("Expected 4 results after appending, got %d", len(result.Matches))
+	}
+	if count, running := registry.Len(); count != 2 || running != 1 {
+		t.Errorf("Expected 2 haystacks with 1 running instance, got %d, %d", count, running)
+	}
+	registry.mutex.Lock()
+	registry.idleTimeout = time.Nanosecond
+	registry.mutex.Unlock()
+	registry.EvictIdle()
+	if _, running := registry.Len(); running != 0 {
+		t.Errorf("Expected idle instances to be evicted, got %d running", running)
+	}
+	result, _ = registry.Search(`fruit`, `'pe`)
+	if len(result.Matches) != 4 {
+		t.Errorf("Expected 4 results after eviction, got %d", len(result.Matches))
+	}
+	registry.Remove(`fruit`)
+	if _, err := registry.Search(`fruit`, `'pe`); err != ErrUnknownHaystack {
+		t.Errorf("Expected ErrUnknownHaystack, got %v", err)
+	}
+
+	// Appending doesn't write into the slice that was added
+	owned := make([]string, 1, 2)
+	owned[0] = `plum`
+	registry.Add(`owned`, owned)
+	registry.Append(`owned`, []string{`pear`})
+	if owned = owned[:2]; owned[1] != `` {
+		t.Errorf("Expected the added slice to be left alone, got %q", owned)
+	}
+
+	// Idle instances are evicted without further calls
+	idle := NewRegistry(DefaultOptions(), 10*time.Millisecond)
+	defer idle.Close()
+	idle.Add(`fruit`, hayStack)
+	idle.Search(`fruit`, `'pe`)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if _, running := idle.Len(); running == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected the idle instance to be evicted, got %d running", running)
+		}
+	}
+}
+
+func TestSlabPool(t *testing.T) {
+	var pool util.SlabPool
+	small := pool.Get(100, 10)
+	if len(small.I16) < 100 || len(small.I32) < 10 {
+		t.Errorf("Expected a slab of at least 100, 10, got %d, %d", len(small.I16), len(small.I32))
+	}
+	large := pool.Get(slab16Size, slab32Size)
+	pool.Put(large)
+	// A large slab is not handed out for a small search
+	for i := 0; i < 10; i++ {
+		if slab := pool.Get(100, 10); slab == large {
+			t.Errorf("Expected a small slab, got the large one")
+		} else {
+			pool.Put(slab)
+		}
+	}
+	// Slabs that were not taken from the pool serve the sizes they can hold
+	pool.Put(util.MakeSlab(300, 30))
+	if slab := pool.Get(256, 16); len(slab.I16) < 256 || len(slab.I32) < 16 {
+		t.Errorf("Expected a slab of at least 256, 16, got %d, %d", len(slab.I16), len(slab.I32))
+	}
+	pool.Put(util.MakeSlab(0, 0))
+}
+
+func TestLimit(t *testing.T) {
+	quoteBytes, err := os.ReadFile("testdata/quotes.txt")
+	if err != nil {
+		panic(err)
+	}
+	quotes := strings.Split(string(quoteBytes), "\n")
+	unlimitedFzf := New(quotes, DefaultOptions())
+	defer unlimitedFzf.End()
+	opts := DefaultOptions()
+	opts.Limit = 20
+	needles := []string{`life`, `'is !the`, `xyzzy`}
+	limitedFzf := New(quotes[:1050], opts)
+	defer limitedFzf.End()
+	// Search before appending, so that the cached results get extended
+	for _, needle := range needles {
+		limitedFzf.Search(needle)
+		<-limitedFzf.GetResultChannel()
+	}
+	limitedFzf.Append(quotes[1050:])
+
+	for _, needle := range needles {
+		unlimitedFzf.Search(needle)
+		unlimited := <-unlimitedFzf.GetResultChannel()
+		limitedFzf.Search(needle)
+		limited := <-limitedFzf.GetResultChannel()
+		if limited.Total != len(unlimited.Matches) || len(limited.Matches) > opts.Limit {
+			t.Errorf("Expected %d of %d matches for %q, got %d of %d", opts.Limit,
+				len(unlimited.Matches), needle, len(limited.Matches), limited.Total)
+		}
+		expected := unlimited
+		expected.Matches = expected.Matches[:len(limited.Matches)]
+		if !reflect.DeepEqual(rankings(limited), rankings(expected)) {
+			t.Errorf("Best matches for %q differ", needle)
+		}
+		// Paging beyond the limit returns the remaining matches in order
+		paged := limited
+		paged.Matches = append(limited.Matches, limitedFzf.Page(opts.Limit, limited.Total)...)
+		if !reflect.DeepEqual(rankings(paged), rankings(unlimited)) {
+			t.Errorf("Paged matches for %q differ", needle)
+		}
+	}
+}
+
+func TestCancel(t *testing.T) {
+	myFzf := New(loadQuotes(), DefaultOptions())
+	// The scan of the first chunk waits until the test lets it go on, so that
+	// the search is still running when it is cancelled or pre-empted
+	chunks, _ := myFzf.chunkList.Snapshot()
+	scanning := make(chan struct{})
+	proceed := make(chan struct{})
+	myFzf.matcher.chunkHook = func(chunk *Chunk) {
+		if chunk == chunks[0] {
+			scanning <- struct{}{}
+			<-proceed
+		}
+	}
+
+	myFzf.Search(`hello world`)
+	<-scanning
+	myFzf.Cancel()
+	proceed <- struct{}{}
+	result := <-myFzf.GetResultChannel()
+	if !result.Cancelled || result.Needle != `hello world` || len(result.Matches) != 0 {
+		t.Errorf("Expected cancelled result, got %d matches (cancelled: %v)",
+			len(result.Matches), result.Cancelled)
+	}
+
+	// A new search pre-empts the running one, whose result is never sent
+	myFzf.Search(`hello world`)
+	<-scanning
+	myFzf.Search(`'hell`)
+	proceed <- struct{}{}
+	<-scanning
+	proceed <- struct{}{}
+	result = <-myFzf.GetResultChannel()
+	if result.Cancelled || result.Needle != `'hell` {
+		t.Errorf("Expected result of second search, got %q (cancelled: %v)",
+			result.Needle, result.Cancelled)
+	}
+
+	// End drops a result that is not received, instead of closing the result
+	// channel while it is being sent
+	myFzf.Search(`life`)
+	<-scanning
+	proceed <- struct{}{}
+	time.Sleep(10 * time.Millisecond)
+	myFzf.End()
+	for range myFzf.GetResultChannel() {
+	}
+}
+
+func TestFilter(t *testing.T) {
+	quoteText := readQuotes()
+	// FilterReader doesn't see an item after the final newline
+	quotes := strings.Split(strings.TrimSuffix(quoteText, "\n"), "\n")
+	unsortedOpts := DefaultOptions()
+	unsortedOpts.Sort = []Criterion{}
+	limitedOpts := DefaultOptions()
+	limitedOpts.Limit = 10
+	tacOpts := DefaultOptions()
+	tacOpts.Tac = true
+	for _, opts := range []Options{DefaultOptions(), unsortedOpts, limitedOpts, tacOpts} {
+		myFzf := New(quotes, opts)
+		// Inverse-only needles keep the order of the items
+		for _, needle := range []string{``, `life`, `'is !the`, `xyzzy`, `!xyz`, `!the !a`} {
+			myFzf.Search(needle)
+			result := <-myFzf.GetResultChannel()
+			filtered := SearchResult{Matches: Filter(quotes, needle, opts)}
+			if !reflect.DeepEqual(rankings(filtered), rankings(result)) {
+				t.Errorf("Filter(%q) differs from Search", needle)
+			}
+
+			var expected strings.Builder
+			for _, match := range filtered.Matches {
+				expected.WriteString(match.Key + "\n")
+			}
+			var written strings.Builder
+			err := FilterReader(strings.NewReader(quoteText), &written, needle, opts)
+			if err != nil {
+				t.Errorf("FilterReader(%q) failed: %v", needle, err)
+			} else if written.String() != expected.String() {
+				t.Errorf("FilterReader(%q) differs from Filter", needle)
+			}
+		}
+		myFzf.End()
+	}
+
+	// Streaming doesn't allocate for the lines that it reads, however long
+	lines := "héllo wörld\n" + strings.Repeat("x", 10000) + "\nhello\n"
+	allocs := func(text string) float64 {
+		return testing.AllocsPerRun(5, func() {
+			FilterReader(strings.NewReader(text), io.Discard, `'wörldh`, unsortedOpts)
+		})
+	}
+	// The pools may drop what they hold, so a few more allocations are fine
+	if few, many := allocs(lines), allocs(strings.Repeat(lines, 100)); many > few+50 {
+		t.Errorf("Expected about as many allocations for 300 lines as for 3, got %v and %v", many, few)
+	}
+}
+
+func TestWithoutPositions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WithPositions = false
+	withoutPositions := searchHayStack(opts, []string{`ap pe`})[0]
+	withPositions := searchHayStack(DefaultOptions(), []string{`ap pe`})[0]
+	if !reflect.DeepEqual(rankings(withoutPositions), rankings(withPositions)) {
+		t.Errorf("Rankings differ without positions")
+	}
+	if len(withoutPositions.Matches) == 0 {
+		t.Errorf("Expected matches")
+	}
+	for idx, match := range withoutPositions.Matches {
+		if match.Positions != nil {
+			t.Errorf("Expected no positions for %q, got %v", match.Key, match.Positions)
+		}
+		expected := withPositions.Matches[idx].Positions
+		if positions := match.ComputePositions(); len(positions) != len(expected) {
+			t.Errorf("Expected positions like %v for %q, got %v", expected, match.Key, positions)
+		}
+	}
+	for _, match := range Filter([]string{`hello world`}, `hel owo`, opts) {
+		if match.Positions != nil || len(match.ComputePositions()) != 6 {
+			t.Errorf("Expected 6 lazy positions for %q, got %v", match.Key, match.ComputePositions())
+		}
+	}
+}
+
+func TestLongItemsAndManyCriteria(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Sort = []Criterion{ByLength}
+	hayStack := []string{
+		"a" + strings.Repeat("x", 100000),
+		"a" + strings.Repeat("x", 70000),
+		"a" + strings.Repeat("x", 80000),
+	}
+	var lengths []int
+	for _, match := range Filter(hayStack, "a", opts) {
+		lengths = append(lengths, len(match.Key))
+	}
+	if !reflect.DeepEqual(lengths, []int{70001, 80001, 100001}) {
+		t.Errorf("Expected items by length, got %v", lengths)
+	}
+
+	opts.Sort = []Criterion{ByLength, ByBegin, ByEnd, ByBegin, ByEnd, ByScore, ByLength, ByBegin, ByEnd, ByScore}
+	var keys []string
+	for _, match := range Filter([]string{"xxab", "ab", "xab"}, "ab", opts) {
+		keys = append(keys, match.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"ab", "xab", "xxab"}) {
+		t.Errorf("Expected items by length, got %v", keys)
+	}
+
+	// Criteria after the first 4 break the ties of those
+	opts.Sort = []Criterion{ByScore, ByScore, ByScore, ByScore, ByLength}
+	for _, limit := range []int{0, 2} {
+		opts.Limit = limit
+		var indexes []int32
+		for _, match := range Filter([]string{"abxx", "abx", "ab"}, "ab", opts) {
+			indexes = append(indexes, match.HayIndex)
+		}
+		if expected := []int32{2, 1, 0}[:len(indexes)]; len(indexes) == 0 || !reflect.DeepEqual(indexes, expected) {
+			t.Errorf("Expected items by length with limit %d, got %v", limit, indexes)
+		}
+	}
+	opts.Limit = 0
+
+	// A match in the trailing whitespace is at the end of the trimmed text,
+	// and items of only whitespace have nothing to divide by
+	opts.Sort = []Criterion{ByEnd}
+	keys = nil
+	for _, match := range Filter([]string{"zzzzzzzzzb z", "ab  ", "  "}, `b\ `, opts) {
+		keys = append(keys, match.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"ab  ", "zzzzzzzzzb z"}) {
+		t.Errorf("Expected items by end, got %v", keys)
+	}
+	if matches := Filter([]string{"  ", "a "}, `\ `, opts); len(matches) != 2 {
+		t.Errorf("Expected the items of whitespace to match, got %v", matches)
+	}
+}
+
+func TestCustomCriterion(t *testing.T) {
+	// Items of the current project first, then by HayIndex, descending
+	inProject := func(info SortInfo) int32 {
+		if strings.HasPrefix(info.Key(), "project/") {
+			return -1
+		}
+		return 0
+	}
+	hayIndexDesc := func(info SortInfo) int32 {
+		return -info.HayIndex
+	}
+	var hayStack []string
+	for i := 0; i < 1000; i++ {
+		if i%3 == 0 {
+			hayStack = append(hayStack, fmt.Sprintf("project/file%d", i))
+		} else {
+			hayStack = append(hayStack, fmt.Sprintf("other/file%d", i))
+		}
+	}
+	opts := DefaultOptions()
+	opts.CustomCriteria = []func(SortInfo) int32{inProject, hayIndexDesc}
+	opts.Sort = []Criterion{CustomCriterion(0), CustomCriterion(1)}
+	var expected []int32
+	for i := 999; i >= 0; i-- {
+		if i%3 == 0 {
+			expected = append(expected, int32(i))
+		}
+	}
+	for i := 999; i >= 0; i-- {
+		if i%3 != 0 {
+			expected = append(expected, int32(i))
+		}
+	}
+
+	myFzf := New(hayStack, opts)
+	defer myFzf.End()
+	myFzf.Search("file")
+	result := <-myFzf.GetResultChannel()
+	var hayIndexes []int32
+	for _, match := range result.Matches {
+		hayIndexes = append(hayIndexes, match.HayIndex)
+	}
+	if !reflect.DeepEqual(hayIndexes, expected) {
+		t.Errorf("Expected project items first, by descending HayIndex, got %v", hayIndexes)
+	}
+
+	hayIndexes = nil
+	for _, match := range Filter(hayStack, "file", opts) {
+		hayIndexes = append(hayIndexes, match.HayIndex)
+	}
+	if !reflect.DeepEqual(hayIndexes, expected) {
+		t.Errorf("Expected Filter to sort like Search, got %v", hayIndexes)
+	}
+
+	var infos []SortInfo
+	opts.CustomCriteria = []func(SortInfo) int32{func(info SortInfo) int32 {
+		infos = append(infos, info)
+		return 0
+	}}
+	opts.Sort = []Criterion{CustomCriterion(0)}
+	Filter([]string{"foo bar"}, "bar", opts)
+	if len(infos) != 1 || infos[0].Begin != 4 || infos[0].End != 7 || infos[0].Score <= 0 {
+		t.Errorf("Expected the match info of bar, got %+v", infos)
+	}
+	if allocs := testing.AllocsPerRun(10, func() { infos[0].Key() }); infos[0].Key() != "foo bar" || allocs != 0 {
+		t.Errorf("Expected the key without allocating, got %q and %v allocations", infos[0].Key(), allocs)
+	}
+}
+
+func TestWeights(t *testing.T) {
+	var hayStack []string
+	var weights []int32
+	for i := 0; i < 1000; i++ {
+		hayStack = append(hayStack, fmt.Sprintf("file%d", i))
+		weights = append(weights, 0)
+	}
+	weights[500] = 1000
+	myFzf := newFzf(newChunkList(nil), DefaultOptions())
+	if err := myFzf.AppendWeighted(hayStack, weights[:10]); err == nil {
+		t.Errorf("Expected an error for too few weights")
+	}
+	if err := myFzf.AppendWeighted(hayStack, weights); err != nil {
+		t.Errorf("Failed to append the weighted items: %v", err)
+	}
+	myFzf.start()
+	defer myFzf.End()
+	search := func(needle string) []MatchResult {
+		myFzf.Search(needle)
+		return (<-myFzf.GetResultChannel()).Matches
+	}
+
+	matches := search("file")
+	if matches[0].HayIndex != 500 || matches[0].Weight != 1000 {
+		t.Errorf("Expected the weighted item first, got %+v", matches[0])
+	}
+	if matches[0].Score != matches[1].Score {
+		t.Errorf("Expected the score without weight, got %d and %d", matches[0].Score, matches[1].Score)
+	}
+
+	// The cached results of the chunks of the changed items must not be
+	// used after a change, those of the other chunks are
+	search("file5")
+	if !myFzf.SetWeight(500, -1000) || !myFzf.SetWeight(999, 10) || myFzf.SetWeight(1000, 10) {
+		t.Errorf("Expected to set the weights of existing items only")
+	}
+	hits := myFzf.Stats().ChunkCache.Hits
+	search("file5")
+	if hits = myFzf.Stats().ChunkCache.Hits - hits; hits != 8 {
+		t.Errorf("Expected the cached results of 8 chunks to be used, got %d", hits)
+	}
+	matches = search("file")
+	if matches[0].HayIndex != 999 || matches[len(matches)-1].HayIndex != 500 {
+		t.Errorf("Expected the changed weights to be used, got %d first and %d last",
+			matches[0].HayIndex, matches[len(matches)-1].HayIndex)
+	}
+
+	opts := DefaultOptions()
+	opts.WeightFormula = func(score int, weight int32) int {
+		return score - int(weight)
+	}
+	myFzf2 := newFzf(newChunkList(nil), opts)
+	myFzf2.AppendWeighted(hayStack, weights)
+	myFzf2.start()
+	defer myFzf2.End()
+	myFzf2.Search("file")
+	matches = (<-myFzf2.GetResultChannel()).Matches
+	if matches[len(matches)-1].HayIndex != 500 {
+		t.Errorf("Expected the weight formula to be used, got %d last", matches[len(matches)-1].HayIndex)
+	}
+}
+
+func TestTacAndIndexCriteria(t *testing.T) {
+	var hayStack []string
+	for i := 0; i < 1000; i++ {
+		hayStack = append(hayStack, fmt.Sprintf("log line %d", i))
+	}
+	search := func(opts Options, needle string) []int32 {
+		myFzf := New(hayStack, opts)
+		defer myFzf.End()
+		myFzf.Search(needle)
+		var hayIndexes []int32
+		for _, match := range (<-myFzf.GetResultChannel()).Matches {
+			hayIndexes = append(hayIndexes, match.HayIndex)
+		}
+		var filtered []int32
+		for _, match := range Filter(hayStack, needle, opts) {
+			filtered = append(filtered, match.HayIndex)
+		}
+		if !reflect.DeepEqual(hayIndexes, filtered) {
+			t.Errorf("Expected Filter to sort like Search for %q", needle)
+		}
+		return hayIndexes
+	}
+	tac := DefaultOptions()
+	tac.Tac = true
+	tac.Sort = nil
+	tac.Limit = 10
+	for _, needle := range []string{``, `line`, `!xyz`} {
+		hayIndexes := search(tac, needle)
+		if len(hayIndexes) != 10 || hayIndexes[0] != 999 || hayIndexes[9] != 990 {
+			t.Errorf("Expected the last items first with Tac for %q, got %v", needle, hayIndexes)
+		}
+	}
+
+	for _, opts := range []Options{DefaultOptions(), tac} {
+		opts.Sort = []Criterion{ByIndexDesc}
+		if hayIndexes := search(opts, `line`); hayIndexes[0] != 999 || hayIndexes[1] != 998 {
+			t.Errorf("Expected descending HayIndex, got %v", hayIndexes)
+		}
+		opts.Sort = []Criterion{ByIndex}
+		if hayIndexes := search(opts, `line`); hayIndexes[0] != 0 || hayIndexes[1] != 1 {
+			t.Errorf("Expected ascending HayIndex, got %v", hayIndexes)
+		}
+	}
+
+	// Ties in ByBegin go to the last items with Tac
+	tac.Sort = []Criterion{ByBegin}
+	tac.Limit = 0
+	if hayIndexes := search(tac, `'99`); hayIndexes[0] != 999 || hayIndexes[10] != 99 {
+		t.Errorf("Expected the earliest matches, last items first, got %v", hayIndexes)
+	}
+
+	opts := DefaultOptions()
+	opts.Sort = []Criterion{ByPathDepth}
+	var keys []string
+	for _, match := range Filter([]string{"a/b/c/file", "a/file", "a/b/", "file", `a\b\file`}, "", opts) {
+		keys = append(keys, match.Key)
+	}
+	for _, match := range Filter([]string{"a/b/c/file", "a/file", "a/b/", "file", `a\b\file`}, "f", opts) {
+		keys = append(keys, match.Key)
+	}
+	expected := []string{"a/b/c/file", "a/file", "a/b/", "file", `a\b\file`,
+		"file", "a/file", `a\b\file`, "a/b/c/file"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected the items by path depth, got %v", keys)
+	}
+}
+
+func TestCaseFolding(t *testing.T) {
+	tables := []struct {
+		folding   CaseFolding
+		needle    string
+		item      string
+		positions []int
+	}{
+		{FoldLower, `strasse`, `Straße`, nil},
+		{FoldFull, `strasse`, `Straße`, []int{0, 1, 2, 3, 4, 5}},
+		{FoldFull, `'straß`, `STRASSE`, []int{0, 1, 2, 3, 4, 5}},
+		{FoldFull, `fil`, `ﬁle`, []int{0, 1}},
+		{FoldSimple, `strasse`, `Straße`, nil},
+		{FoldLower, `σοφοσ`, `ΣΟΦΟς`, nil},
+		{FoldSimple, `σοφοσ`, `ΣΟΦΟς`, []int{0, 1, 2, 3, 4}},
+		{FoldSimple, `^σοφος$`, `ΣΟΦΟΣ`, []int{0, 1, 2, 3, 4}},
+		{FoldSimple, `kelvin`, "\u212aelvin", []int{0, 1, 2, 3, 4, 5}},
+		{FoldSimple, `ſ`, `S`, []int{0}},
+		{FoldSimple, `ǆ`, `ǅ`, []int{0}},
+		{FoldSimple, `istanbul`, `ISTANBUL`, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{FoldSimple | FoldTurkish, `istanbul`, `ISTANBUL`, nil},
+		{FoldSimple | FoldTurkish, `istanbul`, `İSTANBUL`, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{FoldSimple | FoldTurkish, `ıi`, `Iİ`, []int{0, 1}},
+		{FoldLower | FoldTurkish, `ıi`, `Iİ`, []int{0, 1}},
+		{FoldSimple | FoldTurkish, `ı`, `i`, nil},
+		// Case sensitive needles are not folded
+		{FoldFull, `Strasse`, `Straße`, nil},
+	}
+	for _, table := range tables {
+		opts := DefaultOptions()
+		opts.CaseFolding = table.folding
+		// Normalization makes ı match i
+		if table.folding&FoldTurkish != 0 {
+			opts.Normalize = NormalizeNone
+		}
+		checkPositions(t, opts, table.needle, table.item, table.positions, nil)
+	}
+
+	// Items are folded once, when they are added, not on every search
+	opts := DefaultOptions()
+	opts.CaseFolding = FoldSimple | FoldTurkish
+	chunkList := newChunkList(newItemTransforms(opts.CaseFolding, opts.Normalize, nil))
+	chunkList.Push([]byte(`ISTANBUL`))
+	chunks, _ := chunkList.Snapshot()
+	pattern := newPatternBuilder(opts, nil, NewPatternCache(1))(`lubnatsı`)
+	slab := util.MakeSlab(slab16Size, slab32Size)
+	if allocs := testing.AllocsPerRun(10, func() { pattern.MatchItem(&chunks[0].items[0], false, slab) }); allocs != 0 {
+		t.Errorf("Expected no allocations to match a folded item, got %v", allocs)
+	}
+
+	// Characters in the same fold cycle are in the same index key
+	for _, runes := range [][]rune{{'s', 'ſ', 'S'}, {'σ', 'ς', 'Σ'}, {'k', '\u212a'}, {'i', 'ı', 'İ'}} {
+		for _, r := range runes {
+			if algo.FoldRune(r) != algo.FoldRune(runes[0]) {
+				t.Errorf("Expected %q to fold like %q", r, runes[0])
+			}
+		}
+	}
+}
+
+func TestNormalization(t *testing.T) {
+	tables := []struct {
+		normalization Normalization
+		needle        string
+		item          string
+		positions     []int
+	}{
+		{NormalizeNone, `cafe`, `café`, nil},
+		{NormalizeLatin, `cafe`, `café`, []int{0, 1, 2, 3}},
+		{NormalizeLatin, `καφε`, `καφέ`, nil},
+		{NormalizeDiacritics, `cafe`, `café`, []int{0, 1, 2, 3}},
+		{NormalizeDiacritics, `καφε`, `ΚΑΦΈ`, []int{0, 1, 2, 3}},
+		{NormalizeDiacritics, `'мои`, `мой`, []int{0, 1, 2}},
+		{NormalizeDiacritics, `viet`, `Việt`, []int{0, 1, 2, 3}},
+		{NormalizeDiacritics, `file`, `ﬁle`, nil},
+		{NormalizeCompatibility, `file`, `ﬁle`, []int{0, 1, 2}},
+		{NormalizeCompatibility, `abc`, `ＡＢＣ`, []int{0, 1, 2}},
+		{NormalizeCompatibility, `x2`, `x²`, []int{0, 1}},
+		{NormalizeCompatibility, `e^`, `ệ^`, []int{0, 1}},
+		// Needles with diacritics are not normalized
+		{NormalizeDiacritics, `καφέ`, `καφε`, nil},
+		{NormalizeCompatibility, `ﬁle`, `file`, nil},
+	}
+	for _, table := range tables {
+		opts := DefaultOptions()
+		opts.Normalize = table.normalization
+		checkPositions(t, opts, table.needle, table.item, table.positions, nil)
+	}
+}
+
+func TestTransliteration(t *testing.T) {
+	tables := []struct {
+		needle    string
+		item      string
+		positions []int
+	}{
+		{`moskva`, `Москва`, []int{0, 1, 2, 3, 4, 5}},
+		{`Moskva`, `Москва`, []int{0, 1, 2, 3, 4, 5}},
+		{`'shch`, `борщ`, []int{3}},
+		{`^borshch$`, `борщ`, []int{0, 1, 2, 3}},
+		{`kiev`, `Київ`, nil},
+		{`kyiv`, `Київ`, []int{0, 2, 3}},
+		{`athina`, `Αθήνα`, []int{0, 1, 2, 3, 4}},
+		{`tokyo`, `とうきょう`, []int{0, 2, 3}},
+		{`'kyou`, `トウキョウ`, []int{2, 3, 4}},
+		{`'nippon`, `にっぽん`, []int{0, 1, 2, 3}},
+		{`'matcha`, `まっちゃ`, []int{0, 1, 2, 3}},
+		{`moskva 2`, `Москва 2`, []int{0, 1, 2, 3, 4, 5, 7}},
+		{`москва`, `Москва`, []int{0, 1, 2, 3, 4, 5}},
+		{`paris`, `Москва`, nil},
+	}
+	opts := DefaultOptions()
+	opts.Transliterate = Transliterators(TransliterateCyrillic, TransliterateGreek, TransliterateKana)
+	for _, table := range tables {
+		checkPositions(t, opts, table.needle, table.item, table.positions, nil)
+	}
+
+	// The index does not hide the transliterated items
+	hayStack := make([]string, 3*chunkSize)
+	for i := range hayStack {
+		hayStack[i] = fmt.Sprintf("item %d", i)
+	}
+	hayStack[chunkSize+1] = `Москва`
+	opts.Index = true
+	myFzf := New(hayStack, opts)
+	defer myFzf.End()
+	chunks, _ := myFzf.chunkList.Snapshot()
+	for _, chunk := range chunks {
+		for chunk.IsFull() && chunk.getIndex() == nil {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	myFzf.Search(`'moskva`)
+	result := <-myFzf.GetResultChannel()
+	if len(result.Matches) != 1 || int(result.Matches[0].HayIndex) != chunkSize+1 {
+		t.Errorf("Expected the transliterated item to match, got %v", rankings(result))
+	}
+
+	// Only the chunks with transliterated items are copied from a snapshot,
+	// and they keep their index
+	path := t.TempDir() + "/haystack.fzf"
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	if err := myFzf.WriteSnapshot(file, nil, nil); err != nil {
+		t.Fatalf("Writing the snapshot failed: %v", err)
+	}
+	file.Close()
+	snapshot, err := OpenSnapshot(path)
+	if err != nil {
+		t.Fatalf("Opening the snapshot failed: %v", err)
+	}
+	defer snapshot.Close()
+	restored := NewFromSnapshot(snapshot, opts)
+	defer restored.End()
+	chunks, _ = restored.chunkList.Snapshot()
+	if chunks[0] != snapshot.chunks[0] {
+		t.Errorf("Expected the chunk without transliterated items to be shared")
+	}
+	if chunks[1] == snapshot.chunks[1] || chunks[1].getIndex() == nil ||
+		chunks[1].getIndex() != snapshot.chunks[1].getIndex() {
+		t.Errorf("Expected the chunk with a transliterated item to be copied with its index")
+	}
+	restored.Search(`'moskva`)
+	result = <-restored.GetResultChannel()
+	if len(result.Matches) != 1 || int(result.Matches[0].HayIndex) != chunkSize+1 {
+		t.Errorf("Expected the transliterated item of the snapshot to match, got %v", rankings(result))
+	}
+
+	// Ukrainian is romanized differently than Russian
+	opts = DefaultOptions()
+	opts.Transliterate = TransliterateUkrainian
+	for _, table := range []struct {
+		needle    string
+		item      string
+		positions []int
+	}{
+		{`kyiv`, `Київ`, []int{0, 1, 2, 3}},
+		{`kharkiv`, `Харків`, []int{0, 1, 2, 3, 4, 5}},
+		{`zaporizhzhia`, `Запоріжжя`, []int{0, 1, 2, 3, 4, 5, 6, 7, 8}},
+		{`yevropa`, `Європа`, []int{0, 1, 2, 3, 4, 5}},
+		{`kiev`, `Киев`, nil},
+	} {
+		checkPositions(t, opts, table.needle, table.item, table.positions, nil)
+	}
+
+	// The transliterated text is folded like the item
+	opts = DefaultOptions()
+	opts.CaseFolding = FoldSimple | FoldTurkish
+	opts.Normalize = NormalizeNone
+	opts.Transliterate = TransliterateCyrillic
+	checkPositions(t, opts, `ıvan`, `Иван`, []int{0, 1, 2, 3}, nil)
+	checkPositions(t, opts, `ivan`, `Иван`, nil, nil)
+}
+
+func TestGraphemes(t *testing.T) {
+	// e with an acute accent, a thumbs up with a skin tone, the German flag, a
+	// wide character, and a family joined with zero width joiners
+	key := "e\u0301te \U0001F44D\U0001F3FD\U0001F1E9\U0001F1EA\u4E2D \U0001F469\u200D\U0001F469\u200D\U0001F467x"
+	tables := []struct {
+		needle    string
+		graphemes []int
+		utf16     []int
+		bytes     []int
+	}{
+		{"'\u0301t", []int{0, 1}, []int{1, 2}, []int{1, 3}},
+		{"'\U0001F3FD", []int{4}, []int{7}, []int{10}},
+		{"'\U0001F1EA\u4E2D", []int{5, 6}, []int{11, 13}, []int{18, 22}},
+		{"'\U0001F467x", []int{8, 9}, []int{21, 23}, []int{40, 44}},
+	}
+	for _, table := range tables {
+		checkPositions(t, DefaultOptions(), table.needle, key, table.graphemes, MatchResult.GraphemePositions)
+		checkPositions(t, DefaultOptions(), table.needle, key, table.utf16, MatchResult.UTF16Positions)
+		checkPositions(t, DefaultOptions(), table.needle, key, table.bytes, MatchResult.BytePositions)
+	}
+
+	matches := Filter([]string{key}, `'te`, DefaultOptions())
+	expected := []Grapheme{
+		{Rune: 0, Runes: 2, Byte: 0, UTF16: 0, Column: 0, Width: 1},
+		{Rune: 2, Runes: 1, Byte: 3, UTF16: 2, Column: 1, Width: 1, Matched: true},
+		{Rune: 3, Runes: 1, Byte: 4, UTF16: 3, Column: 2, Width: 1, Matched: true},
+		{Rune: 4, Runes: 1, Byte: 5, UTF16: 4, Column: 3, Width: 1},
+		{Rune: 5, Runes: 2, Byte: 6, UTF16: 5, Column: 4, Width: 2},
+		{Rune: 7, Runes: 2, Byte: 14, UTF16: 9, Column: 6, Width: 2},
+		{Rune: 9, Runes: 1, Byte: 22, UTF16: 13, Column: 8, Width: 2},
+		{Rune: 10, Runes: 1, Byte: 25, UTF16: 14, Column: 10, Width: 1},
+		{Rune: 11, Runes: 5, Byte: 26, UTF16: 15, Column: 11, Width: 2},
+		{Rune: 16, Runes: 1, Byte: 44, UTF16: 23, Column: 13, Width: 1},
+	}
+	if graphemes := matches[0].Graphemes(); !reflect.DeepEqual(graphemes, expected) {
+		t.Errorf("Expected graphemes %v, got %v", expected, graphemes)
+	}
+
+	// Combining marks, variation selectors and Hangul jamos
+	for _, table := range []struct {
+		text   string
+		starts []int
+		width  int
+	}{
+		{"a\u0308\u0323b", []int{0, 3}, 2},
+		{"\u2764\uFE0F\u2764", []int{0, 2}, 3},
+		{"\u1100\u1161\u11A8\uAC00", []int{0, 3}, 4},
+		{"\r\n\U0001F1E9\U0001F1EA\U0001F1EB", []int{0, 2, 4}, 4},
+		{"\uFF21\u0600a", []int{0, 1}, 4},
+	} {
+		runes := []rune(table.text)
+		starts := util.GraphemeStarts(runes)
+		width := 0
+		for idx, start := range starts {
+			end := len(runes)
+			if idx+1 < len(starts) {
+				end = starts[idx+1]
+			}
+			width += util.GraphemeWidth(runes[start:end])
+		}
+		if !reflect.DeepEqual(starts, table.starts) || width != table.width {
+			t.Errorf("Expected %v and width %d for %q, got %v and %d", table.starts, table.width, table.text, starts, width)
+		}
+	}
+}
+
+func TestKeysAreNotCopied(t *testing.T) {
+	hayStack := []string{`hello world`, `héllo wörld`}
+	myFzf := New(hayStack[:1], DefaultOptions())
+	defer myFzf.End()
+	myFzf.Append(hayStack[1:])
+	myFzf.Search(`hello`)
+	result := <-myFzf.GetResultChannel()
+	matches := append(result.Matches, Filter(hayStack, `hello`, DefaultOptions())...)
+	if len(matches) != 4 {
+		t.Fatalf("Expected 4 matches, got %d", len(matches))
+	}
+	for _, match := range matches {
+		original := hayStack[match.HayIndex]
+		if (*reflect.StringHeader)(unsafe.Pointer(&match.Key)).Data !=
+			(*reflect.StringHeader)(unsafe.Pointer(&original)).Data {
+			t.Errorf("Expected %q to be the original string", match.Key)
+		}
+		if string(match.KeyBytes()) != original || string(match.KeyRunes()) != original {
+			t.Errorf("Expected bytes and runes of %q", original)
+		}
+		if &match.KeyBytes()[0] != &util.StringBytes(original)[0] {
+			t.Errorf("Expected the bytes of %q to be the original string", original)
+		}
+	}
+}
+
+func TestCharMask(t *testing.T) {
+	patternCache := NewPatternCache(0)
+	tables := []struct {
+		needle string
+		item   string
+		match  bool
+	}{
+		{`hlo`, `Hello`, true},
+		{`hlo`, `Help`, false},
+		{`'is !the`, `this`, true},
+		{`'is !the`, `the ice`, false},
+		{`ab | zz`, `bzz`, true},
+		{`cafe`, `Café`, true},
+		{`^12 .go$`, `123.go`, true},
+		{`ecole`, `ÉCOLE`, true},
+		{`'k`, "\u212a", true},
+		{`ecole`, `ÉCOL`, false},
+	}
+	for _, table := range tables {
+		pattern := BuildPattern(true, algo.FuzzyMatchV2, true, CaseSmart, FoldLower, NormalizeLatin, true,
+			table.needle, nil, nil, false, nil, nil, patternCache)
+		var item Item
+		item.setText([]byte(table.item))
+		masked := item.charMask&pattern.charMask == pattern.charMask
+		match, _, _ := pattern.MatchItem(&item, false, nil)
+		if (match != nil) != table.match || table.match && !masked {
+			t.Errorf("Expected %q to match %q: %v, masked: %v", table.needle, table.item, table.match, masked)
+		}
+	}
+	chunkList := newChunkList(nil)
+	for _, hayStraw := range hayStack {
+		chunkList.Push([]byte(hayStraw))
+	}
+	chunks, _ := chunkList.Snapshot()
+	pattern := BuildPattern(true, algo.FuzzyMatchV2, true, CaseSmart, FoldLower, NormalizeLatin, true,
+		`xyz`, nil, nil, false, nil, nil, patternCache)
+	if len(pattern.Match(chunks[0], nil, nil, nil)) != 0 ||
+		chunks[0].charMask&pattern.charMask == pattern.charMask {
+		t.Errorf("Expected the chunk to be skipped for %q", `xyz`)
+	}
+	if empty := util.ToChars([]byte{}); algo.CharMask(&empty) != 0 {
+		t.Errorf("Expected no characters in empty text")
+	}
+}
+
+func TestIndex(t *testing.T) {
+	quotes := loadQuotes()
+	quotes = append(quotes, `ȺBC Café`, `ɢreat ÉCOLE`, `Kelvin`, `Straße ﬁne`)
+	needles := []string{`'the`, `^the`, `ing.$`, `^great$`, `'abc`, `'ecole`, `kel`,
+		`'kelvin`, `straße`, `'The | 'ing`, `'the !a`, `hello world`, `Life`}
+	for _, caseMode := range []Case{CaseSmart, CaseIgnore, CaseRespect} {
+		for _, fuzzy := range []bool{true, false} {
+			opts := DefaultOptions()
+			opts.CaseMode = caseMode
+			opts.Fuzzy = fuzzy
+			opts.Index = true
+			myFzf := New(quotes, opts)
+			chunks, _ := myFzf.chunkList.Snapshot()
+			for _, chunk := range chunks {
+				for chunk.IsFull() && chunk.getIndex() == nil {
+					time.Sleep(time.Millisecond)
+				}
+			}
+			for _, needle := range needles {
+				myFzf.Search(needle)
+				result := <-myFzf.GetResultChannel()
+				expected := SearchResult{Matches: Filter(quotes, needle, opts)}
+				if !reflect.DeepEqual(rankings(result), rankings(expected)) {
+					t.Errorf("Indexed search for %q (case %d, fuzzy %v) differs", needle, caseMode, fuzzy)
+				}
+			}
+			myFzf.End()
+			// Appending after End does nothing
+			myFzf.Append([]string{`appended`})
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	quotes := loadQuotes()
+	quotes = append(quotes, `ȺBC Café`, `ɢreat ÉCOLE`, `Kelvin`)
+	opts := DefaultOptions()
+	opts.Index = true
+	original := New(quotes, opts)
+	defer original.End()
+	path := t.TempDir() + "/haystack.fzf"
+	file, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	history, err := NewHistory(t.TempDir()+"/history", 10)
+	if err != nil {
+		panic(err)
+	}
+	history.append(`life`)
+	history.append(`café`)
+	frecency := NewFrecency()
+	now := time.Now()
+	frecency.visitAt(`Kelvin`, now)
+	frecency.visitAt(`Kelvin`, now)
+	frecency.visitAt(`ȺBC Café`, now.Add(-30*time.Hour))
+	if err := original.WriteSnapshot(file, history, frecency); err != nil {
+		t.Fatalf("Failed to write snapshot: %v", err)
+	}
+	file.Close()
+
+	snapshot, err := OpenSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to open snapshot: %v", err)
+	}
+	defer snapshot.Close()
+	restoredHistory := snapshot.History(t.TempDir()+"/history", 10)
+	if snapshot.Len() != len(quotes) || !reflect.DeepEqual(restoredHistory.lines, []string{`life`, `café`, ``}) {
+		t.Errorf("Expected %d items and history %v, got %d and %v",
+			len(quotes), history.lines, snapshot.Len(), restoredHistory.lines)
+	}
+	if restoredHistory.previous() != `café` || restoredHistory.append(`ecole`) != nil {
+		t.Errorf("Expected the restored history to be usable")
+	}
+	restoredFrecency := snapshot.Frecency()
+	for _, key := range []string{`Kelvin`, `ȺBC Café`, `life`} {
+		if restoredFrecency.weightAt(key, now) != frecency.weightAt(key, now) {
+			t.Errorf("Expected weight %d for %q, got %d",
+				frecency.weightAt(key, now), key, restoredFrecency.weightAt(key, now))
+		}
+	}
+	if frecency.weightAt(`Kelvin`, now) != 8 || frecency.weightAt(`ȺBC Café`, now) != 1 {
+		t.Errorf("Unexpected frecency weights")
+	}
+	for _, chunk := range snapshot.chunks {
+		if chunk.IsFull() && chunk.getIndex() == nil {
+			t.Errorf("Expected the index to be stored")
+		}
+		for idx := 0; idx < chunk.count; idx++ {
+			// The items are used in place, unless the byte order differs
+			text := &chunk.items[idx].text
+			start := uintptr(unsafe.Pointer(&snapshot.data[0]))
+			if text.Length() > 0 && !text.IsBytes() && littleEndian {
+				if addr := uintptr(unsafe.Pointer(&text.ToRunes()[0])); addr < start || addr >= start+uintptr(len(snapshot.data)) {
+					t.Errorf("Expected %q to point into the snapshot", text.ToString())
+				}
+			}
+		}
+	}
+	opts.Index = false
+	restored := NewFromSnapshot(snapshot, opts)
+	defer restored.End()
+
+	// The weights of Fzf objects from the same snapshot are their own
+	weighted := NewFromSnapshot(snapshot, opts)
+	defer weighted.End()
+	weighted.SetWeight(0, 1000)
+	weighted.Search(``)
+	restored.Search(``)
+	if match := (<-weighted.GetResultChannel()).Matches[0]; match.Weight != 1000 {
+		t.Errorf("Expected weight 1000, got %d", match.Weight)
+	}
+	if match := (<-restored.GetResultChannel()).Matches[0]; match.Weight != 0 {
+		t.Errorf("Expected the weight of another Fzf object to be 0, got %d", match.Weight)
+	}
+	restored.Append([]string{`appended life`})
+	original.Append([]string{`appended life`})
+	for _, needle := range []string{`life`, `'the !a`, `^great$`, `ecole`, ``} {
+		original.Search(needle)
+		expected := <-original.GetResultChannel()
+		restored.Search(needle)
+		result := <-restored.GetResultChannel()
+		if !reflect.DeepEqual(rankings(result), rankings(expected)) {
+			t.Errorf("Search for %q on the snapshot differs", needle)
+			continue
+		}
+		for idx, match := range result.Matches {
+			if match.Key != expected.Matches[idx].Key {
+				t.Errorf("Expected key %q, got %q", expected.Matches[idx].Key, match.Key)
+			}
+		}
+	}
+
+	truncated := t.TempDir() + "/truncated.fzf"
+	data, _ := os.ReadFile(path)
+	os.WriteFile(truncated, data[:len(data)/2], 0600)
+	if _, err := OpenSnapshot(truncated); err != ErrInvalidSnapshot {
+		t.Errorf("Expected an invalid snapshot, got %v", err)
+	}
+}
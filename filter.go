@@ -0,0 +1,204 @@
+package fzf
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+
+	"github.com/reinhrst/fzf-lib/util"
+)
+
+// Size of the blocks that FilterReader copies the lines to
+const lineBlockSize = 64 * 1024
+
+// Filter searches the needle in the haystack and returns the matches, like a
+// single Search on an Fzf object, but synchronously on the calling goroutine.
+// The matches are in the same order as a Search would return them, ties
+// being broken by HayIndex (reversed with Options.Tac), so the result does not
+// depend on timing. Only Options.Limit, Options.WithPositions and the options
+// that determine the matching and the sorting are used.
+func Filter(hayStack []string, needle string, opts Options) []MatchResult {
+	chunkList := newChunkList(newItemTransforms(opts.CaseFolding, opts.Normalize, opts.Transliterate))
+	// The items are matched in the memory of the strings
+	for _, hayStraw := range hayStack {
+		chunkList.Push(util.StringBytes(hayStraw))
+	}
+	chunks, _ := chunkList.Snapshot()
+	pattern := newPatternBuilder(opts, nil, NewPatternCache(1))(needle)
+
+	merger := filterChunks(chunks, pattern, pattern.withPos, opts.Limit, opts.Tac)
+	count := merger.Length()
+	if opts.Limit > 0 {
+		count = util.Min(count, opts.Limit)
+	}
+	var timings SearchTimings
+	return matchResults(merger, keyList{keys: hayStack}, 0, count, &timings)
+}
+
+// FilterReader reads the haystack from r, one item per line, and writes the
+// items that match the needle to w, one per line, in the same order as Filter
+// would return them. If opts.Sort is empty and opts.Tac is not set, the items
+// are written as soon as they are read; otherwise they are written once r is
+// exhausted.
+func FilterReader(r io.Reader, w io.Writer, needle string, opts Options) error {
+	pattern := newPatternBuilder(opts, nil, NewPatternCache(1))(needle)
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	transforms := newItemTransforms(opts.CaseFolding, opts.Normalize, opts.Transliterate)
+
+	if len(opts.Sort) == 0 && !opts.Tac {
+		err := streamLines(reader, writer, pattern, opts.Limit, transforms)
+		if err != nil {
+			return err
+		}
+		return writer.Flush()
+	}
+
+	chunkList := newChunkList(transforms)
+	// The reader reuses its buffer, so the lines are copied, to blocks that
+	// many lines share
+	var block []byte
+	err := readLines(reader, func(line []byte) bool {
+		if len(block)+len(line) > cap(block) {
+			block = make([]byte, 0, util.Max(lineBlockSize, len(line)))
+		}
+		block = append(block, line...)
+		chunkList.Push(block[len(block)-len(line) : len(block) : len(block)])
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	chunks, _ := chunkList.Snapshot()
+	merger := filterChunks(chunks, pattern, false, opts.Limit, opts.Tac)
+	count := merger.Length()
+	if opts.Limit > 0 {
+		count = util.Min(count, opts.Limit)
+	}
+	for i := 0; i < count; i++ {
+		if err := writeLine(writer, merger.Get(i).item); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// filterChunks matches the pattern against all items of the chunks on the
+// calling goroutine, and returns a Merger with the matches sorted (or, with a
+// limit, the best limit matches sorted and the rest not), unless the pattern
+// is not sortable
+func filterChunks(chunks []*Chunk, pattern *Pattern, withPos bool, limit int, tac bool) *Merger {
+	if pattern.IsEmpty() {
+		return PassMerger(pattern, &chunks, tac)
+	}
+	slab := slabPool.Get(slabSizes(chunks, pattern))
+	defer slabPool.Put(slab)
+
+	var matches []Result
+	for _, chunk := range chunks {
+		if chunk.charMask&pattern.charMask != pattern.charMask {
+			continue
+		}
+		for idx := 0; idx < chunk.count; idx++ {
+			if match, _, _ := pattern.MatchItem(&chunk.items[idx], withPos, slab); match != nil {
+				matches = append(matches, *match)
+			}
+		}
+	}
+	if !pattern.sortable {
+		// Like a Search, inverse-only patterns keep the order of the items
+		return NewLimitedMerger(pattern, [][]Result{matches}, nil, false, tac, limit)
+	}
+	best, rest := selectBest(matches, limit, tac)
+	return NewLimitedMerger(pattern, [][]Result{best}, [][]Result{rest}, true, tac, limit)
+}
+
+// streamLines writes the lines of the reader that match the pattern to the
+// writer as soon as they are read, until limit lines are written (if limit is
+// more than 0). The lines are transformed with transforms (if not nil).
+func streamLines(reader *bufio.Reader, writer *bufio.Writer, pattern *Pattern, limit int, transforms *itemTransforms) error {
+	var item Item
+	// The runes of the lines that are not ASCII, which each line reuses
+	var runes []rune
+	var slab *util.Slab
+	written := 0
+	var writeErr error
+	err := readLines(reader, func(line []byte) bool {
+		item.setTextReusing(line, &runes)
+		item.setTexts(transforms.texts(&item.text))
+		if !pattern.IsEmpty() {
+			// The slab grows with the longest line seen so far
+			size16, size32 := slabSizes([]*Chunk{{maxLength: item.matchLength()}}, pattern)
+			if slab == nil || len(slab.I16) < size16 || len(slab.I32) < size32 {
+				if slab != nil {
+					slabPool.Put(slab)
+				}
+				slab = slabPool.Get(size16, size32)
+			}
+			if match, _, _ := pattern.MatchItem(&item, false, slab); match == nil {
+				return true
+			}
+		}
+		if writeErr = writeLine(writer, &item); writeErr != nil {
+			return false
+		}
+		written++
+		return limit <= 0 || written < limit
+	})
+	if slab != nil {
+		slabPool.Put(slab)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// readLines calls fun with each line of the reader, without the line
+// terminator, until it returns false. The line is only valid during the call.
+func readLines(reader *bufio.Reader, fun func([]byte) bool) error {
+	var long []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Lines that don't fit in the buffer are collected in long,
+			// whose array the next long line reuses
+			long = append(long, line...)
+			continue
+		}
+		if len(long) > 0 {
+			line = append(long, line...)
+			long = line[:0]
+		}
+		if len(line) > 0 {
+			line = bytes.TrimSuffix(line, []byte{'\n'})
+			line = bytes.TrimSuffix(line, []byte{'\r'})
+			if !fun(line) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeLine(writer *bufio.Writer, item *Item) error {
+	var err error
+	if item.text.IsBytes() {
+		_, err = writer.Write(item.text.Bytes())
+	} else {
+		for _, r := range item.text.ToRunes() {
+			if _, err = writer.WriteRune(r); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return writer.WriteByte('\n')
+}
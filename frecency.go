@@ -0,0 +1,70 @@
+package fzf
+
+import (
+	"math"
+	"time"
+)
+
+// Frecency counts how often, and remembers when last, items were chosen, so
+// that the items that were chosen often and recently can be ranked higher.
+// It can be written with Fzf.WriteSnapshot and read back with
+// Snapshot.Frecency.
+type Frecency struct {
+	visits map[string]visit
+}
+
+type visit struct {
+	count uint64
+	last  int64 // Unix time in seconds
+}
+
+// NewFrecency returns the pointer to a new, empty Frecency struct
+func NewFrecency() *Frecency {
+	return &Frecency{visits: make(map[string]visit)}
+}
+
+// Visit records that the item with the given key was chosen now
+func (f *Frecency) Visit(key string) {
+	f.visitAt(key, time.Now())
+}
+
+func (f *Frecency) visitAt(key string, now time.Time) {
+	v := f.visits[key]
+	v.count++
+	v.last = now.Unix()
+	f.visits[key] = v
+}
+
+// Weight returns a weight for the item with the given key, to pass to
+// Fzf.AppendWeighted or Fzf.SetWeight: the number of times it was chosen,
+// multiplied by 4 if the last time was in the past hour, by 2 if in the past
+// day, and divided by 2 if not in the past week. Items that were never chosen
+// have weight 0.
+func (f *Frecency) Weight(key string) int32 {
+	return f.weightAt(key, time.Now())
+}
+
+func (f *Frecency) weightAt(key string, now time.Time) int32 {
+	v, found := f.visits[key]
+	if !found {
+		return 0
+	}
+	weight := v.count
+	switch age := now.Unix() - v.last; {
+	case age < int64(time.Hour/time.Second):
+		weight *= 4
+	case age < int64(24*time.Hour/time.Second):
+		weight *= 2
+	case age >= int64(7*24*time.Hour/time.Second):
+		weight /= 2
+	}
+	if weight > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(weight)
+}
+
+// Len returns the number of items that were chosen
+func (f *Frecency) Len() int {
+	return len(f.visits)
+}
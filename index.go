@@ -0,0 +1,253 @@
+package fzf
+
+import (
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/reinhrst/fzf-lib/algo"
+)
+
+// itemSet is a set of items of a chunk, by their position in the chunk
+type itemSet [(chunkSize + 63) / 64]uint64
+
+func (s *itemSet) add(idx int) {
+	s[idx/64] |= 1 << uint(idx%64)
+}
+
+func (s *itemSet) intersect(other *itemSet) {
+	for i := range s {
+		s[i] &= other[i]
+	}
+}
+
+func (s *itemSet) union(other *itemSet) {
+	for i := range s {
+		s[i] |= other[i]
+	}
+}
+
+// each calls fun with the positions in the set, in order
+func (s *itemSet) each(fun func(int)) {
+	for i, word := range s {
+		for word != 0 {
+			fun(i*64 + bits.TrailingZeros64(word))
+			word &= word - 1
+		}
+	}
+}
+
+// allItems returns the set of the first count items
+func allItems(count int) itemSet {
+	var s itemSet
+	for idx := 0; idx < count; idx++ {
+		s.add(idx)
+	}
+	return s
+}
+
+// A gram is a sequence of one or three runes, folded with algo.FoldRune, that
+// is packed into a single key. Runes take 21 bits; unigrams have the highest
+// bit set.
+const unigram uint64 = 1 << 63
+
+func trigramKey(a rune, b rune, c rune) uint64 {
+	return uint64(a)<<42 | uint64(b)<<21 | uint64(c)
+}
+
+func unigramKey(r rune) uint64 {
+	return unigram | uint64(r)
+}
+
+// foldRunes returns the runes of the text folded with algo.FoldRune
+func foldRunes(runes []rune) []rune {
+	folded := make([]rune, len(runes))
+	for idx, r := range runes {
+		folded[idx] = algo.FoldRune(r)
+	}
+	return folded
+}
+
+// chunkIndex is an inverted index of the grams in the items of a full chunk.
+// The items that contain keys[i] are postings[offsets[i]:offsets[i+1]].
+type chunkIndex struct {
+	keys     []uint64
+	offsets  []uint32
+	postings []uint8
+	// Items that are too long to index; they are candidates for every query
+	unindexed itemSet
+}
+
+// buildChunkIndex returns the index of the items of the chunk
+func buildChunkIndex(chunk *Chunk) *chunkIndex {
+	index := &chunkIndex{}
+	items := make(map[uint64][]uint8)
+	add := func(key uint64, idx uint8) {
+		// Items are added in order, so a duplicate is the last one
+		list := items[key]
+		if len(list) == 0 || list[len(list)-1] != idx {
+			items[key] = append(list, idx)
+		}
+	}
+	var runes []rune
+	for idx := 0; idx < chunk.count; idx++ {
+		text := &chunk.items[idx].text
+		if text.Length() > indexMaxLength {
+			index.unindexed.add(idx)
+			continue
+		}
+		runes = runes[:0]
+		for i := 0; i < text.Length(); i++ {
+			runes = append(runes, algo.FoldRune(text.Get(i)))
+		}
+		for i, r := range runes {
+			add(unigramKey(r), uint8(idx))
+			if i >= 2 {
+				add(trigramKey(runes[i-2], runes[i-1], r), uint8(idx))
+			}
+		}
+	}
+
+	index.keys = make([]uint64, 0, len(items))
+	for key := range items {
+		index.keys = append(index.keys, key)
+	}
+	sort.Sort(keySlice(index.keys))
+	index.offsets = make([]uint32, 0, len(items)+1)
+	for _, key := range index.keys {
+		index.offsets = append(index.offsets, uint32(len(index.postings)))
+		index.postings = append(index.postings, items[key]...)
+	}
+	index.offsets = append(index.offsets, uint32(len(index.postings)))
+	return index
+}
+
+type keySlice []uint64
+
+func (s keySlice) Len() int           { return len(s) }
+func (s keySlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s keySlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// lookup returns the items that contain the gram
+func (index *chunkIndex) lookup(key uint64) itemSet {
+	s := index.unindexed
+	i := sort.Search(len(index.keys), func(i int) bool { return index.keys[i] >= key })
+	if i < len(index.keys) && index.keys[i] == key {
+		for _, idx := range index.postings[index.offsets[i]:index.offsets[i+1]] {
+			s.add(int(idx))
+		}
+	}
+	return s
+}
+
+// candidates returns the items that may match the query
+func (index *chunkIndex) candidates(query indexQuery, count int) itemSet {
+	s := allItems(count)
+	for _, termSet := range query {
+		// The items that contain all grams of any of the terms
+		var setItems itemSet
+		for _, keys := range termSet {
+			termItems := allItems(count)
+			for _, key := range keys {
+				keyItems := index.lookup(key)
+				termItems.intersect(&keyItems)
+			}
+			setItems.union(&termItems)
+		}
+		s.intersect(&setItems)
+	}
+	return s
+}
+
+// indexQuery holds the grams of the terms of a pattern, by term set. An item
+// can only match if, for every term set, it contains all grams of at least
+// one of its terms. Term sets that can't be looked up are left out.
+type indexQuery [][][]uint64
+
+// buildIndexQuery returns the query for the term sets. Exact, prefix, suffix
+// and equal terms need the trigrams of their text, and fuzzy terms that are
+// long enough need all of their characters. Inverse terms, and shorter terms,
+// match too many items to be worth looking up.
+func buildIndexQuery(termSets []termSet) indexQuery {
+	var query indexQuery
+	for _, termSet := range termSets {
+		var setKeys [][]uint64
+		for _, term := range termSet {
+			keys := term.indexKeys()
+			if keys == nil {
+				setKeys = nil
+				break
+			}
+			setKeys = append(setKeys, keys)
+		}
+		if setKeys != nil {
+			query = append(query, setKeys)
+		}
+	}
+	return query
+}
+
+// indexKeys returns the grams that an item must contain for the term to
+// match, or nil if the term can't be looked up
+func (t term) indexKeys() []uint64 {
+	if t.inv {
+		return nil
+	}
+	runes := foldRunes(t.text)
+	var keys []uint64
+	if t.typ == termFuzzy {
+		if len(runes) < indexMinFuzzyLength {
+			return nil
+		}
+		for _, r := range runes {
+			keys = append(keys, unigramKey(r))
+		}
+		return keys
+	}
+	if len(runes) < 3 {
+		return nil
+	}
+	for i := 2; i < len(runes); i++ {
+		keys = append(keys, trigramKey(runes[i-2], runes[i-1], runes[i]))
+	}
+	return keys
+}
+
+// setIndex makes the index available to searches
+func (c *Chunk) setIndex(index *chunkIndex) {
+	c.index.Store(index)
+}
+
+// getIndex returns the index of the chunk, or nil if it is not built (yet)
+func (c *Chunk) getIndex() *chunkIndex {
+	index, _ := c.index.Load().(*chunkIndex)
+	return index
+}
+
+// indexChunks builds the indexes of the full chunks that don't have one, on
+// the given number of goroutines
+func indexChunks(chunks []*Chunk, workers int) {
+	var todo []*Chunk
+	for _, chunk := range chunks {
+		if chunk.IsFull() && chunk.getIndex() == nil {
+			todo = append(todo, chunk)
+		}
+	}
+	next := int64(-1)
+	waitGroup := sync.WaitGroup{}
+	for i := 0; i < workers && i < len(todo); i++ {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			for {
+				idx := int(atomic.AddInt64(&next, 1))
+				if idx >= len(todo) {
+					return
+				}
+				todo[idx].setIndex(buildChunkIndex(todo[idx]))
+			}
+		}()
+	}
+	waitGroup.Wait()
+}
@@ -1,12 +1,57 @@
 package fzf
 
 import (
+	"github.com/reinhrst/fzf-lib/algo"
 	"github.com/reinhrst/fzf-lib/util"
 )
 
-// Item represents each input line. 56 bytes.
+// Item represents each input line. 48 bytes.
 type Item struct {
-	text util.Chars // 32 = 24 + 1 + 1 + 2 + 4
+	text     util.Chars // 32 = 24 + 1 + 1 + 2 + 4
+	charMask uint64     // 8, see algo.CharMask
+	texts    *itemTexts // 8, see itemTransforms
+}
+
+// setText sets the text of the item to the given bytes
+func (item *Item) setText(data []byte) {
+	item.setTextReusing(data, nil)
+}
+
+// setTextReusing is setText, but reuses the runes of the previous text (see
+// util.ToCharsReusing)
+func (item *Item) setTextReusing(data []byte, runes *[]rune) {
+	item.text = util.ToCharsReusing(data, runes)
+	item.charMask = algo.CharMask(&item.text)
+}
+
+// setTexts sets the texts that the item is matched as (see
+// itemTransforms.texts), and adds the characters of its transliterated text to
+// its CharMask
+func (item *Item) setTexts(texts *itemTexts) {
+	if item.texts = texts; item.transliterated() {
+		item.charMask |= algo.CharMask(&item.texts.transliterated[0].text)
+	}
+}
+
+// transliterated returns true if the item has a transliterated text
+func (item *Item) transliterated() bool {
+	return item.texts != nil && item.texts.transliterated[0] != nil
+}
+
+// matchLength returns the length of the longest text that the item is matched
+// as
+func (item *Item) matchLength() int {
+	length := item.text.Length()
+	if item.texts != nil {
+		for _, texts := range [][4]*transformed{item.texts.transformed, item.texts.transliterated} {
+			for _, text := range texts {
+				if text != nil {
+					length = util.Max(length, text.text.Length())
+				}
+			}
+		}
+	}
+	return length
 }
 
 // Index returns ordinal index of the Item
@@ -16,6 +61,6 @@ func (item *Item) Index() int32 {
 
 var minItem = Item{text: util.Chars{Index: -1}}
 
-func (item *Item) TrimLength() uint16 {
+func (item *Item) TrimLength() int {
 	return item.text.TrimLength()
 }
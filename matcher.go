@@ -1,10 +1,12 @@
 package fzf
 
 import (
+	"container/list"
 	"fmt"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
 	"github.com/reinhrst/fzf-lib/util"
 )
@@ -16,6 +18,20 @@ type MatchRequest struct {
 	final      bool
 	sort       bool
 	clearCache bool
+	// The search is interrupted as soon as the generation of the Matcher
+	// changes, which happens when a search is cancelled or pre-empted
+	generation int64
+	// Orders the requests, in case more than one is waiting
+	seq int64
+}
+
+// searchFin is what EvtSearchFin carries: the merger with the result of a
+// search, and the time it took to scan the chunks, which is 0 if the merger
+// came from the cache. Cached mergers are shared by the searches that reuse
+// them, so the time is not kept in the merger.
+type searchFin struct {
+	merger   *Merger
+	scanTime time.Duration
 }
 
 // Matcher is responsible for performing search
@@ -26,21 +42,50 @@ type Matcher struct {
 	eventBox       *util.EventBox
 	reqBox         *util.EventBox
 	partitions     int
-	slab           []*util.Slab
-	mergerCache    map[string]*Merger
+	mergerCache    map[string]*list.Element
+	mergerLRU      *list.List
 	chunkCache     ChunkCache
+	cacheBudget    int
+	parallelism    int
+	limit          int
+	pool           *WorkerPool
+	poolClient     *poolClient
+
+	generation int64
+	seq        int64
+	// The chunks whose cached results are outdated, e.g. because weights of
+	// their items changed, and so are the cached mergers
+	invalidMutex  sync.Mutex
+	invalidChunks map[*Chunk]struct{}
+
+	mergerCacheCounters cacheCounters
+	mergerCacheEntries  int64
+	mergerCacheBytes    int64
+
+	// Called before each chunk is scanned, if set; for tests
+	chunkHook func(*Chunk)
 }
 
 const (
 	reqRetry util.EventType = iota
 	reqReset
 	reqQuit
+	reqCancel
 )
 
 // NewMatcher returns a new Matcher
 func NewMatcher(patternBuilder func(string) *Pattern,
-	sort bool, tac bool, eventBox *util.EventBox) *Matcher {
-	partitions := util.Min(numPartitionsMultiplier*numCPU(), maxPartitions)
+	sort bool, tac bool, cacheBudget int, parallelism int, pool *WorkerPool,
+	limit int, eventBox *util.EventBox) *Matcher {
+	workers := numCPU()
+	if parallelism > 0 {
+		workers = parallelism
+	}
+	partitions := util.Min(numPartitionsMultiplier*workers, maxPartitions)
+	var client *poolClient
+	if pool != nil {
+		client = pool.newClient(parallelism)
+	}
 	return &Matcher{
 		patternBuilder: patternBuilder,
 		sort:           sort,
@@ -48,25 +93,34 @@ func NewMatcher(patternBuilder func(string) *Pattern,
 		eventBox:       eventBox,
 		reqBox:         util.NewEventBox(),
 		partitions:     partitions,
-		slab:           make([]*util.Slab, partitions),
-		mergerCache:    make(map[string]*Merger),
-		chunkCache:     NewChunkCache(),
+		mergerCache:    make(map[string]*list.Element),
+		mergerLRU:      list.New(),
+		chunkCache:     NewChunkCache(cacheBudget),
+		cacheBudget:    cacheBudget,
+		parallelism:    parallelism,
+		limit:          limit,
+		pool:           pool,
+		poolClient:     client,
 	}
 }
 
 // Loop puts Matcher in action
 func (m *Matcher) Loop() {
-	prevCount := 0
+	var interrupted *MatchRequest
 	for {
-		var request MatchRequest
+		var request *MatchRequest
+		cancelGeneration := int64(-1)
 		quit := false
 		m.reqBox.Wait(func(events *util.Events) {
 			for evt, val := range *events {
 				switch evt {
-				case reqReset:
-					request = val.(MatchRequest)
-				case reqRetry:
-					request = val.(MatchRequest)
+				case reqReset, reqRetry:
+					newRequest := val.(MatchRequest)
+					if request == nil || newRequest.seq > request.seq {
+						request = &newRequest
+					}
+				case reqCancel:
+					cancelGeneration = val.(int64)
 				case reqQuit:
 					quit = true
 				default:
@@ -80,44 +134,190 @@ func (m *Matcher) Loop() {
 			break
 		}
 
+		// Without a new request, a cancel applies to the interrupted search
+		if request == nil {
+			request = interrupted
+		}
+		interrupted = nil
+		if request == nil {
+			continue
+		}
+		if cancelGeneration >= 0 && request.generation < cancelGeneration {
+			m.eventBox.Set(EvtSearchFin, searchFin{merger: CancelledMerger(request.pattern)})
+			continue
+		}
+
+		invalidChunks := m.takeInvalidChunks()
 		if request.sort != m.sort || request.clearCache {
 			m.sort = request.sort
-			m.mergerCache = make(map[string]*Merger)
-			m.chunkCache = NewChunkCache()
+			m.clearMergerCache()
+			m.chunkCache.Clear()
+		} else if invalidChunks != nil {
+			m.clearMergerCache()
+			for chunk := range invalidChunks {
+				m.chunkCache.Forget(chunk)
+			}
 		}
 
 		// Restart search
 		patternString := request.pattern.originalText
 		var merger *Merger
+		var scanTime time.Duration
 		cancelled := false
 		count := CountItems(request.chunks)
 
+		// Look up mergerCache. Since the ChunkList only grows, a merger for the
+		// same number of items is still valid, and a merger for fewer items
+		// can be extended with the items that were added since.
 		foundCache := false
-		if count == prevCount {
-			// Look up mergerCache
-			if cached, found := m.mergerCache[patternString]; found {
-				foundCache = true
-				merger = cached
-			}
-		} else {
-			// Invalidate mergerCache
-			prevCount = count
-			m.mergerCache = make(map[string]*Merger)
+		cached, found := m.lookupMergerCache(patternString)
+		if found && CountItems(cached.scope) == count {
+			foundCache = true
+			merger = cached
 		}
+		m.mergerCacheCounters.count(foundCache)
 
 		if !foundCache {
-			merger, cancelled = m.scan(request)
+			startedAt := time.Now()
+			if found {
+				merger, cancelled = m.extend(cached, *request)
+			} else {
+				merger, cancelled = m.scan(*request)
+			}
+			if !cancelled && merger != EmptyMerger {
+				scanTime = time.Since(startedAt)
+				merger.scope = request.chunks
+			}
 		}
-		if !cancelled {
+		if cancelled {
+			interrupted = request
+		} else {
 			if merger.cacheable() {
-				m.mergerCache[patternString] = merger
+				m.addMergerCache(patternString, merger)
 			}
 			merger.final = request.final
-			m.eventBox.Set(EvtSearchFin, merger)
+			m.eventBox.Set(EvtSearchFin, searchFin{merger, scanTime})
 		}
 	}
 }
 
+// Invalidate makes the next search drop the cached results of the chunk, and
+// the cached mergers, instead of reusing them
+func (m *Matcher) Invalidate(chunk *Chunk) {
+	m.invalidMutex.Lock()
+	defer m.invalidMutex.Unlock()
+	if m.invalidChunks == nil {
+		m.invalidChunks = make(map[*Chunk]struct{})
+	}
+	m.invalidChunks[chunk] = struct{}{}
+}
+
+// takeInvalidChunks returns the chunks that were invalidated since the last
+// call, or nil if there are none
+func (m *Matcher) takeInvalidChunks() map[*Chunk]struct{} {
+	m.invalidMutex.Lock()
+	defer m.invalidMutex.Unlock()
+	chunks := m.invalidChunks
+	m.invalidChunks = nil
+	return chunks
+}
+
+// stale returns true if the request was cancelled or pre-empted
+func (m *Matcher) stale(request MatchRequest) bool {
+	return atomic.LoadInt64(&m.generation) != request.generation
+}
+
+// mergerCacheEntry is a merger kept in the LRU list of the merger cache
+type mergerCacheEntry struct {
+	key    string
+	merger *Merger
+	size   int64
+}
+
+func (m *Matcher) clearMergerCache() {
+	m.mergerCache = make(map[string]*list.Element)
+	m.mergerLRU.Init()
+	atomic.StoreInt64(&m.mergerCacheEntries, 0)
+	atomic.StoreInt64(&m.mergerCacheBytes, 0)
+}
+
+// lookupMergerCache returns the cached merger for the needle, marking it as
+// recently used
+func (m *Matcher) lookupMergerCache(patternString string) (*Merger, bool) {
+	elem, found := m.mergerCache[patternString]
+	if !found {
+		return nil, false
+	}
+	m.mergerLRU.MoveToFront(elem)
+	return elem.Value.(*mergerCacheEntry).merger, true
+}
+
+// removeMergerCache deletes a single merger from the cache
+func (m *Matcher) removeMergerCache(elem *list.Element) {
+	entry := m.mergerLRU.Remove(elem).(*mergerCacheEntry)
+	delete(m.mergerCache, entry.key)
+	atomic.AddInt64(&m.mergerCacheEntries, -1)
+	atomic.AddInt64(&m.mergerCacheBytes, -entry.size)
+}
+
+// addMergerCache adds the merger to the cache. Like the ChunkCache, the least
+// recently used mergers are evicted once they use more than the cache budget.
+func (m *Matcher) addMergerCache(patternString string, merger *Merger) {
+	if elem, found := m.mergerCache[patternString]; found {
+		if elem.Value.(*mergerCacheEntry).merger == merger {
+			return
+		}
+		m.removeMergerCache(elem)
+	}
+	entry := &mergerCacheEntry{patternString, merger,
+		int64(len(patternString)) + int64(merger.count)*int64(unsafe.Sizeof(Result{}))}
+	m.mergerCache[patternString] = m.mergerLRU.PushFront(entry)
+	atomic.AddInt64(&m.mergerCacheEntries, 1)
+	bytes := atomic.AddInt64(&m.mergerCacheBytes, entry.size)
+	for m.cacheBudget > 0 && bytes > int64(m.cacheBudget) && m.mergerLRU.Len() > 1 {
+		m.removeMergerCache(m.mergerLRU.Back())
+		bytes = atomic.LoadInt64(&m.mergerCacheBytes)
+	}
+}
+
+// Stats returns the counters of the chunk cache, the prefix/suffix narrowing
+// and the merger cache
+func (m *Matcher) Stats() (CacheStats, CacheStats, CacheStats) {
+	mergerStats := m.mergerCacheCounters.stats()
+	mergerStats.Entries = int(atomic.LoadInt64(&m.mergerCacheEntries))
+	mergerStats.Bytes = int(atomic.LoadInt64(&m.mergerCacheBytes))
+	lookups, narrowing := m.chunkCache.Stats()
+	return lookups, narrowing, mergerStats
+}
+
+// runAll runs the tasks on the worker pool if there is one. Otherwise it
+// starts a goroutine for each task, or, with Options.Parallelism, that many
+// goroutines that take the tasks in turn.
+func (m *Matcher) runAll(tasks []func()) {
+	if m.pool != nil {
+		for _, task := range tasks {
+			m.pool.submit(m.poolClient, task)
+		}
+		return
+	}
+	workers := len(tasks)
+	if m.parallelism > 0 {
+		workers = util.Min(workers, m.parallelism)
+	}
+	queue := make(chan func(), len(tasks))
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range queue {
+				task()
+			}
+		}()
+	}
+}
+
 func (m *Matcher) sliceChunks(chunks []*Chunk) [][]*Chunk {
 	partitions := m.partitions
 	perSlice := len(chunks) / partitions
@@ -139,9 +339,31 @@ func (m *Matcher) sliceChunks(chunks []*Chunk) [][]*Chunk {
 	return slices
 }
 
+// slabPool holds the slabs of all Matchers. A slab is only taken from the pool
+// for the duration of a scan, so idle Matchers don't hold on to any.
+var slabPool util.SlabPool
+
+// slabSizes returns the sizes of the slabs needed to match the pattern against
+// the longest item in the chunks, capped at the default sizes. Items that
+// need more than the capped size are matched with the greedy algorithm, as
+// before, since that decision only depends on whether they would fit.
+func slabSizes(chunks []*Chunk, pattern *Pattern) (int, int) {
+	maxLength := 0
+	for _, chunk := range chunks {
+		maxLength = util.Max(maxLength, chunk.maxLength)
+	}
+	needleLength := len(pattern.text)
+	// FuzzyMatchV2 uses three int16 slices of the item length and two of item
+	// length times needle length, and int32 slices of both lengths
+	size16 := util.Min(maxLength*(3+2*needleLength), slab16Size)
+	size32 := util.Min(maxLength+needleLength, slab32Size)
+	return size16, size32
+}
+
 type partialResult struct {
 	index   int
 	matches []Result
+	rest    []Result
 }
 
 func (m *Matcher) scan(request MatchRequest) (*Merger, bool) {
@@ -157,27 +379,37 @@ func (m *Matcher) scan(request MatchRequest) (*Merger, bool) {
 	}
 
 	cancelled := util.NewAtomicBool(false)
+	interrupted := func() bool {
+		return cancelled.Get() || m.stale(request)
+	}
 
+	size16, size32 := slabSizes(request.chunks, pattern)
 	slices := m.sliceChunks(request.chunks)
 	numSlices := len(slices)
 	resultChan := make(chan partialResult, numSlices)
 	countChan := make(chan int, numChunks)
 	waitGroup := sync.WaitGroup{}
 
+	tasks := make([]func(), numSlices)
 	for idx, chunks := range slices {
 		waitGroup.Add(1)
-		if m.slab[idx] == nil {
-			m.slab[idx] = util.MakeSlab(slab16Size, slab32Size)
-		}
-		go func(idx int, slab *util.Slab, chunks []*Chunk) {
+		idx, chunks := idx, chunks
+		tasks[idx] = func() {
 			defer func() { waitGroup.Done() }()
+			slab := slabPool.Get(size16, size32)
+			defer slabPool.Put(slab)
 			count := 0
 			allMatches := make([][]Result, len(chunks))
 			for idx, chunk := range chunks {
-				matches := request.pattern.Match(chunk, slab, &m.chunkCache)
+				if m.chunkHook != nil {
+					m.chunkHook(chunk)
+				}
+				matches := request.pattern.Match(chunk, slab, &m.chunkCache, interrupted)
 				allMatches[idx] = matches
 				count += len(matches)
-				if cancelled.Get() {
+				if interrupted() {
+					// Let the main loop know, in case it is still waiting
+					countChan <- -1
 					return
 				}
 				countChan <- len(matches)
@@ -186,16 +418,14 @@ func (m *Matcher) scan(request MatchRequest) (*Merger, bool) {
 			for _, matches := range allMatches {
 				sliceMatches = append(sliceMatches, matches...)
 			}
+			var rest []Result
 			if m.sort {
-				if m.tac {
-					sort.Sort(ByRelevanceTac(sliceMatches))
-				} else {
-					sort.Sort(ByRelevance(sliceMatches))
-				}
+				sliceMatches, rest = selectBest(sliceMatches, m.limit, m.tac)
 			}
-			resultChan <- partialResult{idx, sliceMatches}
-		}(idx, m.slab[idx], chunks)
+			resultChan <- partialResult{idx, sliceMatches, rest}
+		}
 	}
+	m.runAll(tasks)
 
 	wait := func() bool {
 		cancelled.Set(true)
@@ -206,6 +436,10 @@ func (m *Matcher) scan(request MatchRequest) (*Merger, bool) {
 	count := 0
 	matchCount := 0
 	for matchesInChunk := range countChan {
+		if matchesInChunk < 0 || m.stale(request) {
+			return nil, wait()
+		}
+
 		count++
 		matchCount += matchesInChunk
 
@@ -213,32 +447,74 @@ func (m *Matcher) scan(request MatchRequest) (*Merger, bool) {
 			break
 		}
 
-		if m.reqBox.Peek(reqReset) {
-			return nil, wait()
-		}
-
 		if time.Since(startedAt) > progressMinDuration {
 			m.eventBox.Set(EvtSearchProgress, float32(count)/float32(numChunks))
 		}
 	}
 
 	partialResults := make([][]Result, numSlices)
+	partialRests := make([][]Result, numSlices)
 	for range slices {
 		partialResult := <-resultChan
 		partialResults[partialResult.index] = partialResult.matches
+		partialRests[partialResult.index] = partialResult.rest
+	}
+	return NewLimitedMerger(pattern, partialResults, partialRests, m.sort, m.tac, m.limit), false
+}
+
+// extend returns the merger for the request, reusing the results of a merger
+// for an earlier snapshot of the ChunkList. Only the chunks that were not yet
+// full at the time of the earlier snapshot are scanned.
+func (m *Matcher) extend(cached *Merger, request MatchRequest) (*Merger, bool) {
+	// Full chunks never change, and the last chunk of a snapshot is a copy if
+	// it is not full, so comparing the pointers is enough
+	reusable := 0
+	for reusable < len(cached.scope) && reusable < len(request.chunks) &&
+		cached.scope[reusable] == request.chunks[reusable] {
+		reusable++
+	}
+	if reusable == 0 || cached.chunks != nil || cached.sorted != m.sort {
+		return m.scan(request)
+	}
+
+	partialRequest := request
+	partialRequest.chunks = request.chunks[reusable:]
+	partialMerger, cancelled := m.scan(partialRequest)
+	if cancelled {
+		return nil, true
 	}
-	return NewMerger(pattern, partialResults, m.sort, m.tac), false
+
+	// The items of the ChunkList are indexed in order, so the items in the
+	// reusable chunks are the ones with the lowest indices
+	lists, rest := cached.resultsBefore(int32(reusable*chunkSize), m.limit)
+	lists = append(lists, partialMerger.lists...)
+	rest = append(rest, partialMerger.rest...)
+	if len(lists) > m.partitions {
+		lists, rest = compactLists(lists, rest, m.sort, m.tac, m.limit)
+	}
+	return NewLimitedMerger(request.pattern, lists, rest, m.sort, m.tac, m.limit), false
 }
 
-// Reset is called to interrupt/signal the ongoing search
+// Reset is called to interrupt/signal the ongoing search. If cancel is true,
+// the ongoing search is interrupted; otherwise it is finished first.
 func (m *Matcher) Reset(chunks []*Chunk, patternString string, cancel bool, final bool, sort bool, clearCache bool) {
 	pattern := m.patternBuilder(patternString)
 
 	var event util.EventType
+	var generation int64
 	if cancel {
 		event = reqReset
+		generation = atomic.AddInt64(&m.generation, 1)
 	} else {
 		event = reqRetry
+		generation = atomic.LoadInt64(&m.generation)
 	}
-	m.reqBox.Set(event, MatchRequest{chunks, pattern, final, sort && pattern.sortable, clearCache})
+	seq := atomic.AddInt64(&m.seq, 1)
+	m.reqBox.Set(event, MatchRequest{chunks, pattern, final, sort && pattern.sortable, clearCache, generation, seq})
+}
+
+// Cancel interrupts the ongoing search, or the search that is about to start.
+// A cancelled Merger is sent instead of its results.
+func (m *Matcher) Cancel() {
+	m.reqBox.Set(reqCancel, atomic.AddInt64(&m.generation, 1))
 }
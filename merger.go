@@ -10,13 +10,25 @@ var EmptyMerger = NewMerger(nil, [][]Result{}, false, false)
 type Merger struct {
 	pattern *Pattern
 	lists   [][]Result
-	merged  []Result
-	chunks  *[]*Chunk
-	cursors []int
-	sorted  bool
-	tac     bool
-	final   bool
-	count   int
+	// If a limit is set, lists only hold the best results of each partition,
+	// and the remaining results are kept unsorted in rest
+	rest  [][]Result
+	limit int
+	// The lists that are being merged; the same as lists, until results beyond
+	// the limit are requested
+	sortedLists [][]Result
+	expanded    bool
+	merged      []Result
+	chunks      *[]*Chunk
+	cursors     []int
+	sorted      bool
+	tac         bool
+	final       bool
+	count       int
+	// The chunks that were scanned for this merger
+	scope []*Chunk
+	// True if the search was cancelled, in which case there are no results
+	cancelled bool
 }
 
 // PassMerger returns a new Merger that simply returns the items in the
@@ -34,21 +46,43 @@ func PassMerger(pattern *Pattern, chunks *[]*Chunk, tac bool) *Merger {
 	return &mg
 }
 
+// CancelledMerger returns a Merger without results, signalling that the
+// search for the pattern was cancelled
+func CancelledMerger(pattern *Pattern) *Merger {
+	mg := NewMerger(pattern, [][]Result{}, false, false)
+	mg.cancelled = true
+	return mg
+}
+
 // NewMerger returns a new Merger
 func NewMerger(pattern *Pattern, lists [][]Result, sorted bool, tac bool) *Merger {
+	return NewLimitedMerger(pattern, lists, nil, sorted, tac, 0)
+}
+
+// NewLimitedMerger returns a new Merger for lists that hold (at most) the limit
+// best results of each partition, with the other results of each partition in
+// rest. Only the best results are merged, unless results beyond the limit are
+// requested.
+func NewLimitedMerger(pattern *Pattern, lists [][]Result, rest [][]Result, sorted bool, tac bool, limit int) *Merger {
+	if rest == nil {
+		rest = make([][]Result, len(lists))
+	}
 	mg := Merger{
-		pattern: pattern,
-		lists:   lists,
-		merged:  []Result{},
-		chunks:  nil,
-		cursors: make([]int, len(lists)),
-		sorted:  sorted,
-		tac:     tac,
-		final:   false,
-		count:   0}
+		pattern:     pattern,
+		lists:       lists,
+		rest:        rest,
+		limit:       limit,
+		sortedLists: lists,
+		merged:      []Result{},
+		chunks:      nil,
+		cursors:     make([]int, len(lists)),
+		sorted:      sorted,
+		tac:         tac,
+		final:       false,
+		count:       0}
 
-	for _, list := range mg.lists {
-		mg.count += len(list)
+	for idx, list := range mg.lists {
+		mg.count += len(list) + len(rest[idx])
 	}
 	return &mg
 }
@@ -73,6 +107,9 @@ func (mg *Merger) Get(idx int) Result {
 	}
 
 	if mg.sorted {
+		if mg.limit > 0 && idx >= mg.limit {
+			mg.expand()
+		}
 		return mg.mergedGet(idx)
 	}
 
@@ -89,6 +126,92 @@ func (mg *Merger) Get(idx int) Result {
 	panic(fmt.Sprintf("Index out of bounds (unsorted, %d/%d)", idx, mg.count))
 }
 
+// expand sorts the results beyond the limit, so that all results can be
+// merged. The lists and rest are left untouched, since they may be read by
+// the Matcher.
+func (mg *Merger) expand() {
+	if mg.expanded {
+		return
+	}
+	mg.expanded = true
+	full := make([][]Result, len(mg.lists))
+	hasRest := false
+	for idx, list := range mg.lists {
+		if len(mg.rest[idx]) == 0 {
+			full[idx] = list
+			continue
+		}
+		full[idx] = make([]Result, 0, len(list)+len(mg.rest[idx]))
+		full[idx] = append(full[idx], list...)
+		full[idx] = append(full[idx], mg.rest[idx]...)
+		sortResults(full[idx], mg.tac)
+		hasRest = true
+	}
+	if hasRest {
+		mg.sortedLists = full
+		mg.merged = []Result{}
+		mg.cursors = make([]int, len(full))
+	}
+}
+
+// filterBefore returns the results with an index lower than the given one,
+// keeping their order
+func filterBefore(list []Result, index int32) []Result {
+	filtered := make([]Result, 0, len(list))
+	for _, result := range list {
+		if result.item.Index() < index {
+			filtered = append(filtered, result)
+		}
+	}
+	return filtered
+}
+
+// resultsBefore returns the lists and rest of results, leaving out the items
+// with an index of at least the given one. The order within the lists is kept.
+func (mg *Merger) resultsBefore(index int32, limit int) ([][]Result, [][]Result) {
+	lists := make([][]Result, 0, len(mg.lists))
+	rest := make([][]Result, 0, len(mg.lists))
+	for idx, list := range mg.lists {
+		filtered := filterBefore(list, index)
+		filteredRest := filterBefore(mg.rest[idx], index)
+		if len(filtered) < len(list) && len(filteredRest) > 0 {
+			// Some of the best results are gone, so results from the rest may
+			// take their place
+			filtered, filteredRest = selectBest(
+				append(filtered, filteredRest...), limit, mg.tac)
+		}
+		lists = append(lists, filtered)
+		rest = append(rest, filteredRest)
+	}
+	return lists, rest
+}
+
+// compactLists combines the lists into a single list in the order in which a
+// Merger would return the results, and the rest into a single unsorted list
+func compactLists(lists [][]Result, rest [][]Result, sorted bool, tac bool, limit int) ([][]Result, [][]Result) {
+	compactedRest := []Result{}
+	for _, list := range rest {
+		compactedRest = append(compactedRest, list...)
+	}
+	if !sorted {
+		compacted := []Result{}
+		for _, list := range lists {
+			compacted = append(compacted, list...)
+		}
+		return [][]Result{compacted}, [][]Result{compactedRest}
+	}
+	mg := NewMerger(nil, lists, true, tac)
+	compacted := make([]Result, mg.count)
+	for idx := range compacted {
+		compacted[idx] = mg.mergedGet(idx)
+	}
+	if limit > 0 && len(compacted) > limit {
+		compactedRest = append(compactedRest, compacted[limit:]...)
+		compacted = compacted[:limit]
+	}
+	return [][]Result{compacted}, [][]Result{compactedRest}
+}
+
 func (mg *Merger) cacheable() bool {
 	return mg.count < mergerCacheMax
 }
@@ -97,7 +220,7 @@ func (mg *Merger) mergedGet(idx int) Result {
 	for i := len(mg.merged); i <= idx; i++ {
 		minRank := minRank()
 		minIdx := -1
-		for listIdx, list := range mg.lists {
+		for listIdx, list := range mg.sortedLists {
 			cursor := mg.cursors[listIdx]
 			if cursor < 0 || cursor == len(list) {
 				mg.cursors[listIdx] = -1
@@ -105,7 +228,7 @@ func (mg *Merger) mergedGet(idx int) Result {
 			}
 			if cursor >= 0 {
 				rank := list[cursor]
-				if minIdx < 0 || compareRanks(rank, minRank, mg.tac) {
+				if minIdx < 0 || moreRelevant(&rank, &minRank, mg.tac) {
 					minRank = rank
 					minIdx = listIdx
 				}
@@ -113,7 +236,7 @@ func (mg *Merger) mergedGet(idx int) Result {
 		}
 
 		if minIdx >= 0 {
-			chosen := mg.lists[minIdx]
+			chosen := mg.sortedLists[minIdx]
 			mg.merged = append(mg.merged, chosen[mg.cursors[minIdx]])
 			mg.cursors[minIdx]++
 		} else {
@@ -1,5 +1,7 @@
 package fzf
 
+import "unsafe"
+
 // Case denotes case-sensitivity of search
 type Case int
 
@@ -9,6 +11,54 @@ const (
 	CaseRespect
 )
 
+// CaseFolding denotes how characters are compared when case is ignored
+type CaseFolding int
+
+const (
+	// Characters are lowercased with unicode.ToLower, like fzf does
+	FoldLower CaseFolding = iota
+	// All characters that unicode.SimpleFold cycles through are the same, so
+	// also ſ and s, ς and σ, and the Kelvin sign and k
+	FoldSimple
+	// As FoldSimple, and characters with full case folding match several
+	// characters, like ß and ss, and the ﬁ ligature and fi
+	FoldFull
+)
+
+// FoldTurkish may be combined with any CaseFolding to fold the dotted and the
+// dotless i the way Turkish and Azerbaijani do: I and ı are the same, and so
+// are İ and i. Note that with Options.Normalize, ı also matches i.
+const FoldTurkish CaseFolding = 1 << 4
+
+// Normalization denotes which characters of the items also match the
+// characters without diacritics. Only needles without such characters
+// themselves are normalized.
+type Normalization int
+
+const (
+	// Characters only match themselves, like fzf --literal
+	NormalizeNone Normalization = iota
+	// Latin script letters with diacritics match the letters without, like
+	// fzf does
+	NormalizeLatin
+	// As NormalizeLatin, and characters with a canonical decomposition (NFD)
+	// match it without the nonspacing marks: Greek ά matches α, Cyrillic й
+	// matches и and Vietnamese ệ matches e
+	NormalizeDiacritics
+	// As NormalizeDiacritics, with the compatibility decomposition (NFKD):
+	// full-width Ａ matches A, the ﬁ ligature matches fi and ² matches 2
+	NormalizeCompatibility
+)
+
+// Transliterator transliterates the text of an item to Latin letters, so that
+// the item can be found by typing ASCII. It appends the transliteration of the
+// runes at the start of text (which is never empty) to dst, and returns the
+// number of runes it transliterated, or 0 if it keeps text[0] as it is (in
+// which case it must return dst as it was). dst holds the transliteration of
+// the text before. See TransliterateCyrillic, TransliterateUkrainian,
+// TransliterateGreek, TransliterateKana and Transliterators.
+type Transliterator func(dst []rune, text []rune) ([]rune, int)
+
 // Sort criteria
 type Criterion int
 
@@ -17,8 +67,62 @@ const (
 	ByLength
 	ByBegin
 	ByEnd
+	ByIndex
+	ByIndexDesc
+	ByPathDepth
 )
 
+// SortInfo describes a match to a custom sort criterion
+type SortInfo struct {
+	// The index of the item in the haystack
+	HayIndex int32
+	// The score of the match, without the weight; higher is better
+	Score int
+	// The weight of the item; see Fzf.SetWeight
+	Weight int32
+	// The first and the last position (exclusive) of the match, in
+	// characters. Both are 0 if the match has no positions, e.g. for an
+	// empty needle.
+	Begin int
+	End   int
+
+	item *Item
+}
+
+// Key returns the string of the item. For ASCII items it shares the memory
+// of the item, so it doesn't allocate; it must not be kept after the Fzf
+// object, or the Snapshot it was created from, is closed. Other items are
+// converted on every call.
+func (info SortInfo) Key() string {
+	if info.item.text.IsBytes() {
+		bytes := info.item.text.Bytes()
+		return *(*string)(unsafe.Pointer(&bytes))
+	}
+	return info.item.text.ToString()
+}
+
+const firstCustomCriterion Criterion = 1 << 16
+
+// CustomCriterion returns the Criterion for Options.Sort that sorts matches
+// by the rank that Options.CustomCriteria[index] returns for them, lower
+// ranks first
+func CustomCriterion(index int) Criterion {
+	return firstCustomCriterion + Criterion(index)
+}
+
+// customRank returns the function of the custom criterion, or nil if the
+// criterion is not a custom one
+func customRank(criterion Criterion, customCriteria []func(SortInfo) int32) func(SortInfo) int32 {
+	if idx := int(criterion - firstCustomCriterion); idx >= 0 && idx < len(customCriteria) {
+		return customCriteria[idx]
+	}
+	return nil
+}
+
+// Maximum number of criteria in Options.Sort; the criteria after it are
+// ignored
+const maxSortCriteria = 8
+
 func isAlphabet(char uint8) bool {
 	return char >= 'a' && char <= 'z'
 }
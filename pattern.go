@@ -2,6 +2,7 @@ package fzf
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/reinhrst/fzf-lib/algo"
@@ -56,14 +57,27 @@ type Pattern struct {
 	sortable      bool
 	cacheable     bool
 	cacheKey      string
-	procFun       map[termType]algo.Algo
-	sortCriteria  []Criterion
+	cacheTermSets []termSet
+	// The cache keys of the weaker patterns whose results narrow the search
+	narrowingKeys  []string
+	procFun        map[termType]algo.Algo
+	sortCriteria   []Criterion
+	customCriteria []func(SortInfo) int32
+	// If false, Match doesn't compute the positions of the matched characters
+	withPos bool
+	// Combines the score of a match with the weight of the item; nil means
+	// they are added
+	weigh func(score int, weight int32) int
+	// Returns the weight of the item with the given index; nil means 0
+	weightOf func(index int32) int32
+	// The bits that must be set in the algo.CharMask of an item to match
+	charMask uint64
+	// The grams to look up in the index of a chunk
+	indexQuery indexQuery
 }
 
 // buildPattern builds Pattern object from the given arguments
-func BuildPattern(fuzzy bool, fuzzyAlgo algo.Algo, extended bool, caseMode Case, normalize bool, forward bool, needle string, sortCriteria []Criterion, patternCache *map[string]*Pattern) *Pattern {
-	cacheable := true
-
+func BuildPattern(fuzzy bool, fuzzyAlgo algo.Algo, extended bool, caseMode Case, caseFolding CaseFolding, normalization Normalization, forward bool, needle string, sortCriteria []Criterion, customCriteria []func(SortInfo) int32, withPos bool, weigh func(int, int32) int, weightOf func(int32) int32, patternCache *PatternCache) *Pattern {
 	var asString string
 	if extended {
 		// strip spaces from left side, strip spaces from right if not preceded by
@@ -76,74 +90,79 @@ func BuildPattern(fuzzy bool, fuzzyAlgo algo.Algo, extended bool, caseMode Case,
 		asString = needle
 	}
 
-	cached, found := (*patternCache)[needle]
-	if found {
+	if cached := patternCache.Lookup(needle); cached != nil {
 		return cached
 	}
 
 	caseSensitive := true
 	sortable := true
 	termSets := []termSet{}
+	folder := newCaseFolder(caseFolding)
+	normalize := false
 
 	if extended {
-		termSets = parseTerms(fuzzy, caseMode, normalize, asString)
+		termSets = parseTerms(fuzzy, caseMode, folder, normalization, asString)
 		// We should not sort the result if there are only inverse search terms
 		sortable = false
 	Loop:
 		for _, termSet := range termSets {
-			for idx, term := range termSet {
+			for _, term := range termSet {
 				if !term.inv {
 					sortable = true
-				}
-				// If the query contains inverse search terms or OR operators,
-				// we cannot cache the search scope
-				if !cacheable || idx > 0 || term.inv || fuzzy && term.typ != termFuzzy || !fuzzy && term.typ != termExact {
-					cacheable = false
-					if sortable {
-						// Can't break until we see at least one non-inverse term
-						break Loop
-					}
+					break Loop
 				}
 			}
 		}
 	} else {
-		lowerString := strings.ToLower(asString)
-		normalize = normalize &&
-			lowerString == string(algo.NormalizeRunes([]rune(lowerString)))
+		lowerString := folder.lower(asString)
 		caseSensitive = caseMode == CaseRespect ||
 			caseMode == CaseSmart && lowerString != asString
 		if !caseSensitive {
-			asString = lowerString
+			asString = folder.fold(asString)
 		}
+		normalize = normalizes(normalization, strings.ToLower(asString))
 	}
 
 	ptr := &Pattern{
-		fuzzy:         fuzzy,
-		fuzzyAlgo:     fuzzyAlgo,
-		extended:      extended,
-		caseSensitive: caseSensitive,
-		normalize:     normalize,
-		forward:       forward,
-		text:          []rune(asString),
-		termSets:      termSets,
-		sortable:      sortable,
-		cacheable:     cacheable,
-		originalText:  needle,
-		sortCriteria:  sortCriteria,
-		procFun:       make(map[termType]algo.Algo)}
-
-	ptr.cacheKey = ptr.buildCacheKey()
+		fuzzy:          fuzzy,
+		fuzzyAlgo:      fuzzyAlgo,
+		extended:       extended,
+		caseSensitive:  caseSensitive,
+		normalize:      normalize,
+		forward:        forward,
+		text:           []rune(asString),
+		termSets:       termSets,
+		sortable:       sortable,
+		originalText:   needle,
+		sortCriteria:   sortCriteria,
+		customCriteria: customCriteria,
+		withPos:        withPos,
+		weigh:          weigh,
+		weightOf:       weightOf,
+		procFun:        make(map[termType]algo.Algo)}
+
+	ptr.cacheTermSets = ptr.buildCacheTermSets()
+	ptr.cacheKey = buildCacheKey(ptr.cacheTermSets)
+	ptr.cacheable = len(ptr.cacheKey) > 0
+	if ptr.cacheable {
+		ptr.narrowingKeys = ptr.buildNarrowingKeys()
+	}
+	ptr.charMask = ptr.buildCharMask()
+	if caseFolding&^FoldTurkish != FoldFull && normalization < NormalizeDiacritics {
+		// The index doesn't know which runes fold or decompose to several
+		ptr.indexQuery = buildIndexQuery(ptr.cacheTermSets)
+	}
 	ptr.procFun[termFuzzy] = fuzzyAlgo
 	ptr.procFun[termEqual] = algo.EqualMatch
 	ptr.procFun[termExact] = algo.ExactMatchNaive
 	ptr.procFun[termPrefix] = algo.PrefixMatch
 	ptr.procFun[termSuffix] = algo.SuffixMatch
 
-	(*patternCache)[needle] = ptr
+	patternCache.Add(needle, ptr)
 	return ptr
 }
 
-func parseTerms(fuzzy bool, caseMode Case, normalize bool, str string) []termSet {
+func parseTerms(fuzzy bool, caseMode Case, folder caseFolder, normalization Normalization, str string) []termSet {
 	str = strings.Replace(str, "\\ ", "\t", -1)
 	all_tokens := strings.Split(str, " ")
 	var tokens []string
@@ -158,14 +177,13 @@ func parseTerms(fuzzy bool, caseMode Case, normalize bool, str string) []termSet
 	afterBar := false
 	for _, token := range tokens {
 		typ, inv, text := termFuzzy, false, strings.Replace(token, "\t", " ", -1)
-		lowerText := strings.ToLower(text)
+		lowerText := folder.lower(text)
 		caseSensitive := caseMode == CaseRespect ||
 			caseMode == CaseSmart && text != lowerText
-		normalizeTerm := normalize &&
-			lowerText == string(algo.NormalizeRunes([]rune(lowerText)))
 		if !caseSensitive {
-			text = lowerText
+			text = folder.fold(text)
 		}
+		normalizeTerm := normalizes(normalization, strings.ToLower(text))
 		if !fuzzy {
 			typ = termExact
 		}
@@ -243,17 +261,196 @@ func (p *Pattern) AsString() string {
 	return string(p.text)
 }
 
-func (p *Pattern) buildCacheKey() string {
+// buildCacheTermSets returns the term sets that determine which items the
+// pattern matches. A basic (non-extended) pattern is a single term.
+func (p *Pattern) buildCacheTermSets() []termSet {
 	if !p.extended {
-		return p.AsString()
+		if len(p.text) == 0 {
+			return nil
+		}
+		typ := termFuzzy
+		if !p.fuzzy {
+			typ = termExact
+		}
+		return []termSet{{term{
+			typ:           typ,
+			text:          p.text,
+			caseSensitive: p.caseSensitive,
+			normalize:     p.normalize}}}
 	}
-	cacheableTerms := []string{}
-	for _, termSet := range p.termSets {
-		if len(termSet) == 1 && !termSet[0].inv && (p.fuzzy || termSet[0].typ == termExact) {
-			cacheableTerms = append(cacheableTerms, string(termSet[0].text))
+	return p.termSets
+}
+
+// cacheKey returns a string that uniquely identifies the items the term
+// matches
+func (t term) cacheKey() string {
+	return fmt.Sprintf("%d:%v:%v:%v:%q", t.typ, t.inv, t.caseSensitive, t.normalize, string(t.text))
+}
+
+// buildCacheKey returns a string that is equal for all patterns that match
+// the same items, regardless of the order of the terms
+func buildCacheKey(termSets []termSet) string {
+	setKeys := make([]string, len(termSets))
+	for idx, termSet := range termSets {
+		termKeys := make([]string, len(termSet))
+		for tidx, term := range termSet {
+			termKeys[tidx] = term.cacheKey()
+		}
+		sort.Strings(termKeys)
+		setKeys[idx] = strings.Join(termKeys, " | ")
+	}
+	sort.Strings(setKeys)
+	return strings.Join(setKeys, " ")
+}
+
+// isSubsequence returns true if all runes of needle appear in haystack in
+// the same order
+func isSubsequence(needle []rune, haystack []rune) bool {
+	idx := 0
+	for _, r := range haystack {
+		if idx < len(needle) && needle[idx] == r {
+			idx++
+		}
+	}
+	return idx == len(needle)
+}
+
+// hasRunesAt returns true if text contains needle at offset
+func hasRunesAt(text []rune, needle []rune, offset int) bool {
+	if offset < 0 || offset+len(needle) > len(text) {
+		return false
+	}
+	for idx, r := range needle {
+		if text[offset+idx] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// containsRunes returns true if needle is a substring of text
+func containsRunes(text []rune, needle []rune) bool {
+	for offset := 0; offset+len(needle) <= len(text); offset++ {
+		if hasRunesAt(text, needle, offset) {
+			return true
+		}
+	}
+	return false
+}
+
+// subsumes returns true if every item matched by the (non-inverse) term t is
+// also matched by the (non-inverse) term other
+func (t term) subsumes(other term) bool {
+	if t.caseSensitive != other.caseSensitive || t.normalize != other.normalize {
+		return false
+	}
+	switch other.typ {
+	case termFuzzy:
+		// The exact algorithms fold case slightly differently from the fuzzy
+		// ones, so only fuzzy terms can narrow fuzzy terms
+		return t.typ == termFuzzy && isSubsequence(other.text, t.text)
+	case termExact:
+		return t.typ != termFuzzy && containsRunes(t.text, other.text)
+	case termPrefix:
+		return (t.typ == termPrefix || t.typ == termEqual) && hasRunesAt(t.text, other.text, 0)
+	case termSuffix:
+		return (t.typ == termSuffix || t.typ == termEqual) &&
+			hasRunesAt(t.text, other.text, len(t.text)-len(other.text))
+	case termEqual:
+		return t.typ == termEqual && len(t.text) == len(other.text) && hasRunesAt(t.text, other.text, 0)
+	}
+	return false
+}
+
+// implies returns true if every item matched by the term t is also matched by
+// the term other
+func (t term) implies(other term) bool {
+	if t.inv != other.inv {
+		return false
+	}
+	if t.inv {
+		// Not matching a term implies not matching any term that subsumes it
+		return other.subsumes(t)
+	}
+	return t.subsumes(other)
+}
+
+// implies returns true if every item matched by the term set (at least one of
+// its terms) is also matched by the other term set
+func (ts termSet) implies(other termSet) bool {
+	for _, term := range ts {
+		found := false
+		for _, otherTerm := range other {
+			if term.implies(otherTerm) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// narrows returns true if every item matched by the pattern is also matched
+// by the given term sets, so that their results can be used as search space
+func (p *Pattern) narrows(termSets []termSet) bool {
+	for _, other := range termSets {
+		found := false
+		for _, termSet := range p.cacheTermSets {
+			if termSet.implies(other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
 		}
 	}
-	return strings.Join(cacheableTerms, "\t")
+	return true
+}
+
+// buildNarrowingKeys returns the cache keys of the weaker patterns whose
+// results the ChunkCache uses as search space: the pattern with a term
+// shortened to a prefix or a suffix, and one of its term sets (possibly
+// shortened) alone or left out. E.g. for "foo bar" these are "fo bar",
+// "foo ar", "foo", "bar", "fo", and so on. Only the keys of patterns that
+// narrow this one are kept. Searches while typing find the previous needle
+// among them, without comparing the pattern to every cached entry.
+func (p *Pattern) buildNarrowingKeys() []string {
+	keys := []string{}
+	seen := map[string]bool{p.cacheKey: true}
+	add := func(termSets ...termSet) {
+		if len(termSets) == 0 {
+			return
+		}
+		key := buildCacheKey(termSets)
+		if !seen[key] {
+			seen[key] = true
+			if p.narrows(termSets) {
+				keys = append(keys, key)
+			}
+		}
+	}
+	for idx, set := range p.cacheTermSets {
+		others := make([]termSet, 0, len(p.cacheTermSets))
+		others = append(append(others, p.cacheTermSets[:idx]...), p.cacheTermSets[idx+1:]...)
+		add(others...)
+		add(set)
+		if len(set) != 1 {
+			continue
+		}
+		for length := 1; length < len(set[0].text); length++ {
+			for _, text := range [][]rune{set[0].text[:length], set[0].text[len(set[0].text)-length:]} {
+				shorter := set[0]
+				shorter.text = text
+				add(termSet{shorter})
+				add(append(others[:len(others):len(others)], termSet{shorter})...)
+			}
+		}
+	}
+	return keys
 }
 
 // CacheKey is used to build string to be used as the key of result cache
@@ -261,51 +458,106 @@ func (p *Pattern) CacheKey() string {
 	return p.cacheKey
 }
 
-// Match returns the list of matches Items in the given Chunk
-func (p *Pattern) Match(chunk *Chunk, slab *util.Slab, chunkCache *ChunkCache) []Result {
+// Match returns the list of matches Items in the given Chunk. If cancelled
+// (which may be nil) returns true while matching, the matching stops, and the
+// returned list is incomplete.
+func (p *Pattern) Match(chunk *Chunk, slab *util.Slab, chunkCache *ChunkCache, cancelled func() bool) []Result {
 	// ChunkCache: Exact match
-	cacheKey := p.CacheKey()
 	if p.cacheable {
-		if cached := chunkCache.Lookup(chunk, cacheKey); cached != nil {
+		if cached := chunkCache.Lookup(chunk, p); cached != nil {
 			return cached
 		}
 	}
 
-	// Prefix/suffix cache
-	space := chunkCache.Search(chunk, cacheKey)
+	// Results of weaker patterns narrow down the search space
+	space := chunkCache.Search(chunk, p)
 
-	matches := p.matchChunk(chunk, space, slab)
+	matches, complete := p.matchChunk(chunk, space, slab, cancelled)
 
-	if p.cacheable {
-		chunkCache.Add(chunk, cacheKey, matches)
+	if p.cacheable && complete {
+		chunkCache.Add(chunk, p, matches)
 	}
 	return matches
 }
 
-func (p *Pattern) matchChunk(chunk *Chunk, space []Result, slab *util.Slab) []Result {
+func (p *Pattern) matchChunk(chunk *Chunk, space []Result, slab *util.Slab, cancelled func() bool) ([]Result, bool) {
 	matches := []Result{}
+	// None of the items can match if the chunk lacks a character
+	if chunk.charMask&p.charMask != p.charMask {
+		return matches, true
+	}
 
-	if space == nil {
+	if index := chunk.getIndex(); space == nil && index != nil && len(p.indexQuery) > 0 {
+		complete := true
+		candidates := index.candidates(p.indexQuery, chunk.count)
+		candidates.union(&chunk.transliterated)
+		candidates.each(func(idx int) {
+			if !complete || cancelled != nil && cancelled() {
+				complete = false
+				return
+			}
+			if match, _, _ := p.MatchItem(&chunk.items[idx], p.withPos, slab); match != nil {
+				matches = append(matches, *match)
+			}
+		})
+		return matches, complete
+	} else if space == nil {
 		for idx := 0; idx < chunk.count; idx++ {
-			if match, _, _ := p.MatchItem(&chunk.items[idx], true, slab); match != nil {
+			if cancelled != nil && cancelled() {
+				return matches, false
+			}
+			if match, _, _ := p.MatchItem(&chunk.items[idx], p.withPos, slab); match != nil {
 				matches = append(matches, *match)
 			}
 		}
 	} else {
 		for _, result := range space {
-			if match, _, _ := p.MatchItem(result.item, true, slab); match != nil {
+			if cancelled != nil && cancelled() {
+				return matches, false
+			}
+			if match, _, _ := p.MatchItem(result.item, p.withPos, slab); match != nil {
 				matches = append(matches, *match)
 			}
 		}
 	}
-	return matches
+	return matches, true
+}
+
+// buildCharMask returns the bits of the characters that every match must
+// contain: those of the non-inverse terms, where the terms of an OR only
+// require the bits they have in common
+func (p *Pattern) buildCharMask() uint64 {
+	if !p.extended {
+		return algo.RunesMask(p.text)
+	}
+	var mask uint64
+	for _, termSet := range p.termSets {
+		// Any of the terms may match, so only the bits they have in common
+		// are required
+		setMask := algo.AllChars
+		for _, term := range termSet {
+			if term.inv {
+				setMask = 0
+				break
+			}
+			setMask &= algo.RunesMask(term.text)
+		}
+		mask |= setMask
+	}
+	return mask
 }
 
 // MatchItem returns true if the Item is a match
 func (p *Pattern) MatchItem(item *Item, withPos bool, slab *util.Slab) (*Result, []Offset, *[]int) {
+	// Items that lack a character of the pattern are rejected without
+	// running the algorithms
+	if item.charMask&p.charMask != p.charMask {
+		return nil, nil, nil
+	}
 	if p.extended {
 		if offsets, bonus, pos := p.extendedMatch(item, withPos, slab); len(offsets) == len(p.termSets) {
-			result := buildResult(item, offsets, pos, bonus, p.sortCriteria)
+			weight := p.itemWeight(item)
+			result := buildResult(item, offsets, pos, bonus, weight, p.weightedScore(bonus, weight), p.sortCriteria, p.customCriteria)
 			return &result, offsets, pos
 		}
 		return nil, nil, nil
@@ -313,24 +565,65 @@ func (p *Pattern) MatchItem(item *Item, withPos bool, slab *util.Slab) (*Result,
 	offset, bonus, pos := p.basicMatch(item, withPos, slab)
 	if sidx := offset[0]; sidx >= 0 {
 		offsets := []Offset{offset}
-		result := buildResult(item, offsets, pos, bonus, p.sortCriteria)
+		weight := p.itemWeight(item)
+		result := buildResult(item, offsets, pos, bonus, weight, p.weightedScore(bonus, weight), p.sortCriteria, p.customCriteria)
 		return &result, offsets, pos
 	}
 	return nil, nil, nil
 }
 
+// itemWeight returns the weight of the item; see Fzf.SetWeight
+func (p *Pattern) itemWeight(item *Item) int32 {
+	if p.weightOf == nil {
+		return 0
+	}
+	return p.weightOf(item.Index())
+}
+
+// weightedScore returns the score that an item with the given weight is
+// ranked by with ByScore
+func (p *Pattern) weightedScore(score int, weight int32) int {
+	if p.weigh != nil {
+		return p.weigh(score, weight)
+	}
+	return score + int(weight)
+}
+
+// matchText runs the algorithm on the text of the item for the term, or else
+// on its transliterated text, and maps the offset and the positions of a match
+// back to the item
+func (p *Pattern) matchText(pfun algo.Algo, item *Item, caseSensitive bool, normalize bool, pattern []rune, withPos bool, slab *util.Slab) (Offset, int, *[]int) {
+	input := &item.text
+	var transformed, transliterated *transformed
+	if item.texts != nil {
+		idx := transformIndex(caseSensitive, normalize)
+		transformed, transliterated = item.texts.transformed[idx], item.texts.transliterated[idx]
+	}
+	if transformed != nil {
+		input = &transformed.text
+	}
+	offset, score, pos := p.iter(pfun, []*util.Chars{input}, caseSensitive, normalize, p.forward, pattern, withPos, slab)
+	if offset[0] < 0 {
+		// The item is also matched as its transliterated text
+		if transformed = transliterated; transformed != nil {
+			offset, score, pos = p.iter(pfun, []*util.Chars{&transformed.text}, caseSensitive, normalize, p.forward, pattern, withPos, slab)
+		}
+	}
+	if transformed != nil && offset[0] >= 0 {
+		offset = transformed.offset(offset)
+		transformed.positions(pos)
+	}
+	return offset, score, pos
+}
+
 func (p *Pattern) basicMatch(item *Item, withPos bool, slab *util.Slab) (Offset, int, *[]int) {
-	var input []*util.Chars
-	input = []*util.Chars{&item.text}
 	if p.fuzzy {
-		return p.iter(p.fuzzyAlgo, input, p.caseSensitive, p.normalize, p.forward, p.text, withPos, slab)
+		return p.matchText(p.fuzzyAlgo, item, p.caseSensitive, p.normalize, p.text, withPos, slab)
 	}
-	return p.iter(algo.ExactMatchNaive, input, p.caseSensitive, p.normalize, p.forward, p.text, withPos, slab)
+	return p.matchText(algo.ExactMatchNaive, item, p.caseSensitive, p.normalize, p.text, withPos, slab)
 }
 
 func (p *Pattern) extendedMatch(item *Item, withPos bool, slab *util.Slab) ([]Offset, int, *[]int) {
-	var input []*util.Chars
-	input = []*util.Chars{&item.text}
 	offsets := []Offset{}
 	var totalScore int
 	var allPos *[]int
@@ -343,7 +636,7 @@ func (p *Pattern) extendedMatch(item *Item, withPos bool, slab *util.Slab) ([]Of
 		matched := false
 		for _, term := range termSet {
 			pfun := p.procFun[term.typ]
-			off, score, pos := p.iter(pfun, input, term.caseSensitive, term.normalize, p.forward, term.text, withPos, slab)
+			off, score, pos := p.matchText(pfun, item, term.caseSensitive, term.normalize, term.text, withPos, slab)
 			if sidx := off[0]; sidx >= 0 {
 				if term.inv {
 					continue
@@ -0,0 +1,119 @@
+package fzf
+
+import "sync"
+
+// WorkerPool runs the scan work of any number of Fzf instances on a fixed
+// number of goroutines, so that the total number of concurrent scans is capped.
+// Instances take turns: a worker picks a task from the next instance in line
+// that has work waiting, so a large search does not starve the others.
+type WorkerPool struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	ready   []*poolClient
+	closed  bool
+	workers int
+}
+
+// poolClient holds the tasks of a single submitter (Matcher)
+type poolClient struct {
+	tasks   []func()
+	running int
+	// Maximum number of tasks of this client that may run concurrently;
+	// 0 means no limit other than the number of workers
+	limit  int
+	queued bool
+}
+
+// NewWorkerPool returns a new WorkerPool with the given number of worker
+// goroutines. If workers is 0 or less, the number of CPUs is used.
+func NewWorkerPool(workers int) *WorkerPool {
+	if workers <= 0 {
+		workers = numCPU()
+	}
+	pool := &WorkerPool{workers: workers}
+	pool.cond = sync.NewCond(&pool.mutex)
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// Workers returns the number of worker goroutines of the pool
+func (p *WorkerPool) Workers() int {
+	return p.workers
+}
+
+// Close stops the workers once all submitted tasks are done. Tasks that are
+// submitted after Close run on their own goroutine.
+func (p *WorkerPool) Close() {
+	p.mutex.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+}
+
+func (p *WorkerPool) newClient(limit int) *poolClient {
+	return &poolClient{limit: limit}
+}
+
+// submit queues the task for the client
+func (p *WorkerPool) submit(client *poolClient, task func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		go task()
+		return
+	}
+	client.tasks = append(client.tasks, task)
+	p.enqueue(client)
+}
+
+// enqueue puts the client at the end of the line if it has a task that may
+// run. Unsynchronized; should be called with the mutex held.
+func (p *WorkerPool) enqueue(client *poolClient) {
+	if client.queued || len(client.tasks) == 0 ||
+		client.limit > 0 && client.running >= client.limit {
+		return
+	}
+	client.queued = true
+	p.ready = append(p.ready, client)
+	p.cond.Signal()
+}
+
+// next blocks until there is a task to run, and returns it with its client.
+// Returns nil if the pool is closed and there is nothing left to do.
+func (p *WorkerPool) next() (*poolClient, func()) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for len(p.ready) == 0 {
+		if p.closed {
+			return nil, nil
+		}
+		p.cond.Wait()
+	}
+	client := p.ready[0]
+	p.ready[0] = nil
+	p.ready = p.ready[1:]
+	client.queued = false
+
+	task := client.tasks[0]
+	client.tasks[0] = nil
+	client.tasks = client.tasks[1:]
+	client.running++
+	p.enqueue(client)
+	return client, task
+}
+
+func (p *WorkerPool) work() {
+	for {
+		client, task := p.next()
+		if task == nil {
+			return
+		}
+		task()
+		p.mutex.Lock()
+		client.running--
+		p.enqueue(client)
+		p.mutex.Unlock()
+	}
+}
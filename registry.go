@@ -0,0 +1,250 @@
+package fzf
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrUnknownHaystack is returned when searching a haystack that was never
+// added to the Registry, or that was removed
+var ErrUnknownHaystack = errors.New("unknown haystack")
+
+// ErrRegistryClosed is returned when using a Registry after Close
+var ErrRegistryClosed = errors.New("registry closed")
+
+// Registry manages many named haystacks in a single process. All haystacks
+// share a WorkerPool (and, like all Fzf objects, the pool of slabs). The Fzf
+// object (with its goroutines and caches) for a haystack is only created when
+// it is searched, and is thrown away again by a background goroutine after it
+// has not been searched for a while.
+type Registry struct {
+	mutex       sync.Mutex
+	opts        Options
+	ownPool     bool
+	idleTimeout time.Duration
+	haystacks   map[string]*registryEntry
+	closed      bool
+	stop        chan struct{}
+}
+
+// registryEntry holds a haystack. All fields are guarded by the mutex of the
+// Registry; the searchMutex serializes the searches (and appends) on the
+// haystack, since they share one result channel.
+type registryEntry struct {
+	searchMutex sync.Mutex
+	hayStack    []string
+	fzf         *Fzf
+	lastUsed    time.Time
+	users       int
+	removed     bool
+}
+
+// NewRegistry returns a new Registry that uses the given options for all its
+// haystacks. If opts.Pool is nil, the Registry creates a WorkerPool with one
+// worker per CPU. Instances that have not been searched for idleTimeout are
+// ended; an idleTimeout of 0 or less keeps them forever. The idle instances
+// are looked for twice per idle timeout, until the Registry is closed.
+func NewRegistry(opts Options, idleTimeout time.Duration) *Registry {
+	ownPool := opts.Pool == nil
+	if ownPool {
+		opts.Pool = NewWorkerPool(0)
+	}
+	r := &Registry{
+		opts:        opts,
+		ownPool:     ownPool,
+		idleTimeout: idleTimeout,
+		haystacks:   make(map[string]*registryEntry),
+		stop:        make(chan struct{}),
+	}
+	if idleTimeout > 0 {
+		go r.evictLoop(time.NewTicker(idleTimeout / 2))
+	}
+	return r
+}
+
+// Add adds a haystack with the given id, replacing any existing haystack with
+// the same id. The haystack is copied, so the caller may reuse the slice.
+func (r *Registry) Add(id string, hayStack []string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return ErrRegistryClosed
+	}
+	if entry, found := r.haystacks[id]; found {
+		r.removeEntry(entry)
+	}
+	// The haystack is copied, as Append appends to it
+	hayStack = append([]string(nil), hayStack...)
+	r.haystacks[id] = &registryEntry{hayStack: hayStack, lastUsed: time.Now()}
+	return nil
+}
+
+// Append adds items to the end of the haystack with the given id
+func (r *Registry) Append(id string, hayStack []string) error {
+	entry, err := r.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer r.release(entry)
+	entry.searchMutex.Lock()
+	defer entry.searchMutex.Unlock()
+
+	r.mutex.Lock()
+	entry.hayStack = append(entry.hayStack, hayStack...)
+	fzf := entry.fzf
+	r.mutex.Unlock()
+	if fzf != nil {
+		fzf.Append(hayStack)
+	}
+	return nil
+}
+
+// Remove removes the haystack with the given id
+func (r *Registry) Remove(id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if entry, found := r.haystacks[id]; found {
+		r.removeEntry(entry)
+		delete(r.haystacks, id)
+	}
+}
+
+// Search searches the needle in the haystack with the given id and waits for
+// the result. Searches on the same haystack are done one after the other;
+// searches on different haystacks run concurrently.
+func (r *Registry) Search(id string, needle string) (SearchResult, error) {
+	entry, err := r.acquire(id)
+	if err != nil {
+		return SearchResult{}, err
+	}
+	defer r.release(entry)
+	entry.searchMutex.Lock()
+	defer entry.searchMutex.Unlock()
+
+	r.mutex.Lock()
+	fzf, hayStack := entry.fzf, entry.hayStack
+	entry.lastUsed = time.Now()
+	r.mutex.Unlock()
+	if fzf == nil {
+		// Only we can create or end the Fzf object while holding the
+		// searchMutex, so it is safe to create it without holding the lock
+		fzf = New(hayStack, r.opts)
+		r.mutex.Lock()
+		entry.fzf = fzf
+		r.mutex.Unlock()
+	}
+	fzf.Search(needle)
+	return <-fzf.GetResultChannel(), nil
+}
+
+// Len returns the number of haystacks, and the number of those that currently
+// have a running Fzf object
+func (r *Registry) Len() (int, int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	running := 0
+	for _, entry := range r.haystacks {
+		if entry.fzf != nil {
+			running++
+		}
+	}
+	return len(r.haystacks), running
+}
+
+// EvictIdle ends the Fzf objects of all haystacks that have not been searched
+// for the idle timeout. This also happens in the background, so it only needs
+// to be called to free them right away.
+func (r *Registry) EvictIdle() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.evictIdle()
+}
+
+// Close ends all Fzf objects and, if the Registry created it, the WorkerPool
+func (r *Registry) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	r.closed = true
+	close(r.stop)
+	for id, entry := range r.haystacks {
+		r.removeEntry(entry)
+		delete(r.haystacks, id)
+	}
+	if r.ownPool {
+		r.opts.Pool.Close()
+	}
+}
+
+// acquire returns the entry with the given id, and marks it as in use so that
+// it won't be evicted
+func (r *Registry) acquire(id string) (*registryEntry, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return nil, ErrRegistryClosed
+	}
+	entry, found := r.haystacks[id]
+	if !found {
+		return nil, ErrUnknownHaystack
+	}
+	entry.users++
+	return entry, nil
+}
+
+// release marks the entry as no longer in use by the caller. The last user of
+// a removed entry ends its Fzf object.
+func (r *Registry) release(entry *registryEntry) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry.users--
+	if entry.removed {
+		r.endEntry(entry)
+	}
+}
+
+// removeEntry marks the entry as removed. Should be called with the mutex
+// held.
+func (r *Registry) removeEntry(entry *registryEntry) {
+	entry.removed = true
+	r.endEntry(entry)
+}
+
+// endEntry ends the Fzf object of the entry, unless it is in use. Should be
+// called with the mutex held.
+func (r *Registry) endEntry(entry *registryEntry) {
+	if entry.users == 0 && entry.fzf != nil {
+		entry.fzf.End()
+		entry.fzf = nil
+	}
+}
+
+// evictLoop evicts the idle instances on every tick, until the Registry is
+// closed
+func (r *Registry) evictLoop(ticker *time.Ticker) {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.EvictIdle()
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// evictIdle ends the Fzf objects that have been idle for too long. Should be
+// called with the mutex held.
+func (r *Registry) evictIdle() {
+	if r.idleTimeout <= 0 {
+		return
+	}
+	for _, entry := range r.haystacks {
+		if time.Since(entry.lastUsed) >= r.idleTimeout {
+			r.endEntry(entry)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package fzf
 
 import (
+	"container/heap"
 	"math"
 	"sort"
 	"unicode"
@@ -12,21 +13,32 @@ import (
 type Offset [2]int32
 
 type Result struct {
-	item      *Item
-	points    [4]uint16
-	positions *[]int
-	score     int
+	item *Item
+	// The value of each of the first 4 sort criteria, lower is better. The
+	// first criterion is last, so that on little-endian architectures the
+	// points can be compared as 64-bit words.
+	points [4]uint32
+	// The values of the criteria after the first 4, in the same order; nil
+	// unless Options.Sort has more than 4 criteria
+	morePoints *[maxSortCriteria - 4]uint32
+	positions  *[]int
+	score      int
 }
 
-func buildResult(item *Item, offsets []Offset, positions *[]int, score int, sortCriteria []Criterion) Result {
+// buildResult returns the Result of a match with the given score, which is
+// ranked by the weighted score
+func buildResult(item *Item, offsets []Offset, positions *[]int, score int, weight int32, weightedScore int, sortCriteria []Criterion, customCriteria []func(SortInfo) int32) Result {
 	if len(offsets) > 1 {
 		sort.Sort(ByOrder(offsets))
 	}
 
 	result := Result{item: item, positions: positions, score: score}
+	if len(sortCriteria) > len(result.points) {
+		result.morePoints = new([maxSortCriteria - 4]uint32)
+	}
 	numChars := item.text.Length()
-	minBegin := math.MaxUint16
-	minEnd := math.MaxUint16
+	minBegin := math.MaxInt32
+	minEnd := math.MaxInt32
 	maxEnd := 0
 	validOffsetFound := false
 	for _, offset := range offsets {
@@ -40,13 +52,17 @@ func buildResult(item *Item, offsets []Offset, positions *[]int, score int, sort
 	}
 
 	for idx, criterion := range sortCriteria {
-		val := uint16(math.MaxUint16)
+		if idx >= maxSortCriteria {
+			break
+		}
+		val := uint32(math.MaxUint32)
 		switch criterion {
 		case ByScore:
-			// Higher is better
-			val = math.MaxUint16 - util.AsUint16(score)
+			// Higher is better. Weights can make the score negative, so it
+			// is offset to keep the order.
+			val = math.MaxUint32 - (uint32(util.Constrain(weightedScore, math.MinInt32, math.MaxInt32)) ^ 1<<31)
 		case ByLength:
-			val = item.TrimLength()
+			val = util.AsUint32(item.TrimLength())
 		case ByBegin, ByEnd:
 			if validOffsetFound {
 				whitePrefixLen := 0
@@ -58,25 +74,88 @@ func buildResult(item *Item, offsets []Offset, positions *[]int, score int, sort
 					}
 				}
 				if criterion == ByBegin {
-					val = util.AsUint16(minEnd - whitePrefixLen)
+					val = util.AsUint32(minEnd - whitePrefixLen)
+				} else if trimLength := item.TrimLength(); trimLength > 0 {
+					// A match in the trailing whitespace ends past the
+					// trimmed text, which ranks it like a match at its end
+					end := util.Constrain(maxEnd-whitePrefixLen, 0, trimLength)
+					val = math.MaxUint32 - uint32(math.MaxUint32*uint64(end)/uint64(trimLength))
 				} else {
-					val = util.AsUint16(math.MaxUint16 - math.MaxUint16*(maxEnd-whitePrefixLen)/int(item.TrimLength()))
+					val = 0
+				}
+			}
+		case ByIndex:
+			val = uint32(item.Index())
+		case ByIndexDesc:
+			val = math.MaxUint32 - uint32(item.Index())
+		case ByPathDepth:
+			val = util.AsUint32(pathDepth(item))
+		default:
+			if rank := customRank(criterion, customCriteria); rank != nil {
+				info := SortInfo{HayIndex: item.Index(), Score: score, Weight: weight, item: item}
+				if validOffsetFound {
+					info.Begin, info.End = minBegin, maxEnd
 				}
+				// Flip the sign bit so that the ranks compare as unsigned
+				val = uint32(rank(info)) ^ 1<<31
 			}
 		}
-		result.points[3-idx] = val
+		if idx < len(result.points) {
+			result.points[len(result.points)-1-idx] = val
+		} else {
+			result.morePoints[maxSortCriteria-1-idx] = val
+		}
 	}
 
 	return result
 }
 
+// pathDepth returns the number of path separators in the item, not counting
+// a trailing one
+func pathDepth(item *Item) int {
+	depth := 0
+	length := item.text.Length()
+	for idx := 0; idx < length-1; idx++ {
+		if r := item.text.Get(idx); r == '/' || r == '\\' {
+			depth++
+		}
+	}
+	return depth
+}
+
 // Index returns ordinal index of the Item
 func (result *Result) Index() int32 {
 	return result.item.Index()
 }
 
 func minRank() Result {
-	return Result{item: &minItem, points: [4]uint16{math.MaxUint16, 0, 0, 0}}
+	result := Result{item: &minItem}
+	for idx := range result.points {
+		result.points[idx] = math.MaxUint32
+	}
+	return result
+}
+
+// compareWideRanks is compareRanks for Results with points for more than 4
+// criteria, which are compared after the first 4
+func compareWideRanks(irank *Result, jrank *Result, tac bool) bool {
+	if irank.points == jrank.points && irank.morePoints != nil && jrank.morePoints != nil {
+		for idx := len(irank.morePoints) - 1; idx >= 0; idx-- {
+			if left, right := irank.morePoints[idx], jrank.morePoints[idx]; left != right {
+				return left < right
+			}
+		}
+	}
+	return compareRanks(irank, jrank, tac)
+}
+
+// moreRelevant returns true if irank ranks before jrank. The Less methods
+// repeat it, so that compareRanks is inlined in them.
+func moreRelevant(irank *Result, jrank *Result, tac bool) bool {
+	if irank.morePoints != nil {
+		return compareWideRanks(irank, jrank, tac)
+	}
+	return compareRanks(irank, jrank, tac)
 }
 
 // ByOrder is for sorting substring offsets
@@ -108,7 +187,10 @@ func (a ByRelevance) Swap(i, j int) {
 }
 
 func (a ByRelevance) Less(i, j int) bool {
-	return compareRanks(a[i], a[j], false)
+	if a[i].morePoints != nil {
+		return compareWideRanks(&a[i], &a[j], false)
+	}
+	return compareRanks(&a[i], &a[j], false)
 }
 
 // ByRelevanceTac is for sorting Items
@@ -123,5 +205,71 @@ func (a ByRelevanceTac) Swap(i, j int) {
 }
 
 func (a ByRelevanceTac) Less(i, j int) bool {
-	return compareRanks(a[i], a[j], true)
+	if a[i].morePoints != nil {
+		return compareWideRanks(&a[i], &a[j], true)
+	}
+	return compareRanks(&a[i], &a[j], true)
+}
+
+// sortResults sorts the results by relevance
+func sortResults(results []Result, tac bool) {
+	if tac {
+		sort.Sort(ByRelevanceTac(results))
+	} else {
+		sort.Sort(ByRelevance(results))
+	}
+}
+
+// worstFirst is a heap of Results with the least relevant one on top
+type worstFirst struct {
+	results []Result
+	tac     bool
+}
+
+func (h *worstFirst) Len() int {
+	return len(h.results)
+}
+
+func (h *worstFirst) Swap(i, j int) {
+	h.results[i], h.results[j] = h.results[j], h.results[i]
+}
+
+func (h *worstFirst) Less(i, j int) bool {
+	if h.results[j].morePoints != nil {
+		return compareWideRanks(&h.results[j], &h.results[i], h.tac)
+	}
+	return compareRanks(&h.results[j], &h.results[i], h.tac)
+}
+
+func (h *worstFirst) Push(x interface{}) {
+	h.results = append(h.results, x.(Result))
+}
+
+func (h *worstFirst) Pop() interface{} {
+	last := h.results[len(h.results)-1]
+	h.results = h.results[:len(h.results)-1]
+	return last
+}
+
+// selectBest returns the limit most relevant results sorted by relevance, and
+// the other results in no particular order. If limit is 0 or less, all
+// results are sorted. The given slice is reused.
+func selectBest(results []Result, limit int, tac bool) ([]Result, []Result) {
+	if limit <= 0 || len(results) <= limit {
+		sortResults(results, tac)
+		return results, nil
+	}
+	best := &worstFirst{results: make([]Result, limit), tac: tac}
+	copy(best.results, results[:limit])
+	heap.Init(best)
+	rest := results[limit:limit]
+	for _, result := range results[limit:] {
+		if moreRelevant(&result, &best.results[0], tac) {
+			result, best.results[0] = best.results[0], result
+			heap.Fix(best, 0)
+		}
+		rest = append(rest, result)
+	}
+	sortResults(best.results, tac)
+	return best.results, rest
 }
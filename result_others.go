@@ -2,7 +2,7 @@
 
 package fzf
 
-func compareRanks(irank Result, jrank Result, tac bool) bool {
+func compareRanks(irank *Result, jrank *Result, tac bool) bool {
 	for idx := 3; idx >= 0; idx-- {
 		left := irank.points[idx]
 		right := jrank.points[idx]
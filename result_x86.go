@@ -4,9 +4,14 @@ package fzf
 
 import "unsafe"
 
-func compareRanks(irank Result, jrank Result, tac bool) bool {
-	left := *(*uint64)(unsafe.Pointer(&irank.points[0]))
-	right := *(*uint64)(unsafe.Pointer(&jrank.points[0]))
+func compareRanks(irank *Result, jrank *Result, tac bool) bool {
+	// Two criteria at a time, the first criterion in the highest bits
+	left := *(*uint64)(unsafe.Pointer(&irank.points[2]))
+	right := *(*uint64)(unsafe.Pointer(&jrank.points[2]))
+	if left == right {
+		left = *(*uint64)(unsafe.Pointer(&irank.points[0]))
+		right = *(*uint64)(unsafe.Pointer(&jrank.points[0]))
+	}
 	if left < right {
 		return true
 	} else if left > right {
@@ -0,0 +1,534 @@
+package fzf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+	"unsafe"
+
+	"github.com/reinhrst/fzf-lib/util"
+)
+
+// ErrInvalidSnapshot is returned when opening a file that is not a snapshot,
+// or that was written by an incompatible version
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// A snapshot file consists of a header, followed by the sections below. All
+// numbers are little endian, and every section starts at a multiple of 8
+// bytes, so that the numbers can be used in place.
+//
+//	header     magic, version, chunk size, number of items, text length,
+//	           number of indexed chunks, number of history lines, number of
+//	           frecency keys
+//	ends       [items]uint64 offset of the end of each item in the text; the
+//	           highest bit is set for items that are not ASCII
+//	charMasks  [items]uint64 algo.CharMask of each item
+//	text       the items, one after the other: ASCII items as bytes, and the
+//	           others as uint32 runes, which start at a multiple of 4 bytes
+//	indexes    per indexed chunk: the number of keys and of postings, the
+//	           unindexed items, the keys, the offsets and the postings
+//	history    [lines+1]uint64 offsets, and the text of the lines
+//	frecency   [keys+1]uint64 offsets, [keys]uint64 counts, [keys]uint64 Unix
+//	           times of the last visits, and the text of the keys
+//
+// So the items are used in place, without decoding or copying them.
+const (
+	snapshotMagic    = "FZFSNAP\x00"
+	snapshotVersion  = 2
+	snapshotNonASCII = uint64(1) << 63
+)
+
+var littleEndian = func() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}()
+
+// Snapshot is a haystack that was written with Fzf.WriteSnapshot. Where the
+// operating system allows, the file is memory-mapped, so that opening it is
+// fast and processes that open the same file share its memory. Any number of
+// Fzf objects can be created from a Snapshot with NewFromSnapshot.
+type Snapshot struct {
+	data     []byte
+	release  func() error
+	chunks   []*Chunk
+	history  []string
+	frecency *Frecency
+}
+
+// OpenSnapshot opens the snapshot file at path. The Snapshot must be closed,
+// after ending all Fzf objects that were created from it.
+func OpenSnapshot(path string) (*Snapshot, error) {
+	data, release, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := readSnapshot(data)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	snapshot.release = release
+	return snapshot, nil
+}
+
+// Len returns the number of items in the snapshot
+func (s *Snapshot) Len() int {
+	return CountItems(s.chunks)
+}
+
+// History returns a History with the lines that were written with the
+// snapshot, of which it keeps the last maxSize. Like with NewHistory, the
+// lines that are appended to it are written to the file at path.
+func (s *Snapshot) History(path string, maxSize int) *History {
+	lines := s.history
+	if len(lines) > maxSize {
+		lines = lines[len(lines)-maxSize:]
+	}
+	lines = append(append([]string(nil), lines...), "")
+	return &History{
+		path:     path,
+		maxSize:  maxSize,
+		lines:    lines,
+		modified: make(map[int]string),
+		cursor:   len(lines) - 1}
+}
+
+// Frecency returns a copy of the Frecency that was written with the snapshot
+func (s *Snapshot) Frecency() *Frecency {
+	frecency := NewFrecency()
+	for key, v := range s.frecency.visits {
+		frecency.visits[key] = v
+	}
+	return frecency
+}
+
+// Close releases the file. Fzf objects created from the snapshot, and the
+// KeyBytes of their matches, must not be used afterwards.
+func (s *Snapshot) Close() error {
+	return s.release()
+}
+
+// NewFromSnapshot creates a new Fzf object, with the haystack of the snapshot
+// and the given options. Items that are appended later are not written to the
+// snapshot. If opts.Index is set, indexes that are missing from the snapshot
+// are built in the background.
+func NewFromSnapshot(snapshot *Snapshot, opts Options) *Fzf {
+	transforms := newItemTransforms(opts.CaseFolding, opts.Normalize, opts.Transliterate)
+	chunks := make([]*Chunk, len(snapshot.chunks))
+	for i, chunk := range snapshot.chunks {
+		// The items of the snapshot are shared, so only the chunks with
+		// items that the options transform are copied
+		chunks[i] = chunk.transform(transforms)
+	}
+	if cnt := len(chunks); cnt > 0 && !chunks[cnt-1].IsFull() && chunks[cnt-1] == snapshot.chunks[cnt-1] {
+		// Full chunks never change, but the last chunk is appended to
+		chunks[cnt-1] = &Chunk{
+			items:     chunks[cnt-1].items,
+			count:     chunks[cnt-1].count,
+			maxLength: chunks[cnt-1].maxLength,
+			charMask:  chunks[cnt-1].charMask}
+	}
+	fzf := newFzf(newChunkListFrom(chunks, transforms), opts)
+	fzf.requestIndex()
+	fzf.start()
+	return fzf
+}
+
+// WriteSnapshot writes the haystack to w, with the lines of the history and
+// the frecency (either can be nil), so that it can be opened with
+// OpenSnapshot. If the Fzf object was created with opts.Index, the index is
+// completed and written as well. The weights of the items are not written;
+// the items of a snapshot start with weight 0.
+func (fzf *Fzf) WriteSnapshot(w io.Writer, history *History, frecency *Frecency) error {
+	chunks, count := fzf.chunkList.Snapshot()
+	var lines []string
+	if history != nil {
+		// The last line is the one being edited
+		lines = history.lines[:len(history.lines)-1]
+	}
+	var frecencyKeys []string
+	if frecency != nil {
+		for key := range frecency.visits {
+			frecencyKeys = append(frecencyKeys, key)
+		}
+		sort.Strings(frecencyKeys)
+	}
+	if fzf.indexRequests != nil {
+		indexChunks(chunks, fzf.indexWorkers)
+	}
+	indexed := 0
+	for indexed < len(chunks) && chunks[indexed].getIndex() != nil {
+		indexed++
+	}
+
+	eachItem := func(fun func(*Item)) {
+		for _, chunk := range chunks {
+			for idx := 0; idx < chunk.count; idx++ {
+				fun(&chunk.items[idx])
+			}
+		}
+	}
+	// end returns the end of the item in the text that starts at offset
+	end := func(offset int, item *Item) int {
+		if item.text.IsBytes() {
+			return offset + item.text.Length()
+		}
+		return align(offset, 4) + 4*item.text.Length()
+	}
+	sw := snapshotWriter{w: bufio.NewWriter(w)}
+	textLength := 0
+	eachItem(func(item *Item) {
+		textLength = end(textLength, item)
+	})
+	sw.write([]byte(snapshotMagic))
+	sw.uint32s(snapshotVersion, uint32(chunkSize))
+	sw.uint64s(uint64(count), uint64(textLength), uint64(indexed), uint64(len(lines)),
+		uint64(len(frecencyKeys)))
+
+	offset := 0
+	eachItem(func(item *Item) {
+		flags := uint64(0)
+		if !item.text.IsBytes() {
+			flags = snapshotNonASCII
+		}
+		offset = end(offset, item)
+		sw.uint64s(uint64(offset) | flags)
+	})
+	eachItem(func(item *Item) {
+		sw.uint64s(item.charMask)
+	})
+	eachItem(func(item *Item) {
+		if item.text.IsBytes() {
+			sw.write(item.text.Bytes())
+			return
+		}
+		sw.padTo(4)
+		for _, r := range item.text.ToRunes() {
+			sw.uint32s(uint32(r))
+		}
+	})
+	sw.pad()
+
+	for _, chunk := range chunks[:indexed] {
+		index := chunk.getIndex()
+		sw.uint64s(uint64(len(index.keys)), uint64(len(index.postings)))
+		sw.uint64s(index.unindexed[:]...)
+		sw.uint64s(index.keys...)
+		sw.uint32s(index.offsets...)
+		sw.pad()
+		sw.write(index.postings)
+		sw.pad()
+	}
+
+	sw.strings(lines)
+	sw.offsets(frecencyKeys)
+	for _, key := range frecencyKeys {
+		sw.uint64s(frecency.visits[key].count)
+	}
+	for _, key := range frecencyKeys {
+		sw.uint64s(uint64(frecency.visits[key].last))
+	}
+	sw.write([]byte(strings.Join(frecencyKeys, "")))
+	sw.pad()
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// snapshotWriter writes the sections of a snapshot, keeping the first error
+type snapshotWriter struct {
+	w    *bufio.Writer
+	size int
+	err  error
+}
+
+func (sw *snapshotWriter) write(data []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(data)
+		sw.size += len(data)
+	}
+}
+
+func (sw *snapshotWriter) uint64s(values ...uint64) {
+	var buf [8]byte
+	for _, value := range values {
+		binary.LittleEndian.PutUint64(buf[:], value)
+		sw.write(buf[:])
+	}
+}
+
+func (sw *snapshotWriter) uint32s(values ...uint32) {
+	var buf [4]byte
+	for _, value := range values {
+		binary.LittleEndian.PutUint32(buf[:], value)
+		sw.write(buf[:])
+	}
+}
+
+// offsets writes the offsets of the strings, one after the other
+func (sw *snapshotWriter) offsets(strs []string) {
+	offset := 0
+	for _, str := range strs {
+		sw.uint64s(uint64(offset))
+		offset += len(str)
+	}
+	sw.uint64s(uint64(offset))
+}
+
+// strings writes the offsets and the text of the strings
+func (sw *snapshotWriter) strings(strs []string) {
+	sw.offsets(strs)
+	sw.write([]byte(strings.Join(strs, "")))
+	sw.pad()
+}
+
+// pad writes zeroes up to the next multiple of 8 bytes
+func (sw *snapshotWriter) pad() {
+	sw.padTo(8)
+}
+
+// padTo writes zeroes up to the next multiple of n bytes
+func (sw *snapshotWriter) padTo(n int) {
+	sw.write(make([]byte, align(sw.size, n)-sw.size))
+}
+
+// align returns offset rounded up to a multiple of n
+func align(offset int, n int) int {
+	return (offset + n - 1) / n * n
+}
+
+// snapshotReader reads the sections of a snapshot. After the first error, it
+// returns empty values.
+type snapshotReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (sr *snapshotReader) take(n int) []byte {
+	if sr.err != nil || n < 0 || n > len(sr.data)-sr.pos {
+		sr.err = ErrInvalidSnapshot
+		return nil
+	}
+	data := sr.data[sr.pos : sr.pos+n]
+	sr.pos += n
+	return data
+}
+
+// pad skips to the next multiple of 8 bytes
+func (sr *snapshotReader) pad() {
+	sr.take((8 - sr.pos%8) % 8)
+}
+
+// uint64s returns n numbers. They are used in place if the byte order and
+// the alignment allow it.
+func (sr *snapshotReader) uint64s(n int) []uint64 {
+	data := sr.take(n * 8)
+	if len(data) == 0 {
+		return nil
+	}
+	if littleEndian && uintptr(unsafe.Pointer(&data[0]))%8 == 0 {
+		var values []uint64
+		header := (*reflect.SliceHeader)(unsafe.Pointer(&values))
+		header.Data = uintptr(unsafe.Pointer(&data[0]))
+		header.Len = n
+		header.Cap = n
+		return values
+	}
+	values := make([]uint64, n)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return values
+}
+
+func (sr *snapshotReader) uint32s(n int) []uint32 {
+	data := sr.take(n * 4)
+	if len(data) == 0 {
+		return nil
+	}
+	if littleEndian && uintptr(unsafe.Pointer(&data[0]))%4 == 0 {
+		var values []uint32
+		header := (*reflect.SliceHeader)(unsafe.Pointer(&values))
+		header.Data = uintptr(unsafe.Pointer(&data[0]))
+		header.Len = n
+		header.Cap = n
+		return values
+	}
+	values := make([]uint32, n)
+	for i := range values {
+		values[i] = binary.LittleEndian.Uint32(data[i*4:])
+	}
+	return values
+}
+
+// count returns a number of elements, which can't exceed the size of the data
+func (sr *snapshotReader) count() int {
+	values := sr.uint64s(1)
+	if len(values) == 0 || values[0] > uint64(len(sr.data)) {
+		sr.err = ErrInvalidSnapshot
+		return 0
+	}
+	return int(values[0])
+}
+
+// strings returns n strings, which are copied, as they may outlive the data
+func (sr *snapshotReader) strings(n int, text []byte, offsets []uint64) []string {
+	strs := make([]string, n)
+	for i := range strs {
+		start, end := offsets[i], offsets[i+1]
+		if start > end || end > uint64(len(text)) {
+			sr.err = ErrInvalidSnapshot
+			return nil
+		}
+		strs[i] = string(text[start:end])
+	}
+	return strs
+}
+
+// runes returns the runes in data, which are used in place if the byte
+// order and the alignment allow it
+func (sr *snapshotReader) runes(data []byte) []rune {
+	n := len(data) / 4
+	if n == 0 {
+		return []rune{}
+	}
+	var runes []rune
+	if littleEndian && uintptr(unsafe.Pointer(&data[0]))%4 == 0 {
+		header := (*reflect.SliceHeader)(unsafe.Pointer(&runes))
+		header.Data = uintptr(unsafe.Pointer(&data[0]))
+		header.Len = n
+		header.Cap = n
+	} else {
+		runes = make([]rune, n)
+		for i := range runes {
+			runes[i] = rune(binary.LittleEndian.Uint32(data[i*4:]))
+		}
+	}
+	// The algorithms look up runes in tables, which invalid runes are not in
+	for _, r := range runes {
+		if r < 0 || r > utf8.MaxRune {
+			sr.err = ErrInvalidSnapshot
+			return nil
+		}
+	}
+	return runes
+}
+
+// readSnapshot parses the snapshot in data. The items refer to data, so it
+// must not change.
+func readSnapshot(data []byte) (*Snapshot, error) {
+	sr := snapshotReader{data: data}
+	if string(sr.take(len(snapshotMagic))) != snapshotMagic {
+		return nil, ErrInvalidSnapshot
+	}
+	header := sr.uint32s(2)
+	if sr.err != nil || header[0] != snapshotVersion || header[1] != uint32(chunkSize) {
+		return nil, ErrInvalidSnapshot
+	}
+	count, textLength, indexed := sr.count(), sr.count(), sr.count()
+	historyCount, frecencyCount := sr.count(), sr.count()
+	ends := sr.uint64s(count)
+	charMasks := sr.uint64s(count)
+	text := sr.take(textLength)
+	sr.pad()
+	if sr.err != nil || indexed > (count+chunkSize-1)/chunkSize {
+		return nil, ErrInvalidSnapshot
+	}
+
+	snapshot := &Snapshot{data: data}
+	// The chunks are allocated together, and the items point into the text
+	chunks := make([]Chunk, (count+chunkSize-1)/chunkSize)
+	snapshot.chunks = make([]*Chunk, len(chunks))
+	start := uint64(0)
+	for i := 0; i < count; i++ {
+		end := ends[i] &^ snapshotNonASCII
+		nonASCII := ends[i]&snapshotNonASCII != 0
+		if nonASCII {
+			start = uint64(align(int(start), 4))
+		}
+		if start > end || end > uint64(textLength) || nonASCII && (end-start)%4 != 0 {
+			return nil, ErrInvalidSnapshot
+		}
+		chunk := &chunks[i/chunkSize]
+		snapshot.chunks[i/chunkSize] = chunk
+		item := &chunk.items[chunk.count]
+		if nonASCII {
+			item.text = util.RunesToChars(sr.runes(text[start:end]))
+			if sr.err != nil {
+				return nil, ErrInvalidSnapshot
+			}
+		} else {
+			item.text = util.AsciiToChars(text[start:end])
+		}
+		item.text.Index = int32(i)
+		item.charMask = charMasks[i]
+		chunk.added(chunk.count)
+		chunk.count++
+		start = end
+	}
+
+	for _, chunk := range snapshot.chunks[:indexed] {
+		index := &chunkIndex{}
+		numKeys, numPostings := sr.count(), sr.count()
+		copy(index.unindexed[:], sr.uint64s(len(index.unindexed)))
+		index.keys = sr.uint64s(numKeys)
+		index.offsets = sr.uint32s(numKeys + 1)
+		sr.pad()
+		index.postings = sr.take(numPostings)
+		sr.pad()
+		if sr.err != nil || !index.valid(chunk.count) {
+			return nil, ErrInvalidSnapshot
+		}
+		chunk.setIndex(index)
+	}
+
+	historyOffsets := sr.uint64s(historyCount + 1)
+	if sr.err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	snapshot.history = sr.strings(historyCount, sr.take(int(historyOffsets[historyCount])), historyOffsets)
+	sr.pad()
+
+	frecencyOffsets := sr.uint64s(frecencyCount + 1)
+	counts := sr.uint64s(frecencyCount)
+	times := sr.uint64s(frecencyCount)
+	if sr.err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	keys := sr.strings(frecencyCount, sr.take(int(frecencyOffsets[frecencyCount])), frecencyOffsets)
+	if sr.err != nil {
+		return nil, ErrInvalidSnapshot
+	}
+	snapshot.frecency = NewFrecency()
+	for i, key := range keys {
+		snapshot.frecency.visits[key] = visit{counts[i], int64(times[i])}
+	}
+	return snapshot, nil
+}
+
+// valid returns true if the offsets and postings of the index are within
+// bounds, so that lookups can't fail
+func (index *chunkIndex) valid(count int) bool {
+	if index.offsets[0] != 0 || int(index.offsets[len(index.offsets)-1]) != len(index.postings) {
+		return false
+	}
+	for i := 1; i < len(index.offsets); i++ {
+		if index.offsets[i] < index.offsets[i-1] {
+			return false
+		}
+	}
+	for _, idx := range index.postings {
+		if int(idx) >= count {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,31 @@
+// +build linux darwin freebsd netbsd openbsd dragonfly
+// +build !tinygo
+
+package fzf
+
+import (
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file into memory, and returns the function that unmaps it
+func mapFile(path string) ([]byte, func() error, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := info.Size()
+	if size == 0 || int64(int(size)) != size {
+		return nil, nil, ErrInvalidSnapshot
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return syscall.Munmap(data) }, nil
+}
@@ -0,0 +1,14 @@
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly tinygo
+
+package fzf
+
+import "io/ioutil"
+
+// mapFile reads the file into memory, as memory-mapping is not supported
+func mapFile(path string) ([]byte, func() error, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,96 @@
+package fzf
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheStats holds the counters of a single cache
+type CacheStats struct {
+	Hits    int64
+	Misses  int64
+	Entries int
+	// Approximate number of bytes kept alive by the cache
+	Bytes int
+}
+
+// SearchTimings holds the time spent in the different phases of a search
+type SearchTimings struct {
+	// Matching the chunks against the pattern (0 if the merger was cached)
+	Scan time.Duration
+	// Merging the sorted partial results into a single list
+	Merge time.Duration
+	// Converting the results into MatchResults
+	Convert time.Duration
+}
+
+func (t *SearchTimings) add(other SearchTimings) {
+	t.Scan += other.Scan
+	t.Merge += other.Merge
+	t.Convert += other.Convert
+}
+
+// Stats gives insight into how well the caches work for the current workload
+type Stats struct {
+	// Exact lookups of a query in the per-chunk result cache
+	ChunkCache CacheStats
+	// Lookups of a shorter (prefix/suffix) query in the per-chunk result cache,
+	// used to narrow down the search space. Entries and Bytes are not set.
+	ChunkCacheNarrowing CacheStats
+	// Lookups of complete search results in the matcher
+	MergerCache CacheStats
+	// Lookups of parsed needles
+	PatternCache CacheStats
+	// Number of searches that delivered a result
+	Searches int64
+	// Timings of the most recent search
+	LastSearch SearchTimings
+	// Timings of all searches combined
+	TotalSearch SearchTimings
+}
+
+// cacheCounters counts hits and misses, and may be updated concurrently
+type cacheCounters struct {
+	hits   int64
+	misses int64
+}
+
+func (c *cacheCounters) count(hit bool) {
+	if hit {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+}
+
+func (c *cacheCounters) stats() CacheStats {
+	return CacheStats{
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// searchStats collects the timings of searches
+type searchStats struct {
+	mutex    sync.Mutex
+	searches int64
+	last     SearchTimings
+	total    SearchTimings
+}
+
+func (s *searchStats) add(timings SearchTimings) {
+	s.mutex.Lock()
+	s.searches++
+	s.last = timings
+	s.total.add(timings)
+	s.mutex.Unlock()
+}
+
+func (s *searchStats) fill(stats *Stats) {
+	s.mutex.Lock()
+	stats.Searches = s.searches
+	stats.LastSearch = s.last
+	stats.TotalSearch = s.total
+	s.mutex.Unlock()
+}
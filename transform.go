@@ -0,0 +1,363 @@
+package fzf
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/reinhrst/fzf-lib/algo"
+	"github.com/reinhrst/fzf-lib/util"
+)
+
+// runeTransform maps the runes of the text of an item to the runes that it
+// is matched as. A rune may map to more than one rune, so the transformed
+// text keeps track of where its runes came from.
+type runeTransform struct {
+	// The ASCII characters that are mapped; other ASCII characters are kept
+	// without calling mapRune, so that most ASCII texts need no copy
+	ascii [utf8.RuneSelf]bool
+	// mapRune appends the runes that r maps to to dst, or returns false if r
+	// is kept as it is
+	mapRune func(dst []rune, r rune) ([]rune, bool)
+}
+
+// transformed is the text of an item after a runeTransform
+type transformed struct {
+	text util.Chars
+	// The index of the rune of the original text that each rune came from
+	origins []int32
+	// The length of the original text
+	length int32
+}
+
+// apply returns the transformed text, or nil if the transform doesn't change
+// the text
+func (t *runeTransform) apply(text *util.Chars) *transformed {
+	length := text.Length()
+	first := 0
+	if text.IsBytes() {
+		bytes := text.Bytes()
+		for first < length && !t.ascii[bytes[first]] {
+			first++
+		}
+		if first == length {
+			return nil
+		}
+	}
+
+	var runes []rune
+	var origins []int32
+	var scratch [4]rune
+	for idx := first; idx < length; idx++ {
+		r := text.Get(idx)
+		if r < utf8.RuneSelf && !t.ascii[r] {
+			if runes != nil {
+				runes = append(runes, r)
+				origins = append(origins, int32(idx))
+			}
+			continue
+		}
+		if runes == nil {
+			mapped, changed := t.mapRune(scratch[:0], r)
+			if !changed {
+				continue
+			}
+			// The first change; the runes before it are kept
+			runes = make([]rune, idx, length+8)
+			origins = make([]int32, idx, length+8)
+			for i := 0; i < idx; i++ {
+				runes[i] = text.Get(i)
+				origins[i] = int32(i)
+			}
+			runes = append(runes, mapped...)
+		} else {
+			var changed bool
+			if runes, changed = t.mapRune(runes, r); !changed {
+				runes = append(runes, r)
+			}
+		}
+		for len(origins) < len(runes) {
+			origins = append(origins, int32(idx))
+		}
+	}
+	if runes == nil {
+		return nil
+	}
+	return &transformed{util.RunesToChars(runes), origins, int32(length)}
+}
+
+// origin returns the index in the original text of the rune at idx
+func (t *transformed) origin(idx int32) int32 {
+	if idx < int32(len(t.origins)) {
+		return t.origins[idx]
+	}
+	return t.length
+}
+
+// offset maps an offset in the transformed text to the original text
+func (t *transformed) offset(offset Offset) Offset {
+	if offset[0] >= offset[1] {
+		begin := t.origin(offset[0])
+		return Offset{begin, begin}
+	}
+	return Offset{t.origin(offset[0]), t.origin(offset[1]-1) + 1}
+}
+
+// then returns the text that next transformed the text of t to, with the
+// origins in the text that t transformed
+func (t *transformed) then(next *transformed) *transformed {
+	origins := make([]int32, len(next.origins))
+	for idx, origin := range next.origins {
+		origins[idx] = t.origin(origin)
+	}
+	return &transformed{next.text, origins, t.length}
+}
+
+// positions maps the positions in the transformed text to the original text,
+// in place. Runes that came from the same rune give a single position.
+func (t *transformed) positions(pos *[]int) {
+	if pos == nil {
+		return
+	}
+	mapped := (*pos)[:0]
+	for _, p := range *pos {
+		origin := int(t.origin(int32(p)))
+		if len(mapped) == 0 || mapped[len(mapped)-1] != origin {
+			mapped = append(mapped, origin)
+		}
+	}
+	*pos = mapped
+}
+
+// composeTransforms returns the transform that maps the runes with first, and
+// the runes that they map to with second
+func composeTransforms(first *runeTransform, second *runeTransform) *runeTransform {
+	if first == nil {
+		return second
+	} else if second == nil {
+		return first
+	}
+	composed := &runeTransform{}
+	for c := range composed.ascii {
+		composed.ascii[c] = first.ascii[c] || second.ascii[c]
+	}
+	composed.mapRune = func(dst []rune, r rune) ([]rune, bool) {
+		var scratch [4]rune
+		mapped, changed := scratch[:0], false
+		if r >= utf8.RuneSelf || first.ascii[r] {
+			mapped, changed = first.mapRune(mapped, r)
+		}
+		if !changed {
+			mapped = append(mapped, r)
+		}
+		for _, m := range mapped {
+			if m >= utf8.RuneSelf || second.ascii[m] {
+				var mappedTwice bool
+				if dst, mappedTwice = second.mapRune(dst, m); mappedTwice {
+					changed = true
+					continue
+				}
+			}
+			dst = append(dst, m)
+		}
+		return dst, changed
+	}
+	return composed
+}
+
+// newDecomposer returns the transform that decomposes the runes for the
+// normalization, or nil if the algorithms normalize them themselves
+func newDecomposer(normalization Normalization) *runeTransform {
+	if normalization < NormalizeDiacritics {
+		return nil
+	}
+	compatibility := normalization == NormalizeCompatibility
+	return &runeTransform{mapRune: func(dst []rune, r rune) ([]rune, bool) {
+		return algo.Decompose(dst, r, compatibility)
+	}}
+}
+
+// normalizes returns true if the lowercase text of a term is normalized: if
+// none of its characters would be changed by the normalization
+func normalizes(normalization Normalization, lowerText string) bool {
+	if normalization == NormalizeNone ||
+		lowerText != string(algo.NormalizeRunes([]rune(lowerText))) {
+		return false
+	}
+	if decomposer := newDecomposer(normalization); decomposer != nil {
+		chars := util.RunesToChars([]rune(lowerText))
+		return decomposer.apply(&chars) == nil
+	}
+	return true
+}
+
+// Index of the transform of the items for a term in Pattern.transforms
+func transformIndex(caseSensitive bool, normalize bool) int {
+	idx := 0
+	if !caseSensitive {
+		idx |= 1
+	}
+	if normalize {
+		idx |= 2
+	}
+	return idx
+}
+
+// itemTransforms are the transforms of the texts of the items for the
+// options, which are applied once, when the items are added
+type itemTransforms struct {
+	// By transformIndex; nil where the items are matched as they are
+	transforms    [4]*runeTransform
+	transliterate Transliterator
+}
+
+// newItemTransforms returns the transforms of the items for the options, or
+// nil if the items are matched as they are
+func newItemTransforms(folding CaseFolding, normalization Normalization, transliterate Transliterator) *itemTransforms {
+	folder := newCaseFolder(folding)
+	decomposer := newDecomposer(normalization)
+	if folder.items == nil && decomposer == nil && transliterate == nil {
+		return nil
+	}
+	t := &itemTransforms{transliterate: transliterate}
+	t.transforms[transformIndex(false, false)] = folder.items
+	t.transforms[transformIndex(true, true)] = decomposer
+	t.transforms[transformIndex(false, true)] = composeTransforms(decomposer, folder.items)
+	return t
+}
+
+// itemTexts are the texts that an item is matched as instead of its text
+type itemTexts struct {
+	// The text after each transform, by transformIndex; nil where the
+	// transform doesn't change it
+	transformed [4]*transformed
+	// The transliterated text, as it is and after each transform, by
+	// transformIndex; nil if the item is not transliterated
+	transliterated [4]*transformed
+}
+
+// texts returns the texts of an item with the given text, or nil if it is
+// matched as it is
+func (t *itemTransforms) texts(text *util.Chars) *itemTexts {
+	if t == nil {
+		return nil
+	}
+	texts := &itemTexts{}
+	changed := false
+	for idx, transformed := range t.apply(text) {
+		if transformed != nil {
+			texts.transformed[idx] = transformed
+			changed = true
+		}
+	}
+	if t.transliterate != nil {
+		if latin := transliterate(t.transliterate, text); latin != nil {
+			for idx, transformed := range t.apply(&latin.text) {
+				if transformed != nil {
+					texts.transliterated[idx] = latin.then(transformed)
+				} else {
+					texts.transliterated[idx] = latin
+				}
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return texts
+}
+
+// apply returns the text after each transform, by transformIndex; nil where
+// the transform doesn't change it. Transforms that are the same are applied
+// once.
+func (t *itemTransforms) apply(text *util.Chars) [4]*transformed {
+	var result [4]*transformed
+	for idx, transform := range t.transforms {
+		if transform == nil {
+			continue
+		}
+		same := -1
+		for prev := 0; prev < idx && same < 0; prev++ {
+			if t.transforms[prev] == transform {
+				same = prev
+			}
+		}
+		if same >= 0 {
+			result[idx] = result[same]
+		} else {
+			result[idx] = transform.apply(text)
+		}
+	}
+	return result
+}
+
+// caseFolder folds the case-insensitive terms of a pattern, and the items
+// they are matched against, according to a CaseFolding
+type caseFolder struct {
+	turkish bool
+	// nil if the items are matched as they are, and lowercased by the
+	// algorithms
+	items *runeTransform
+}
+
+func newCaseFolder(folding CaseFolding) caseFolder {
+	turkish := folding&FoldTurkish != 0
+	folding &^= FoldTurkish
+	if folding == FoldLower && !turkish {
+		return caseFolder{}
+	}
+	transform := &runeTransform{}
+	transform.ascii['I'] = turkish
+	transform.mapRune = func(dst []rune, r rune) ([]rune, bool) {
+		if folding == FoldFull {
+			if runes := algo.FullCaseFold(r); runes != nil {
+				return append(dst, runes...), true
+			}
+		}
+		var folded rune
+		if turkish && (r == 'I' || r == 'İ') {
+			folded = algo.TurkishCaseFold(r)
+		} else if folding != FoldLower {
+			folded = algo.CaseFold(r)
+		} else {
+			return dst, false
+		}
+		// The algorithms lowercase uppercase runes themselves, but not title
+		// case runes
+		if folded == r || unicode.IsUpper(r) && folded == unicode.ToLower(r) {
+			return dst, false
+		}
+		// Uppercase letters are kept uppercase if possible, for the bonus
+		// of camel case
+		if unicode.IsUpper(r) {
+			if upper := unicode.ToUpper(folded); unicode.ToLower(upper) == folded {
+				folded = upper
+			}
+		}
+		return append(dst, folded), true
+	}
+	return caseFolder{turkish, transform}
+}
+
+// lower returns the lowercase text of a term
+func (f caseFolder) lower(text string) string {
+	if f.turkish {
+		return strings.ToLowerSpecial(unicode.TurkishCase, text)
+	}
+	return strings.ToLower(text)
+}
+
+// fold returns the text of a case-insensitive term, lowercased and folded
+// like the items it is matched against
+func (f caseFolder) fold(text string) string {
+	text = f.lower(text)
+	if f.items == nil {
+		return text
+	}
+	chars := util.RunesToChars([]rune(text))
+	if folded := f.items.apply(&chars); folded != nil {
+		return folded.text.ToString()
+	}
+	return text
+}
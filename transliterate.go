@@ -0,0 +1,204 @@
+package fzf
+
+import (
+	"unicode"
+
+	"github.com/reinhrst/fzf-lib/algo"
+	"github.com/reinhrst/fzf-lib/util"
+)
+
+// transliterate returns the text transliterated by t, or nil if t doesn't
+// change it. The runes that several runes are transliterated to are spread
+// over them, so that the positions of a match cover all of them.
+func transliterate(t Transliterator, text *util.Chars) *transformed {
+	// ASCII texts are not transliterated
+	if text.IsBytes() {
+		return nil
+	}
+	runes := text.ToRunes()
+	latin := make([]rune, 0, len(runes)+8)
+	origins := make([]int32, 0, len(runes)+8)
+	changed := false
+	for idx := 0; idx < len(runes); {
+		start := len(latin)
+		var count int
+		if latin, count = t(latin, runes[idx:]); count <= 0 {
+			latin = append(latin[:start], runes[idx])
+			count = 1
+		} else {
+			changed = true
+			count = util.Min(count, len(runes)-idx)
+		}
+		length := len(latin) - start
+		for i := 0; i < length; i++ {
+			origins = append(origins, int32(idx+i*count/length))
+		}
+		idx += count
+	}
+	if !changed {
+		return nil
+	}
+	return &transformed{util.RunesToChars(latin), origins, int32(len(runes))}
+}
+
+// Transliterators returns the Transliterator that transliterates the text with
+// the first of the transliterators that transliterates it
+func Transliterators(transliterators ...Transliterator) Transliterator {
+	return func(dst []rune, text []rune) ([]rune, int) {
+		for _, t := range transliterators {
+			if latin, count := t(dst, text); count > 0 {
+				return latin, count
+			}
+		}
+		return dst, 0
+	}
+}
+
+// appendLetter appends the transliteration of the letter r in the table, which
+// has the lowercase letters, with its first letter uppercase if r is
+func appendLetter(dst []rune, r rune, letters map[rune]string) ([]rune, int) {
+	lower := unicode.ToLower(r)
+	latin, found := letters[lower]
+	if !found {
+		return dst, 0
+	}
+	for i, l := range latin {
+		if i == 0 && lower != r {
+			l = unicode.ToUpper(l)
+		}
+		dst = append(dst, l)
+	}
+	return dst, 1
+}
+
+// TransliterateCyrillic transliterates the Cyrillic letters of Russian,
+// Belarusian, Serbian and Macedonian to Latin letters, so that moskva matches
+// Москва. The hard and the soft sign are left out. For Ukrainian, whose и is
+// romanized as y, see TransliterateUkrainian.
+func TransliterateCyrillic(dst []rune, text []rune) ([]rune, int) {
+	return appendLetter(dst, text[0], cyrillicLetters)
+}
+
+var cyrillicLetters = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "yo",
+	'ж': "zh", 'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m",
+	'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u",
+	'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "",
+	'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+	'і': "i", 'ї': "yi", 'є': "ye", 'ґ': "g", 'ў': "u",
+	'ђ': "dj", 'ј': "j", 'љ': "lj", 'њ': "nj", 'ћ': "c", 'џ': "dz",
+	'ѓ': "gj", 'ќ': "kj", 'ѕ': "dz",
+}
+
+// TransliterateUkrainian transliterates Ukrainian letters to Latin letters
+// with the national romanization of Ukraine, so that kyiv matches Київ and
+// kharkiv matches Харків. Є, Ї, Й, Ю and Я are ye, yi, y, yu and ya at the
+// start of a word, which it finds from the letters appended to dst before,
+// and ie, i, i, iu and ia elsewhere. The soft sign is left out.
+func TransliterateUkrainian(dst []rune, text []rune) ([]rune, int) {
+	if len(dst) == 0 || !unicode.IsLetter(dst[len(dst)-1]) {
+		if latin, count := appendLetter(dst, text[0], ukrainianInitials); count > 0 {
+			return latin, count
+		}
+	}
+	return appendLetter(dst, text[0], ukrainianLetters)
+}
+
+var ukrainianLetters = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "h", 'ґ': "g", 'д': "d", 'е': "e",
+	'є': "ie", 'ж': "zh", 'з': "z", 'и': "y", 'і': "i", 'ї': "i", 'й': "i",
+	'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r",
+	'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch",
+	'ш': "sh", 'щ': "shch", 'ь': "", 'ю': "iu", 'я': "ia",
+}
+
+var ukrainianInitials = map[rune]string{
+	'є': "ye", 'ї': "yi", 'й': "y", 'ю': "yu", 'я': "ya",
+}
+
+// TransliterateGreek transliterates Greek letters, with or without
+// diacritics, to Latin letters, so that athina matches Αθήνα
+func TransliterateGreek(dst []rune, text []rune) ([]rune, int) {
+	r := text[0]
+	var scratch [4]rune
+	if base, found := algo.Decompose(scratch[:0], r, false); found && len(base) == 1 {
+		r = base[0]
+	}
+	return appendLetter(dst, r, greekLetters)
+}
+
+var greekLetters = map[rune]string{
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i",
+	'θ': "th", 'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x",
+	'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y",
+	'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+// TransliterateKana transliterates Japanese hiragana and katakana to Latin
+// letters with Hepburn romanization, so that tokyo matches とうきょう and
+// トウキョウ. The long vowel mark is kept.
+func TransliterateKana(dst []rune, text []rune) ([]rune, int) {
+	kana := hiragana(text[0])
+	latin, found := kanaLetters[kana]
+	if !found {
+		return dst, 0
+	}
+	if len(text) > 1 {
+		next := hiragana(text[1])
+		// The small tsu doubles the consonant of the next kana
+		if kana == 'っ' {
+			if consonant := []rune(kanaLetters[next]); len(consonant) > 1 {
+				if consonant[0] == 'c' {
+					consonant[0] = 't'
+				}
+				dst = append(dst, consonant[0])
+			}
+			return dst, 1
+		}
+		// A small ya, yu or yo combines with the kana before it: きゃ is kya,
+		// and しゃ is sha
+		if vowel, small := smallYKana[next]; small && len(latin) > 1 && latin[len(latin)-1] == 'i' {
+			for _, l := range latin[:len(latin)-1] {
+				dst = append(dst, l)
+			}
+			if last := latin[len(latin)-2]; last != 'h' && last != 'j' {
+				dst = append(dst, 'y')
+			}
+			return append(dst, vowel), 2
+		}
+	}
+	for _, l := range latin {
+		dst = append(dst, l)
+	}
+	return dst, 1
+}
+
+// hiragana returns the hiragana of the katakana r, or r itself
+func hiragana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - ('ァ' - 'ぁ')
+	}
+	return r
+}
+
+var smallYKana = map[rune]rune{'ゃ': 'a', 'ゅ': 'u', 'ょ': 'o'}
+
+var kanaLetters = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo", 'ゃ': "ya", 'ゅ': "yu", 'ょ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゎ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n",
+	'っ': "", 'ゔ': "vu", 'ゕ': "ka", 'ゖ': "ke",
+}
@@ -2,6 +2,8 @@ package util
 
 import (
 	"fmt"
+	"math"
+	"reflect"
 	"unicode"
 	"unicode/utf8"
 	"unsafe"
@@ -45,12 +47,28 @@ func checkAscii(bytes []byte) (bool, int) {
 
 // ToChars converts byte array into rune array
 func ToChars(bytes []byte) Chars {
+	return ToCharsReusing(bytes, nil)
+}
+
+// ToCharsReusing is ToChars, but decodes bytes that are not ASCII into the
+// array of *buffer if it is large enough, or else into a new one that it
+// stores in *buffer (if not nil). The Chars are only valid until the buffer
+// is reused.
+func ToCharsReusing(bytes []byte, buffer *[]rune) Chars {
 	inBytes, bytesUntil := checkAscii(bytes)
 	if inBytes {
 		return Chars{slice: bytes, inBytes: inBytes}
 	}
 
-	runes := make([]rune, bytesUntil, len(bytes))
+	var runes []rune
+	if buffer != nil && cap(*buffer) >= len(bytes) {
+		runes = (*buffer)[:bytesUntil]
+	} else {
+		runes = make([]rune, bytesUntil, len(bytes))
+		if buffer != nil {
+			*buffer = runes
+		}
+	}
 	for i := 0; i < bytesUntil; i++ {
 		runes[i] = rune(bytes[i])
 	}
@@ -62,6 +80,23 @@ func ToChars(bytes []byte) Chars {
 	return RunesToChars(runes)
 }
 
+// AsciiToChars returns the Chars of bytes that are known to be ASCII, without
+// looking at them
+func AsciiToChars(bytes []byte) Chars {
+	return Chars{slice: bytes, inBytes: true}
+}
+
+// StringBytes returns the bytes of the string without copying them; they
+// must not be modified
+func StringBytes(s string) []byte {
+	var bytes []byte
+	header := (*reflect.SliceHeader)(unsafe.Pointer(&bytes))
+	header.Data = (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	header.Len = len(s)
+	header.Cap = len(s)
+	return bytes
+}
+
 func RunesToChars(runes []rune) Chars {
 	return Chars{slice: *(*[]byte)(unsafe.Pointer(&runes)), inBytes: false}
 }
@@ -101,9 +136,10 @@ func (chars *Chars) String() string {
 }
 
 // TrimLength returns the length after trimming leading and trailing whitespaces
-func (chars *Chars) TrimLength() uint16 {
-	if chars.trimLengthKnown {
-		return chars.trimLength
+func (chars *Chars) TrimLength() int {
+	// Lengths that don't fit in the cached value are computed every time
+	if chars.trimLengthKnown && chars.trimLength < math.MaxUint16 {
+		return int(chars.trimLength)
 	}
 	chars.trimLengthKnown = true
 	var i int
@@ -127,7 +163,7 @@ func (chars *Chars) TrimLength() uint16 {
 		}
 	}
 	chars.trimLength = AsUint16(i - j + 1)
-	return chars.trimLength
+	return i - j + 1
 }
 
 func (chars *Chars) LeadingWhitespaces() int {
@@ -0,0 +1,144 @@
+// +build ignore
+
+// This program generates graphemes_table.go. It needs github.com/rivo/uniseg
+// (v0.4.7, Unicode 15.0), whose grapheme clusters and widths it reproduces:
+//
+//	go run gen_graphemes.go > graphemes_table.go
+
+package main
+
+import (
+	"fmt"
+	"go/format"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// The names of the grapheme break properties in graphemes.go
+var names = []string{"gbOther", "gbCR", "gbLF", "gbControl", "gbExtend", "gbZWJ",
+	"gbRegionalIndicator", "gbPrepend", "gbSpacingMark", "gbL", "gbV", "gbT", "gbLV",
+	"gbLVT", "gbExtendedPictographic"}
+
+const (
+	gbOther = iota
+	gbCR
+	gbLF
+	gbControl
+	gbExtend
+	gbZWJ
+	gbRegionalIndicator
+	gbPrepend
+	gbSpacingMark
+	gbL
+	gbV
+	gbT
+	gbLV
+	gbLVT
+	gbExtendedPictographic
+)
+
+func main() {
+	var properties, widths strings.Builder
+	writeRanges(&properties, func(r rune) string {
+		if p := property(r); p != gbOther {
+			return names[p]
+		}
+		return ""
+	})
+	writeRanges(&widths, func(r rune) string {
+		if width := uniseg.StringWidth(string(r)); width != 1 {
+			return fmt.Sprint(width)
+		}
+		return ""
+	})
+
+	source := fmt.Sprintf(`// Code generated by gen_graphemes.go; DO NOT EDIT.
+
+package util
+
+// graphemeProperties are the grapheme cluster break properties of the runes
+// that are not ASCII (see graphemeProperty for those), other than gbOther
+var graphemeProperties = []runeRange{
+%s}
+
+// runeWidths are the widths of the runes that are not ASCII, other than 1
+var runeWidths = []runeRange{
+%s}
+`, properties.String(), widths.String())
+	formatted, err := format.Source([]byte(source))
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(formatted)
+}
+
+// writeRanges writes the ranges of runes with the same value, leaving out the
+// runes whose value is empty
+func writeRanges(w *strings.Builder, value func(rune) string) {
+	first, current := rune(-1), ""
+	flush := func(last rune) {
+		if current != "" {
+			fmt.Fprintf(w, "\t{0x%04X, 0x%04X, %s},\n", first, last, current)
+		}
+	}
+	for r := rune(utf8.RuneSelf); r <= unicode.MaxRune; r++ {
+		v := ""
+		if utf8.ValidRune(r) {
+			v = value(r)
+		}
+		if v != current {
+			flush(r - 1)
+			first, current = r, v
+		}
+	}
+	flush(unicode.MaxRune)
+}
+
+// single returns true if the string is a single grapheme cluster
+func single(s string) bool {
+	return uniseg.GraphemeClusterCount(s) == 1
+}
+
+// property returns the grapheme cluster break property of r, which is found
+// from how uniseg breaks r next to other runes
+func property(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115F || r >= 0xA960 && r <= 0xA97C:
+		return gbL
+	case r >= 0x1160 && r <= 0x11A7 || r >= 0xD7B0 && r <= 0xD7C6:
+		return gbV
+	case r >= 0x11A8 && r <= 0x11FF || r >= 0xD7CB && r <= 0xD7FB:
+		return gbT
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return gbLV
+		}
+		return gbLVT
+	case r >= 0x1F1E6 && r <= 0x1F1FF:
+		return gbRegionalIndicator
+	case r == 0x200D:
+		return gbZWJ
+	}
+	s := string(r)
+	const emoji = "\U0001F600"
+	switch {
+	case single("a" + s):
+		// An extend continues an emoji sequence, a spacing mark doesn't
+		if single(emoji + s + "\u200d" + emoji) {
+			return gbExtend
+		}
+		return gbSpacingMark
+	case single(s + "a"):
+		return gbPrepend
+	case !single(s + "\u0300"):
+		return gbControl
+	case single(emoji + "\u200d" + s):
+		return gbExtendedPictographic
+	}
+	return gbOther
+}
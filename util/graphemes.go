@@ -0,0 +1,219 @@
+package util
+
+import "unicode/utf8"
+
+// Grapheme cluster break properties of Unicode Standard Annex #29
+const (
+	gbOther = iota
+	gbCR
+	gbLF
+	gbControl
+	gbExtend
+	gbZWJ
+	gbRegionalIndicator
+	gbPrepend
+	gbSpacingMark
+	gbL
+	gbV
+	gbT
+	gbLV
+	gbLVT
+	gbExtendedPictographic
+)
+
+// Variation selectors that select the text and the emoji presentation
+const (
+	textPresentation  = 0xFE0E
+	emojiPresentation = 0xFE0F
+)
+
+// runeRange is a range of runes with the same value of a property
+type runeRange struct {
+	first rune
+	last  rune
+	value uint8
+}
+
+// lookup returns the value of the range that contains r, or missing
+func lookup(ranges []runeRange, r rune, missing uint8) uint8 {
+	low, high := 0, len(ranges)
+	for low < high {
+		mid := (low + high) / 2
+		if ranges[mid].last < r {
+			low = mid + 1
+		} else {
+			high = mid
+		}
+	}
+	if low < len(ranges) && ranges[low].first <= r {
+		return ranges[low].value
+	}
+	return missing
+}
+
+func graphemeProperty(r rune) uint8 {
+	if r < utf8.RuneSelf {
+		switch {
+		case r == '\r':
+			return gbCR
+		case r == '\n':
+			return gbLF
+		case r < ' ' || r == utf8.RuneSelf-1:
+			return gbControl
+		}
+		return gbOther
+	}
+	return lookup(graphemeProperties, r, gbOther)
+}
+
+// graphemeBoundary returns true if two runes with the properties prev and
+// next belong to different grapheme clusters. emojiZWJ is true if prev is a
+// zero width joiner after an emoji and its extends, and odd is true if prev
+// is preceded by an even number of regional indicators.
+func graphemeBoundary(prev uint8, next uint8, emojiZWJ bool, odd bool) bool {
+	switch {
+	case prev == gbCR && next == gbLF:
+		return false
+	case prev == gbCR, prev == gbLF, prev == gbControl,
+		next == gbCR, next == gbLF, next == gbControl:
+		return true
+	case prev == gbL && (next == gbL || next == gbV || next == gbLV || next == gbLVT),
+		(prev == gbLV || prev == gbV) && (next == gbV || next == gbT),
+		(prev == gbLVT || prev == gbT) && next == gbT:
+		return false
+	case next == gbExtend, next == gbZWJ, next == gbSpacingMark, prev == gbPrepend:
+		return false
+	case emojiZWJ && next == gbExtendedPictographic:
+		return false
+	case prev == gbRegionalIndicator && next == gbRegionalIndicator:
+		return !odd
+	}
+	return true
+}
+
+// GraphemeStarts returns the index of the first rune of each grapheme cluster
+// of the runes: the characters as users perceive them, like a letter with its
+// combining marks, a flag, or an emoji with its modifiers and the emojis that
+// it is joined with. The clusters are the extended grapheme clusters of
+// Unicode 15.0.
+func GraphemeStarts(runes []rune) []int {
+	starts := make([]int, 0, len(runes))
+	var prev uint8
+	// True if prev ends an emoji followed by extends
+	emoji := false
+	emojiZWJ := false
+	regionalIndicators := 0
+	for idx, r := range runes {
+		next := graphemeProperty(r)
+		if idx == 0 || graphemeBoundary(prev, next, emojiZWJ, regionalIndicators%2 == 1) {
+			starts = append(starts, idx)
+		}
+		emojiZWJ = next == gbZWJ && emoji
+		emoji = next == gbExtendedPictographic || emoji && next == gbExtend
+		if next == gbRegionalIndicator {
+			regionalIndicators++
+		} else {
+			regionalIndicators = 0
+		}
+		prev = next
+	}
+	return starts
+}
+
+// RuneWidth returns the number of columns that the rune takes on a terminal:
+// 0 for control characters and combining marks, 2 for East Asian wide and
+// full-width characters and emoji, and 1 for the others
+func RuneWidth(r rune) int {
+	if r < utf8.RuneSelf {
+		if r < ' ' || r == utf8.RuneSelf-1 {
+			return 0
+		}
+		return 1
+	}
+	return int(lookup(runeWidths, r, 1))
+}
+
+// GraphemeWidth returns the number of columns that the grapheme cluster takes
+// on a terminal. A variation selector makes an emoji 1 or 2 columns wide.
+func GraphemeWidth(cluster []rune) int {
+	if len(cluster) == 0 {
+		return 0
+	}
+	width := RuneWidth(cluster[0])
+	switch graphemeProperty(cluster[0]) {
+	case gbExtendedPictographic:
+		for _, r := range cluster[1:] {
+			if r == textPresentation {
+				width = 1
+			} else if r == emojiPresentation {
+				width = 2
+			}
+		}
+	case gbRegionalIndicator, gbL:
+		// A flag, or a Hangul syllable made of jamos, is as wide as its first rune
+	default:
+		for _, r := range cluster[1:] {
+			width += RuneWidth(r)
+		}
+	}
+	return width
+}
+
+// UTF16Offsets returns the offset in UTF-16 code units of each of the
+// positions in the runes, as JavaScript strings index them. A position at
+// the end of the runes is the length of the text.
+func UTF16Offsets(runes []rune, positions []int) []int {
+	return runeOffsets(runes, positions, func(r rune) int {
+		if r >= 0x10000 && r <= utf8.MaxRune {
+			return 2
+		}
+		return 1
+	})
+}
+
+// ByteOffsets returns the offset in bytes of each of the positions in the
+// runes when they are encoded as UTF-8. A position at the end of the runes is
+// the length of the text.
+func ByteOffsets(runes []rune, positions []int) []int {
+	return runeOffsets(runes, positions, func(r rune) int {
+		if length := utf8.RuneLen(r); length > 0 {
+			return length
+		}
+		// Invalid runes are encoded as utf8.RuneError
+		return utf8.RuneLen(utf8.RuneError)
+	})
+}
+
+// runeOffsets returns the offsets of the positions in the runes, given the
+// length of each rune
+func runeOffsets(runes []rune, positions []int, length func(rune) int) []int {
+	offsets := make([]int, len(runes)+1)
+	for idx, r := range runes {
+		offsets[idx+1] = offsets[idx] + length(r)
+	}
+	result := make([]int, len(positions))
+	for idx, pos := range positions {
+		result[idx] = offsets[Constrain(pos, 0, len(runes))]
+	}
+	return result
+}
+
+// GraphemeIndexes returns the index of the grapheme cluster (see
+// GraphemeStarts) that contains each of the positions in the runes
+func GraphemeIndexes(runes []rune, positions []int) []int {
+	clusters := make([]int, len(runes)+1)
+	cluster := -1
+	starts := GraphemeStarts(runes)
+	for idx := range runes {
+		if cluster+1 < len(starts) && starts[cluster+1] == idx {
+			cluster++
+		}
+		clusters[idx] = cluster
+	}
+	clusters[len(runes)] = len(starts)
+	result := make([]int, len(positions))
+	for idx, pos := range positions {
+		result[idx] = clusters[Constrain(pos, 0, len(runes))]
+	}
+	return result
+}
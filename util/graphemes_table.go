@@ -0,0 +1,1953 @@
+// Code generated by gen_graphemes.go; DO NOT EDIT.
+
+package util
+
+// graphemeProperties are the grapheme cluster break properties of the runes
+// that are not ASCII (see graphemeProperty for those), other than gbOther
+var graphemeProperties = []runeRange{
+	{0x0080, 0x009F, gbControl},
+	{0x00A9, 0x00A9, gbExtendedPictographic},
+	{0x00AD, 0x00AD, gbControl},
+	{0x00AE, 0x00AE, gbExtendedPictographic},
+	{0x0300, 0x036F, gbExtend},
+	{0x0483, 0x0489, gbExtend},
+	{0x0591, 0x05BD, gbExtend},
+	{0x05BF, 0x05BF, gbExtend},
+	{0x05C1, 0x05C2, gbExtend},
+	{0x05C4, 0x05C5, gbExtend},
+	{0x05C7, 0x05C7, gbExtend},
+	{0x0600, 0x0605, gbPrepend},
+	{0x0610, 0x061A, gbExtend},
+	{0x061C, 0x061C, gbControl},
+	{0x064B, 0x065F, gbExtend},
+	{0x0670, 0x0670, gbExtend},
+	{0x06D6, 0x06DC, gbExtend},
+	{0x06DD, 0x06DD, gbPrepend},
+	{0x06DF, 0x06E4, gbExtend},
+	{0x06E7, 0x06E8, gbExtend},
+	{0x06EA, 0x06ED, gbExtend},
+	{0x070F, 0x070F, gbPrepend},
+	{0x0711, 0x0711, gbExtend},
+	{0x0730, 0x074A, gbExtend},
+	{0x07A6, 0x07B0, gbExtend},
+	{0x07EB, 0x07F3, gbExtend},
+	{0x07FD, 0x07FD, gbExtend},
+	{0x0816, 0x0819, gbExtend},
+	{0x081B, 0x0823, gbExtend},
+	{0x0825, 0x0827, gbExtend},
+	{0x0829, 0x082D, gbExtend},
+	{0x0859, 0x085B, gbExtend},
+	{0x0890, 0x0891, gbPrepend},
+	{0x0898, 0x089F, gbExtend},
+	{0x08CA, 0x08E1, gbExtend},
+	{0x08E2, 0x08E2, gbPrepend},
+	{0x08E3, 0x0902, gbExtend},
+	{0x0903, 0x0903, gbSpacingMark},
+	{0x093A, 0x093A, gbExtend},
+	{0x093B, 0x093B, gbSpacingMark},
+	{0x093C, 0x093C, gbExtend},
+	{0x093E, 0x0940, gbSpacingMark},
+	{0x0941, 0x0948, gbExtend},
+	{0x0949, 0x094C, gbSpacingMark},
+	{0x094D, 0x094D, gbExtend},
+	{0x094E, 0x094F, gbSpacingMark},
+	{0x0951, 0x0957, gbExtend},
+	{0x0962, 0x0963, gbExtend},
+	{0x0981, 0x0981, gbExtend},
+	{0x0982, 0x0983, gbSpacingMark},
+	{0x09BC, 0x09BC, gbExtend},
+	{0x09BE, 0x09BE, gbExtend},
+	{0x09BF, 0x09C0, gbSpacingMark},
+	{0x09C1, 0x09C4, gbExtend},
+	{0x09C7, 0x09C8, gbSpacingMark},
+	{0x09CB, 0x09CC, gbSpacingMark},
+	{0x09CD, 0x09CD, gbExtend},
+	{0x09D7, 0x09D7, gbExtend},
+	{0x09E2, 0x09E3, gbExtend},
+	{0x09FE, 0x09FE, gbExtend},
+	{0x0A01, 0x0A02, gbExtend},
+	{0x0A03, 0x0A03, gbSpacingMark},
+	{0x0A3C, 0x0A3C, gbExtend},
+	{0x0A3E, 0x0A40, gbSpacingMark},
+	{0x0A41, 0x0A42, gbExtend},
+	{0x0A47, 0x0A48, gbExtend},
+	{0x0A4B, 0x0A4D, gbExtend},
+	{0x0A51, 0x0A51, gbExtend},
+	{0x0A70, 0x0A71, gbExtend},
+	{0x0A75, 0x0A75, gbExtend},
+	{0x0A81, 0x0A82, gbExtend},
+	{0x0A83, 0x0A83, gbSpacingMark},
+	{0x0ABC, 0x0ABC, gbExtend},
+	{0x0ABE, 0x0AC0, gbSpacingMark},
+	{0x0AC1, 0x0AC5, gbExtend},
+	{0x0AC7, 0x0AC8, gbExtend},
+	{0x0AC9, 0x0AC9, gbSpacingMark},
+	{0x0ACB, 0x0ACC, gbSpacingMark},
+	{0x0ACD, 0x0ACD, gbExtend},
+	{0x0AE2, 0x0AE3, gbExtend},
+	{0x0AFA, 0x0AFF, gbExtend},
+	{0x0B01, 0x0B01, gbExtend},
+	{0x0B02, 0x0B03, gbSpacingMark},
+	{0x0B3C, 0x0B3C, gbExtend},
+	{0x0B3E, 0x0B3F, gbExtend},
+	{0x0B40, 0x0B40, gbSpacingMark},
+	{0x0B41, 0x0B44, gbExtend},
+	{0x0B47, 0x0B48, gbSpacingMark},
+	{0x0B4B, 0x0B4C, gbSpacingMark},
+	{0x0B4D, 0x0B4D, gbExtend},
+	{0x0B55, 0x0B57, gbExtend},
+	{0x0B62, 0x0B63, gbExtend},
+	{0x0B82, 0x0B82, gbExtend},
+	{0x0BBE, 0x0BBE, gbExtend},
+	{0x0BBF, 0x0BBF, gbSpacingMark},
+	{0x0BC0, 0x0BC0, gbExtend},
+	{0x0BC1, 0x0BC2, gbSpacingMark},
+	{0x0BC6, 0x0BC8, gbSpacingMark},
+	{0x0BCA, 0x0BCC, gbSpacingMark},
+	{0x0BCD, 0x0BCD, gbExtend},
+	{0x0BD7, 0x0BD7, gbExtend},
+	{0x0C00, 0x0C00, gbExtend},
+	{0x0C01, 0x0C03, gbSpacingMark},
+	{0x0C04, 0x0C04, gbExtend},
+	{0x0C3C, 0x0C3C, gbExtend},
+	{0x0C3E, 0x0C40, gbExtend},
+	{0x0C41, 0x0C44, gbSpacingMark},
+	{0x0C46, 0x0C48, gbExtend},
+	{0x0C4A, 0x0C4D, gbExtend},
+	{0x0C55, 0x0C56, gbExtend},
+	{0x0C62, 0x0C63, gbExtend},
+	{0x0C81, 0x0C81, gbExtend},
+	{0x0C82, 0x0C83, gbSpacingMark},
+	{0x0CBC, 0x0CBC, gbExtend},
+	{0x0CBE, 0x0CBE, gbSpacingMark},
+	{0x0CBF, 0x0CBF, gbExtend},
+	{0x0CC0, 0x0CC1, gbSpacingMark},
+	{0x0CC2, 0x0CC2, gbExtend},
+	{0x0CC3, 0x0CC4, gbSpacingMark},
+	{0x0CC6, 0x0CC6, gbExtend},
+	{0x0CC7, 0x0CC8, gbSpacingMark},
+	{0x0CCA, 0x0CCB, gbSpacingMark},
+	{0x0CCC, 0x0CCD, gbExtend},
+	{0x0CD5, 0x0CD6, gbExtend},
+	{0x0CE2, 0x0CE3, gbExtend},
+	{0x0CF3, 0x0CF3, gbSpacingMark},
+	{0x0D00, 0x0D01, gbExtend},
+	{0x0D02, 0x0D03, gbSpacingMark},
+	{0x0D3B, 0x0D3C, gbExtend},
+	{0x0D3E, 0x0D3E, gbExtend},
+	{0x0D3F, 0x0D40, gbSpacingMark},
+	{0x0D41, 0x0D44, gbExtend},
+	{0x0D46, 0x0D48, gbSpacingMark},
+	{0x0D4A, 0x0D4C, gbSpacingMark},
+	{0x0D4D, 0x0D4D, gbExtend},
+	{0x0D4E, 0x0D4E, gbPrepend},
+	{0x0D57, 0x0D57, gbExtend},
+	{0x0D62, 0x0D63, gbExtend},
+	{0x0D81, 0x0D81, gbExtend},
+	{0x0D82, 0x0D83, gbSpacingMark},
+	{0x0DCA, 0x0DCA, gbExtend},
+	{0x0DCF, 0x0DCF, gbExtend},
+	{0x0DD0, 0x0DD1, gbSpacingMark},
+	{0x0DD2, 0x0DD4, gbExtend},
+	{0x0DD6, 0x0DD6, gbExtend},
+	{0x0DD8, 0x0DDE, gbSpacingMark},
+	{0x0DDF, 0x0DDF, gbExtend},
+	{0x0DF2, 0x0DF3, gbSpacingMark},
+	{0x0E31, 0x0E31, gbExtend},
+	{0x0E33, 0x0E33, gbSpacingMark},
+	{0x0E34, 0x0E3A, gbExtend},
+	{0x0E47, 0x0E4E, gbExtend},
+	{0x0EB1, 0x0EB1, gbExtend},
+	{0x0EB3, 0x0EB3, gbSpacingMark},
+	{0x0EB4, 0x0EBC, gbExtend},
+	{0x0EC8, 0x0ECE, gbExtend},
+	{0x0F18, 0x0F19, gbExtend},
+	{0x0F35, 0x0F35, gbExtend},
+	{0x0F37, 0x0F37, gbExtend},
+	{0x0F39, 0x0F39, gbExtend},
+	{0x0F3E, 0x0F3F, gbSpacingMark},
+	{0x0F71, 0x0F7E, gbExtend},
+	{0x0F7F, 0x0F7F, gbSpacingMark},
+	{0x0F80, 0x0F84, gbExtend},
+	{0x0F86, 0x0F87, gbExtend},
+	{0x0F8D, 0x0F97, gbExtend},
+	{0x0F99, 0x0FBC, gbExtend},
+	{0x0FC6, 0x0FC6, gbExtend},
+	{0x102D, 0x1030, gbExtend},
+	{0x1031, 0x1031, gbSpacingMark},
+	{0x1032, 0x1037, gbExtend},
+	{0x1039, 0x103A, gbExtend},
+	{0x103B, 0x103C, gbSpacingMark},
+	{0x103D, 0x103E, gbExtend},
+	{0x1056, 0x1057, gbSpacingMark},
+	{0x1058, 0x1059, gbExtend},
+	{0x105E, 0x1060, gbExtend},
+	{0x1071, 0x1074, gbExtend},
+	{0x1082, 0x1082, gbExtend},
+	{0x1084, 0x1084, gbSpacingMark},
+	{0x1085, 0x1086, gbExtend},
+	{0x108D, 0x108D, gbExtend},
+	{0x109D, 0x109D, gbExtend},
+	{0x1100, 0x115F, gbL},
+	{0x1160, 0x11A7, gbV},
+	{0x11A8, 0x11FF, gbT},
+	{0x135D, 0x135F, gbExtend},
+	{0x1712, 0x1714, gbExtend},
+	{0x1715, 0x1715, gbSpacingMark},
+	{0x1732, 0x1733, gbExtend},
+	{0x1734, 0x1734, gbSpacingMark},
+	{0x1752, 0x1753, gbExtend},
+	{0x1772, 0x1773, gbExtend},
+	{0x17B4, 0x17B5, gbExtend},
+	{0x17B6, 0x17B6, gbSpacingMark},
+	{0x17B7, 0x17BD, gbExtend},
+	{0x17BE, 0x17C5, gbSpacingMark},
+	{0x17C6, 0x17C6, gbExtend},
+	{0x17C7, 0x17C8, gbSpacingMark},
+	{0x17C9, 0x17D3, gbExtend},
+	{0x17DD, 0x17DD, gbExtend},
+	{0x180B, 0x180D, gbExtend},
+	{0x180E, 0x180E, gbControl},
+	{0x180F, 0x180F, gbExtend},
+	{0x1885, 0x1886, gbExtend},
+	{0x18A9, 0x18A9, gbExtend},
+	{0x1920, 0x1922, gbExtend},
+	{0x1923, 0x1926, gbSpacingMark},
+	{0x1927, 0x1928, gbExtend},
+	{0x1929, 0x192B, gbSpacingMark},
+	{0x1930, 0x1931, gbSpacingMark},
+	{0x1932, 0x1932, gbExtend},
+	{0x1933, 0x1938, gbSpacingMark},
+	{0x1939, 0x193B, gbExtend},
+	{0x1A17, 0x1A18, gbExtend},
+	{0x1A19, 0x1A1A, gbSpacingMark},
+	{0x1A1B, 0x1A1B, gbExtend},
+	{0x1A55, 0x1A55, gbSpacingMark},
+	{0x1A56, 0x1A56, gbExtend},
+	{0x1A57, 0x1A57, gbSpacingMark},
+	{0x1A58, 0x1A5E, gbExtend},
+	{0x1A60, 0x1A60, gbExtend},
+	{0x1A62, 0x1A62, gbExtend},
+	{0x1A65, 0x1A6C, gbExtend},
+	{0x1A6D, 0x1A72, gbSpacingMark},
+	{0x1A73, 0x1A7C, gbExtend},
+	{0x1A7F, 0x1A7F, gbExtend},
+	{0x1AB0, 0x1ACE, gbExtend},
+	{0x1B00, 0x1B03, gbExtend},
+	{0x1B04, 0x1B04, gbSpacingMark},
+	{0x1B34, 0x1B3A, gbExtend},
+	{0x1B3B, 0x1B3B, gbSpacingMark},
+	{0x1B3C, 0x1B3C, gbExtend},
+	{0x1B3D, 0x1B41, gbSpacingMark},
+	{0x1B42, 0x1B42, gbExtend},
+	{0x1B43, 0x1B44, gbSpacingMark},
+	{0x1B6B, 0x1B73, gbExtend},
+	{0x1B80, 0x1B81, gbExtend},
+	{0x1B82, 0x1B82, gbSpacingMark},
+	{0x1BA1, 0x1BA1, gbSpacingMark},
+	{0x1BA2, 0x1BA5, gbExtend},
+	{0x1BA6, 0x1BA7, gbSpacingMark},
+	{0x1BA8, 0x1BA9, gbExtend},
+	{0x1BAA, 0x1BAA, gbSpacingMark},
+	{0x1BAB, 0x1BAD, gbExtend},
+	{0x1BE6, 0x1BE6, gbExtend},
+	{0x1BE7, 0x1BE7, gbSpacingMark},
+	{0x1BE8, 0x1BE9, gbExtend},
+	{0x1BEA, 0x1BEC, gbSpacingMark},
+	{0x1BED, 0x1BED, gbExtend},
+	{0x1BEE, 0x1BEE, gbSpacingMark},
+	{0x1BEF, 0x1BF1, gbExtend},
+	{0x1BF2, 0x1BF3, gbSpacingMark},
+	{0x1C24, 0x1C2B, gbSpacingMark},
+	{0x1C2C, 0x1C33, gbExtend},
+	{0x1C34, 0x1C35, gbSpacingMark},
+	{0x1C36, 0x1C37, gbExtend},
+	{0x1CD0, 0x1CD2, gbExtend},
+	{0x1CD4, 0x1CE0, gbExtend},
+	{0x1CE1, 0x1CE1, gbSpacingMark},
+	{0x1CE2, 0x1CE8, gbExtend},
+	{0x1CED, 0x1CED, gbExtend},
+	{0x1CF4, 0x1CF4, gbExtend},
+	{0x1CF7, 0x1CF7, gbSpacingMark},
+	{0x1CF8, 0x1CF9, gbExtend},
+	{0x1DC0, 0x1DFF, gbExtend},
+	{0x200B, 0x200B, gbControl},
+	{0x200C, 0x200C, gbExtend},
+	{0x200D, 0x200D, gbZWJ},
+	{0x200E, 0x200F, gbControl},
+	{0x2028, 0x202E, gbControl},
+	{0x203C, 0x203C, gbExtendedPictographic},
+	{0x2049, 0x2049, gbExtendedPictographic},
+	{0x2060, 0x206F, gbControl},
+	{0x20D0, 0x20F0, gbExtend},
+	{0x2122, 0x2122, gbExtendedPictographic},
+	{0x2139, 0x2139, gbExtendedPictographic},
+	{0x2194, 0x2199, gbExtendedPictographic},
+	{0x21A9, 0x21AA, gbExtendedPictographic},
+	{0x231A, 0x231B, gbExtendedPictographic},
+	{0x2328, 0x2328, gbExtendedPictographic},
+	{0x2388, 0x2388, gbExtendedPictographic},
+	{0x23CF, 0x23CF, gbExtendedPictographic},
+	{0x23E9, 0x23F3, gbExtendedPictographic},
+	{0x23F8, 0x23FA, gbExtendedPictographic},
+	{0x24C2, 0x24C2, gbExtendedPictographic},
+	{0x25AA, 0x25AB, gbExtendedPictographic},
+	{0x25B6, 0x25B6, gbExtendedPictographic},
+	{0x25C0, 0x25C0, gbExtendedPictographic},
+	{0x25FB, 0x25FE, gbExtendedPictographic},
+	{0x2600, 0x2605, gbExtendedPictographic},
+	{0x2607, 0x2612, gbExtendedPictographic},
+	{0x2614, 0x2685, gbExtendedPictographic},
+	{0x2690, 0x2705, gbExtendedPictographic},
+	{0x2708, 0x2712, gbExtendedPictographic},
+	{0x2714, 0x2714, gbExtendedPictographic},
+	{0x2716, 0x2716, gbExtendedPictographic},
+	{0x271D, 0x271D, gbExtendedPictographic},
+	{0x2721, 0x2721, gbExtendedPictographic},
+	{0x2728, 0x2728, gbExtendedPictographic},
+	{0x2733, 0x2734, gbExtendedPictographic},
+	{0x2744, 0x2744, gbExtendedPictographic},
+	{0x2747, 0x2747, gbExtendedPictographic},
+	{0x274C, 0x274C, gbExtendedPictographic},
+	{0x274E, 0x274E, gbExtendedPictographic},
+	{0x2753, 0x2755, gbExtendedPictographic},
+	{0x2757, 0x2757, gbExtendedPictographic},
+	{0x2763, 0x2767, gbExtendedPictographic},
+	{0x2795, 0x2797, gbExtendedPictographic},
+	{0x27A1, 0x27A1, gbExtendedPictographic},
+	{0x27B0, 0x27B0, gbExtendedPictographic},
+	{0x27BF, 0x27BF, gbExtendedPictographic},
+	{0x2934, 0x2935, gbExtendedPictographic},
+	{0x2B05, 0x2B07, gbExtendedPictographic},
+	{0x2B1B, 0x2B1C, gbExtendedPictographic},
+	{0x2B50, 0x2B50, gbExtendedPictographic},
+	{0x2B55, 0x2B55, gbExtendedPictographic},
+	{0x2CEF, 0x2CF1, gbExtend},
+	{0x2D7F, 0x2D7F, gbExtend},
+	{0x2DE0, 0x2DFF, gbExtend},
+	{0x302A, 0x302F, gbExtend},
+	{0x3030, 0x3030, gbExtendedPictographic},
+	{0x303D, 0x303D, gbExtendedPictographic},
+	{0x3099, 0x309A, gbExtend},
+	{0x3297, 0x3297, gbExtendedPictographic},
+	{0x3299, 0x3299, gbExtendedPictographic},
+	{0xA66F, 0xA672, gbExtend},
+	{0xA674, 0xA67D, gbExtend},
+	{0xA69E, 0xA69F, gbExtend},
+	{0xA6F0, 0xA6F1, gbExtend},
+	{0xA802, 0xA802, gbExtend},
+	{0xA806, 0xA806, gbExtend},
+	{0xA80B, 0xA80B, gbExtend},
+	{0xA823, 0xA824, gbSpacingMark},
+	{0xA825, 0xA826, gbExtend},
+	{0xA827, 0xA827, gbSpacingMark},
+	{0xA82C, 0xA82C, gbExtend},
+	{0xA880, 0xA881, gbSpacingMark},
+	{0xA8B4, 0xA8C3, gbSpacingMark},
+	{0xA8C4, 0xA8C5, gbExtend},
+	{0xA8E0, 0xA8F1, gbExtend},
+	{0xA8FF, 0xA8FF, gbExtend},
+	{0xA926, 0xA92D, gbExtend},
+	{0xA947, 0xA951, gbExtend},
+	{0xA952, 0xA953, gbSpacingMark},
+	{0xA960, 0xA97C, gbL},
+	{0xA980, 0xA982, gbExtend},
+	{0xA983, 0xA983, gbSpacingMark},
+	{0xA9B3, 0xA9B3, gbExtend},
+	{0xA9B4, 0xA9B5, gbSpacingMark},
+	{0xA9B6, 0xA9B9, gbExtend},
+	{0xA9BA, 0xA9BB, gbSpacingMark},
+	{0xA9BC, 0xA9BD, gbExtend},
+	{0xA9BE, 0xA9C0, gbSpacingMark},
+	{0xA9E5, 0xA9E5, gbExtend},
+	{0xAA29, 0xAA2E, gbExtend},
+	{0xAA2F, 0xAA30, gbSpacingMark},
+	{0xAA31, 0xAA32, gbExtend},
+	{0xAA33, 0xAA34, gbSpacingMark},
+	{0xAA35, 0xAA36, gbExtend},
+	{0xAA43, 0xAA43, gbExtend},
+	{0xAA4C, 0xAA4C, gbExtend},
+	{0xAA4D, 0xAA4D, gbSpacingMark},
+	{0xAA7C, 0xAA7C, gbExtend},
+	{0xAAB0, 0xAAB0, gbExtend},
+	{0xAAB2, 0xAAB4, gbExtend},
+	{0xAAB7, 0xAAB8, gbExtend},
+	{0xAABE, 0xAABF, gbExtend},
+	{0xAAC1, 0xAAC1, gbExtend},
+	{0xAAEB, 0xAAEB, gbSpacingMark},
+	{0xAAEC, 0xAAED, gbExtend},
+	{0xAAEE, 0xAAEF, gbSpacingMark},
+	{0xAAF5, 0xAAF5, gbSpacingMark},
+	{0xAAF6, 0xAAF6, gbExtend},
+	{0xABE3, 0xABE4, gbSpacingMark},
+	{0xABE5, 0xABE5, gbExtend},
+	{0xABE6, 0xABE7, gbSpacingMark},
+	{0xABE8, 0xABE8, gbExtend},
+	{0xABE9, 0xABEA, gbSpacingMark},
+	{0xABEC, 0xABEC, gbSpacingMark},
+	{0xABED, 0xABED, gbExtend},
+	{0xAC00, 0xAC00, gbLV},
+	{0xAC01, 0xAC1B, gbLVT},
+	{0xAC1C, 0xAC1C, gbLV},
+	{0xAC1D, 0xAC37, gbLVT},
+	{0xAC38, 0xAC38, gbLV},
+	{0xAC39, 0xAC53, gbLVT},
+	{0xAC54, 0xAC54, gbLV},
+	{0xAC55, 0xAC6F, gbLVT},
+	{0xAC70, 0xAC70, gbLV},
+	{0xAC71, 0xAC8B, gbLVT},
+	{0xAC8C, 0xAC8C, gbLV},
+	{0xAC8D, 0xACA7, gbLVT},
+	{0xACA8, 0xACA8, gbLV},
+	{0xACA9, 0xACC3, gbLVT},
+	{0xACC4, 0xACC4, gbLV},
+	{0xACC5, 0xACDF, gbLVT},
+	{0xACE0, 0xACE0, gbLV},
+	{0xACE1, 0xACFB, gbLVT},
+	{0xACFC, 0xACFC, gbLV},
+	{0xACFD, 0xAD17, gbLVT},
+	{0xAD18, 0xAD18, gbLV},
+	{0xAD19, 0xAD33, gbLVT},
+	{0xAD34, 0xAD34, gbLV},
+	{0xAD35, 0xAD4F, gbLVT},
+	{0xAD50, 0xAD50, gbLV},
+	{0xAD51, 0xAD6B, gbLVT},
+	{0xAD6C, 0xAD6C, gbLV},
+	{0xAD6D, 0xAD87, gbLVT},
+	{0xAD88, 0xAD88, gbLV},
+	{0xAD89, 0xADA3, gbLVT},
+	{0xADA4, 0xADA4, gbLV},
+	{0xADA5, 0xADBF, gbLVT},
+	{0xADC0, 0xADC0, gbLV},
+	{0xADC1, 0xADDB, gbLVT},
+	{0xADDC, 0xADDC, gbLV},
+	{0xADDD, 0xADF7, gbLVT},
+	{0xADF8, 0xADF8, gbLV},
+	{0xADF9, 0xAE13, gbLVT},
+	{0xAE14, 0xAE14, gbLV},
+	{0xAE15, 0xAE2F, gbLVT},
+	{0xAE30, 0xAE30, gbLV},
+	{0xAE31, 0xAE4B, gbLVT},
+	{0xAE4C, 0xAE4C, gbLV},
+	{0xAE4D, 0xAE67, gbLVT},
+	{0xAE68, 0xAE68, gbLV},
+	{0xAE69, 0xAE83, gbLVT},
+	{0xAE84, 0xAE84, gbLV},
+	{0xAE85, 0xAE9F, gbLVT},
+	{0xAEA0, 0xAEA0, gbLV},
+	{0xAEA1, 0xAEBB, gbLVT},
+	{0xAEBC, 0xAEBC, gbLV},
+	{0xAEBD, 0xAED7, gbLVT},
+	{0xAED8, 0xAED8, gbLV},
+	{0xAED9, 0xAEF3, gbLVT},
+	{0xAEF4, 0xAEF4, gbLV},
+	{0xAEF5, 0xAF0F, gbLVT},
+	{0xAF10, 0xAF10, gbLV},
+	{0xAF11, 0xAF2B, gbLVT},
+	{0xAF2C, 0xAF2C, gbLV},
+	{0xAF2D, 0xAF47, gbLVT},
+	{0xAF48, 0xAF48, gbLV},
+	{0xAF49, 0xAF63, gbLVT},
+	{0xAF64, 0xAF64, gbLV},
+	{0xAF65, 0xAF7F, gbLVT},
+	{0xAF80, 0xAF80, gbLV},
+	{0xAF81, 0xAF9B, gbLVT},
+	{0xAF9C, 0xAF9C, gbLV},
+	{0xAF9D, 0xAFB7, gbLVT},
+	{0xAFB8, 0xAFB8, gbLV},
+	{0xAFB9, 0xAFD3, gbLVT},
+	{0xAFD4, 0xAFD4, gbLV},
+	{0xAFD5, 0xAFEF, gbLVT},
+	{0xAFF0, 0xAFF0, gbLV},
+	{0xAFF1, 0xB00B, gbLVT},
+	{0xB00C, 0xB00C, gbLV},
+	{0xB00D, 0xB027, gbLVT},
+	{0xB028, 0xB028, gbLV},
+	{0xB029, 0xB043, gbLVT},
+	{0xB044, 0xB044, gbLV},
+	{0xB045, 0xB05F, gbLVT},
+	{0xB060, 0xB060, gbLV},
+	{0xB061, 0xB07B, gbLVT},
+	{0xB07C, 0xB07C, gbLV},
+	{0xB07D, 0xB097, gbLVT},
+	{0xB098, 0xB098, gbLV},
+	{0xB099, 0xB0B3, gbLVT},
+	{0xB0B4, 0xB0B4, gbLV},
+	{0xB0B5, 0xB0CF, gbLVT},
+	{0xB0D0, 0xB0D0, gbLV},
+	{0xB0D1, 0xB0EB, gbLVT},
+	{0xB0EC, 0xB0EC, gbLV},
+	{0xB0ED, 0xB107, gbLVT},
+	{0xB108, 0xB108, gbLV},
+	{0xB109, 0xB123, gbLVT},
+	{0xB124, 0xB124, gbLV},
+	{0xB125, 0xB13F, gbLVT},
+	{0xB140, 0xB140, gbLV},
+	{0xB141, 0xB15B, gbLVT},
+	{0xB15C, 0xB15C, gbLV},
+	{0xB15D, 0xB177, gbLVT},
+	{0xB178, 0xB178, gbLV},
+	{0xB179, 0xB193, gbLVT},
+	{0xB194, 0xB194, gbLV},
+	{0xB195, 0xB1AF, gbLVT},
+	{0xB1B0, 0xB1B0, gbLV},
+	{0xB1B1, 0xB1CB, gbLVT},
+	{0xB1CC, 0xB1CC, gbLV},
+	{0xB1CD, 0xB1E7, gbLVT},
+	{0xB1E8, 0xB1E8, gbLV},
+	{0xB1E9, 0xB203, gbLVT},
+	{0xB204, 0xB204, gbLV},
+	{0xB205, 0xB21F, gbLVT},
+	{0xB220, 0xB220, gbLV},
+	{0xB221, 0xB23B, gbLVT},
+	{0xB23C, 0xB23C, gbLV},
+	{0xB23D, 0xB257, gbLVT},
+	{0xB258, 0xB258, gbLV},
+	{0xB259, 0xB273, gbLVT},
+	{0xB274, 0xB274, gbLV},
+	{0xB275, 0xB28F, gbLVT},
+	{0xB290, 0xB290, gbLV},
+	{0xB291, 0xB2AB, gbLVT},
+	{0xB2AC, 0xB2AC, gbLV},
+	{0xB2AD, 0xB2C7, gbLVT},
+	{0xB2C8, 0xB2C8, gbLV},
+	{0xB2C9, 0xB2E3, gbLVT},
+	{0xB2E4, 0xB2E4, gbLV},
+	{0xB2E5, 0xB2FF, gbLVT},
+	{0xB300, 0xB300, gbLV},
+	{0xB301, 0xB31B, gbLVT},
+	{0xB31C, 0xB31C, gbLV},
+	{0xB31D, 0xB337, gbLVT},
+	{0xB338, 0xB338, gbLV},
+	{0xB339, 0xB353, gbLVT},
+	{0xB354, 0xB354, gbLV},
+	{0xB355, 0xB36F, gbLVT},
+	{0xB370, 0xB370, gbLV},
+	{0xB371, 0xB38B, gbLVT},
+	{0xB38C, 0xB38C, gbLV},
+	{0xB38D, 0xB3A7, gbLVT},
+	{0xB3A8, 0xB3A8, gbLV},
+	{0xB3A9, 0xB3C3, gbLVT},
+	{0xB3C4, 0xB3C4, gbLV},
+	{0xB3C5, 0xB3DF, gbLVT},
+	{0xB3E0, 0xB3E0, gbLV},
+	{0xB3E1, 0xB3FB, gbLVT},
+	{0xB3FC, 0xB3FC, gbLV},
+	{0xB3FD, 0xB417, gbLVT},
+	{0xB418, 0xB418, gbLV},
+	{0xB419, 0xB433, gbLVT},
+	{0xB434, 0xB434, gbLV},
+	{0xB435, 0xB44F, gbLVT},
+	{0xB450, 0xB450, gbLV},
+	{0xB451, 0xB46B, gbLVT},
+	{0xB46C, 0xB46C, gbLV},
+	{0xB46D, 0xB487, gbLVT},
+	{0xB488, 0xB488, gbLV},
+	{0xB489, 0xB4A3, gbLVT},
+	{0xB4A4, 0xB4A4, gbLV},
+	{0xB4A5, 0xB4BF, gbLVT},
+	{0xB4C0, 0xB4C0, gbLV},
+	{0xB4C1, 0xB4DB, gbLVT},
+	{0xB4DC, 0xB4DC, gbLV},
+	{0xB4DD, 0xB4F7, gbLVT},
+	{0xB4F8, 0xB4F8, gbLV},
+	{0xB4F9, 0xB513, gbLVT},
+	{0xB514, 0xB514, gbLV},
+	{0xB515, 0xB52F, gbLVT},
+	{0xB530, 0xB530, gbLV},
+	{0xB531, 0xB54B, gbLVT},
+	{0xB54C, 0xB54C, gbLV},
+	{0xB54D, 0xB567, gbLVT},
+	{0xB568, 0xB568, gbLV},
+	{0xB569, 0xB583, gbLVT},
+	{0xB584, 0xB584, gbLV},
+	{0xB585, 0xB59F, gbLVT},
+	{0xB5A0, 0xB5A0, gbLV},
+	{0xB5A1, 0xB5BB, gbLVT},
+	{0xB5BC, 0xB5BC, gbLV},
+	{0xB5BD, 0xB5D7, gbLVT},
+	{0xB5D8, 0xB5D8, gbLV},
+	{0xB5D9, 0xB5F3, gbLVT},
+	{0xB5F4, 0xB5F4, gbLV},
+	{0xB5F5, 0xB60F, gbLVT},
+	{0xB610, 0xB610, gbLV},
+	{0xB611, 0xB62B, gbLVT},
+	{0xB62C, 0xB62C, gbLV},
+	{0xB62D, 0xB647, gbLVT},
+	{0xB648, 0xB648, gbLV},
+	{0xB649, 0xB663, gbLVT},
+	{0xB664, 0xB664, gbLV},
+	{0xB665, 0xB67F, gbLVT},
+	{0xB680, 0xB680, gbLV},
+	{0xB681, 0xB69B, gbLVT},
+	{0xB69C, 0xB69C, gbLV},
+	{0xB69D, 0xB6B7, gbLVT},
+	{0xB6B8, 0xB6B8, gbLV},
+	{0xB6B9, 0xB6D3, gbLVT},
+	{0xB6D4, 0xB6D4, gbLV},
+	{0xB6D5, 0xB6EF, gbLVT},
+	{0xB6F0, 0xB6F0, gbLV},
+	{0xB6F1, 0xB70B, gbLVT},
+	{0xB70C, 0xB70C, gbLV},
+	{0xB70D, 0xB727, gbLVT},
+	{0xB728, 0xB728, gbLV},
+	{0xB729, 0xB743, gbLVT},
+	{0xB744, 0xB744, gbLV},
+	{0xB745, 0xB75F, gbLVT},
+	{0xB760, 0xB760, gbLV},
+	{0xB761, 0xB77B, gbLVT},
+	{0xB77C, 0xB77C, gbLV},
+	{0xB77D, 0xB797, gbLVT},
+	{0xB798, 0xB798, gbLV},
+	{0xB799, 0xB7B3, gbLVT},
+	{0xB7B4, 0xB7B4, gbLV},
+	{0xB7B5, 0xB7CF, gbLVT},
+	{0xB7D0, 0xB7D0, gbLV},
+	{0xB7D1, 0xB7EB, gbLVT},
+	{0xB7EC, 0xB7EC, gbLV},
+	{0xB7ED, 0xB807, gbLVT},
+	{0xB808, 0xB808, gbLV},
+	{0xB809, 0xB823, gbLVT},
+	{0xB824, 0xB824, gbLV},
+	{0xB825, 0xB83F, gbLVT},
+	{0xB840, 0xB840, gbLV},
+	{0xB841, 0xB85B, gbLVT},
+	{0xB85C, 0xB85C, gbLV},
+	{0xB85D, 0xB877, gbLVT},
+	{0xB878, 0xB878, gbLV},
+	{0xB879, 0xB893, gbLVT},
+	{0xB894, 0xB894, gbLV},
+	{0xB895, 0xB8AF, gbLVT},
+	{0xB8B0, 0xB8B0, gbLV},
+	{0xB8B1, 0xB8CB, gbLVT},
+	{0xB8CC, 0xB8CC, gbLV},
+	{0xB8CD, 0xB8E7, gbLVT},
+	{0xB8E8, 0xB8E8, gbLV},
+	{0xB8E9, 0xB903, gbLVT},
+	{0xB904, 0xB904, gbLV},
+	{0xB905, 0xB91F, gbLVT},
+	{0xB920, 0xB920, gbLV},
+	{0xB921, 0xB93B, gbLVT},
+	{0xB93C, 0xB93C, gbLV},
+	{0xB93D, 0xB957, gbLVT},
+	{0xB958, 0xB958, gbLV},
+	{0xB959, 0xB973, gbLVT},
+	{0xB974, 0xB974, gbLV},
+	{0xB975, 0xB98F, gbLVT},
+	{0xB990, 0xB990, gbLV},
+	{0xB991, 0xB9AB, gbLVT},
+	{0xB9AC, 0xB9AC, gbLV},
+	{0xB9AD, 0xB9C7, gbLVT},
+	{0xB9C8, 0xB9C8, gbLV},
+	{0xB9C9, 0xB9E3, gbLVT},
+	{0xB9E4, 0xB9E4, gbLV},
+	{0xB9E5, 0xB9FF, gbLVT},
+	{0xBA00, 0xBA00, gbLV},
+	{0xBA01, 0xBA1B, gbLVT},
+	{0xBA1C, 0xBA1C, gbLV},
+	{0xBA1D, 0xBA37, gbLVT},
+	{0xBA38, 0xBA38, gbLV},
+	{0xBA39, 0xBA53, gbLVT},
+	{0xBA54, 0xBA54, gbLV},
+	{0xBA55, 0xBA6F, gbLVT},
+	{0xBA70, 0xBA70, gbLV},
+	{0xBA71, 0xBA8B, gbLVT},
+	{0xBA8C, 0xBA8C, gbLV},
+	{0xBA8D, 0xBAA7, gbLVT},
+	{0xBAA8, 0xBAA8, gbLV},
+	{0xBAA9, 0xBAC3, gbLVT},
+	{0xBAC4, 0xBAC4, gbLV},
+	{0xBAC5, 0xBADF, gbLVT},
+	{0xBAE0, 0xBAE0, gbLV},
+	{0xBAE1, 0xBAFB, gbLVT},
+	{0xBAFC, 0xBAFC, gbLV},
+	{0xBAFD, 0xBB17, gbLVT},
+	{0xBB18, 0xBB18, gbLV},
+	{0xBB19, 0xBB33, gbLVT},
+	{0xBB34, 0xBB34, gbLV},
+	{0xBB35, 0xBB4F, gbLVT},
+	{0xBB50, 0xBB50, gbLV},
+	{0xBB51, 0xBB6B, gbLVT},
+	{0xBB6C, 0xBB6C, gbLV},
+	{0xBB6D, 0xBB87, gbLVT},
+	{0xBB88, 0xBB88, gbLV},
+	{0xBB89, 0xBBA3, gbLVT},
+	{0xBBA4, 0xBBA4, gbLV},
+	{0xBBA5, 0xBBBF, gbLVT},
+	{0xBBC0, 0xBBC0, gbLV},
+	{0xBBC1, 0xBBDB, gbLVT},
+	{0xBBDC, 0xBBDC, gbLV},
+	{0xBBDD, 0xBBF7, gbLVT},
+	{0xBBF8, 0xBBF8, gbLV},
+	{0xBBF9, 0xBC13, gbLVT},
+	{0xBC14, 0xBC14, gbLV},
+	{0xBC15, 0xBC2F, gbLVT},
+	{0xBC30, 0xBC30, gbLV},
+	{0xBC31, 0xBC4B, gbLVT},
+	{0xBC4C, 0xBC4C, gbLV},
+	{0xBC4D, 0xBC67, gbLVT},
+	{0xBC68, 0xBC68, gbLV},
+	{0xBC69, 0xBC83, gbLVT},
+	{0xBC84, 0xBC84, gbLV},
+	{0xBC85, 0xBC9F, gbLVT},
+	{0xBCA0, 0xBCA0, gbLV},
+	{0xBCA1, 0xBCBB, gbLVT},
+	{0xBCBC, 0xBCBC, gbLV},
+	{0xBCBD, 0xBCD7, gbLVT},
+	{0xBCD8, 0xBCD8, gbLV},
+	{0xBCD9, 0xBCF3, gbLVT},
+	{0xBCF4, 0xBCF4, gbLV},
+	{0xBCF5, 0xBD0F, gbLVT},
+	{0xBD10, 0xBD10, gbLV},
+	{0xBD11, 0xBD2B, gbLVT},
+	{0xBD2C, 0xBD2C, gbLV},
+	{0xBD2D, 0xBD47, gbLVT},
+	{0xBD48, 0xBD48, gbLV},
+	{0xBD49, 0xBD63, gbLVT},
+	{0xBD64, 0xBD64, gbLV},
+	{0xBD65, 0xBD7F, gbLVT},
+	{0xBD80, 0xBD80, gbLV},
+	{0xBD81, 0xBD9B, gbLVT},
+	{0xBD9C, 0xBD9C, gbLV},
+	{0xBD9D, 0xBDB7, gbLVT},
+	{0xBDB8, 0xBDB8, gbLV},
+	{0xBDB9, 0xBDD3, gbLVT},
+	{0xBDD4, 0xBDD4, gbLV},
+	{0xBDD5, 0xBDEF, gbLVT},
+	{0xBDF0, 0xBDF0, gbLV},
+	{0xBDF1, 0xBE0B, gbLVT},
+	{0xBE0C, 0xBE0C, gbLV},
+	{0xBE0D, 0xBE27, gbLVT},
+	{0xBE28, 0xBE28, gbLV},
+	{0xBE29, 0xBE43, gbLVT},
+	{0xBE44, 0xBE44, gbLV},
+	{0xBE45, 0xBE5F, gbLVT},
+	{0xBE60, 0xBE60, gbLV},
+	{0xBE61, 0xBE7B, gbLVT},
+	{0xBE7C, 0xBE7C, gbLV},
+	{0xBE7D, 0xBE97, gbLVT},
+	{0xBE98, 0xBE98, gbLV},
+	{0xBE99, 0xBEB3, gbLVT},
+	{0xBEB4, 0xBEB4, gbLV},
+	{0xBEB5, 0xBECF, gbLVT},
+	{0xBED0, 0xBED0, gbLV},
+	{0xBED1, 0xBEEB, gbLVT},
+	{0xBEEC, 0xBEEC, gbLV},
+	{0xBEED, 0xBF07, gbLVT},
+	{0xBF08, 0xBF08, gbLV},
+	{0xBF09, 0xBF23, gbLVT},
+	{0xBF24, 0xBF24, gbLV},
+	{0xBF25, 0xBF3F, gbLVT},
+	{0xBF40, 0xBF40, gbLV},
+	{0xBF41, 0xBF5B, gbLVT},
+	{0xBF5C, 0xBF5C, gbLV},
+	{0xBF5D, 0xBF77, gbLVT},
+	{0xBF78, 0xBF78, gbLV},
+	{0xBF79, 0xBF93, gbLVT},
+	{0xBF94, 0xBF94, gbLV},
+	{0xBF95, 0xBFAF, gbLVT},
+	{0xBFB0, 0xBFB0, gbLV},
+	{0xBFB1, 0xBFCB, gbLVT},
+	{0xBFCC, 0xBFCC, gbLV},
+	{0xBFCD, 0xBFE7, gbLVT},
+	{0xBFE8, 0xBFE8, gbLV},
+	{0xBFE9, 0xC003, gbLVT},
+	{0xC004, 0xC004, gbLV},
+	{0xC005, 0xC01F, gbLVT},
+	{0xC020, 0xC020, gbLV},
+	{0xC021, 0xC03B, gbLVT},
+	{0xC03C, 0xC03C, gbLV},
+	{0xC03D, 0xC057, gbLVT},
+	{0xC058, 0xC058, gbLV},
+	{0xC059, 0xC073, gbLVT},
+	{0xC074, 0xC074, gbLV},
+	{0xC075, 0xC08F, gbLVT},
+	{0xC090, 0xC090, gbLV},
+	{0xC091, 0xC0AB, gbLVT},
+	{0xC0AC, 0xC0AC, gbLV},
+	{0xC0AD, 0xC0C7, gbLVT},
+	{0xC0C8, 0xC0C8, gbLV},
+	{0xC0C9, 0xC0E3, gbLVT},
+	{0xC0E4, 0xC0E4, gbLV},
+	{0xC0E5, 0xC0FF, gbLVT},
+	{0xC100, 0xC100, gbLV},
+	{0xC101, 0xC11B, gbLVT},
+	{0xC11C, 0xC11C, gbLV},
+	{0xC11D, 0xC137, gbLVT},
+	{0xC138, 0xC138, gbLV},
+	{0xC139, 0xC153, gbLVT},
+	{0xC154, 0xC154, gbLV},
+	{0xC155, 0xC16F, gbLVT},
+	{0xC170, 0xC170, gbLV},
+	{0xC171, 0xC18B, gbLVT},
+	{0xC18C, 0xC18C, gbLV},
+	{0xC18D, 0xC1A7, gbLVT},
+	{0xC1A8, 0xC1A8, gbLV},
+	{0xC1A9, 0xC1C3, gbLVT},
+	{0xC1C4, 0xC1C4, gbLV},
+	{0xC1C5, 0xC1DF, gbLVT},
+	{0xC1E0, 0xC1E0, gbLV},
+	{0xC1E1, 0xC1FB, gbLVT},
+	{0xC1FC, 0xC1FC, gbLV},
+	{0xC1FD, 0xC217, gbLVT},
+	{0xC218, 0xC218, gbLV},
+	{0xC219, 0xC233, gbLVT},
+	{0xC234, 0xC234, gbLV},
+	{0xC235, 0xC24F, gbLVT},
+	{0xC250, 0xC250, gbLV},
+	{0xC251, 0xC26B, gbLVT},
+	{0xC26C, 0xC26C, gbLV},
+	{0xC26D, 0xC287, gbLVT},
+	{0xC288, 0xC288, gbLV},
+	{0xC289, 0xC2A3, gbLVT},
+	{0xC2A4, 0xC2A4, gbLV},
+	{0xC2A5, 0xC2BF, gbLVT},
+	{0xC2C0, 0xC2C0, gbLV},
+	{0xC2C1, 0xC2DB, gbLVT},
+	{0xC2DC, 0xC2DC, gbLV},
+	{0xC2DD, 0xC2F7, gbLVT},
+	{0xC2F8, 0xC2F8, gbLV},
+	{0xC2F9, 0xC313, gbLVT},
+	{0xC314, 0xC314, gbLV},
+	{0xC315, 0xC32F, gbLVT},
+	{0xC330, 0xC330, gbLV},
+	{0xC331, 0xC34B, gbLVT},
+	{0xC34C, 0xC34C, gbLV},
+	{0xC34D, 0xC367, gbLVT},
+	{0xC368, 0xC368, gbLV},
+	{0xC369, 0xC383, gbLVT},
+	{0xC384, 0xC384, gbLV},
+	{0xC385, 0xC39F, gbLVT},
+	{0xC3A0, 0xC3A0, gbLV},
+	{0xC3A1, 0xC3BB, gbLVT},
+	{0xC3BC, 0xC3BC, gbLV},
+	{0xC3BD, 0xC3D7, gbLVT},
+	{0xC3D8, 0xC3D8, gbLV},
+	{0xC3D9, 0xC3F3, gbLVT},
+	{0xC3F4, 0xC3F4, gbLV},
+	{0xC3F5, 0xC40F, gbLVT},
+	{0xC410, 0xC410, gbLV},
+	{0xC411, 0xC42B, gbLVT},
+	{0xC42C, 0xC42C, gbLV},
+	{0xC42D, 0xC447, gbLVT},
+	{0xC448, 0xC448, gbLV},
+	{0xC449, 0xC463, gbLVT},
+	{0xC464, 0xC464, gbLV},
+	{0xC465, 0xC47F, gbLVT},
+	{0xC480, 0xC480, gbLV},
+	{0xC481, 0xC49B, gbLVT},
+	{0xC49C, 0xC49C, gbLV},
+	{0xC49D, 0xC4B7, gbLVT},
+	{0xC4B8, 0xC4B8, gbLV},
+	{0xC4B9, 0xC4D3, gbLVT},
+	{0xC4D4, 0xC4D4, gbLV},
+	{0xC4D5, 0xC4EF, gbLVT},
+	{0xC4F0, 0xC4F0, gbLV},
+	{0xC4F1, 0xC50B, gbLVT},
+	{0xC50C, 0xC50C, gbLV},
+	{0xC50D, 0xC527, gbLVT},
+	{0xC528, 0xC528, gbLV},
+	{0xC529, 0xC543, gbLVT},
+	{0xC544, 0xC544, gbLV},
+	{0xC545, 0xC55F, gbLVT},
+	{0xC560, 0xC560, gbLV},
+	{0xC561, 0xC57B, gbLVT},
+	{0xC57C, 0xC57C, gbLV},
+	{0xC57D, 0xC597, gbLVT},
+	{0xC598, 0xC598, gbLV},
+	{0xC599, 0xC5B3, gbLVT},
+	{0xC5B4, 0xC5B4, gbLV},
+	{0xC5B5, 0xC5CF, gbLVT},
+	{0xC5D0, 0xC5D0, gbLV},
+	{0xC5D1, 0xC5EB, gbLVT},
+	{0xC5EC, 0xC5EC, gbLV},
+	{0xC5ED, 0xC607, gbLVT},
+	{0xC608, 0xC608, gbLV},
+	{0xC609, 0xC623, gbLVT},
+	{0xC624, 0xC624, gbLV},
+	{0xC625, 0xC63F, gbLVT},
+	{0xC640, 0xC640, gbLV},
+	{0xC641, 0xC65B, gbLVT},
+	{0xC65C, 0xC65C, gbLV},
+	{0xC65D, 0xC677, gbLVT},
+	{0xC678, 0xC678, gbLV},
+	{0xC679, 0xC693, gbLVT},
+	{0xC694, 0xC694, gbLV},
+	{0xC695, 0xC6AF, gbLVT},
+	{0xC6B0, 0xC6B0, gbLV},
+	{0xC6B1, 0xC6CB, gbLVT},
+	{0xC6CC, 0xC6CC, gbLV},
+	{0xC6CD, 0xC6E7, gbLVT},
+	{0xC6E8, 0xC6E8, gbLV},
+	{0xC6E9, 0xC703, gbLVT},
+	{0xC704, 0xC704, gbLV},
+	{0xC705, 0xC71F, gbLVT},
+	{0xC720, 0xC720, gbLV},
+	{0xC721, 0xC73B, gbLVT},
+	{0xC73C, 0xC73C, gbLV},
+	{0xC73D, 0xC757, gbLVT},
+	{0xC758, 0xC758, gbLV},
+	{0xC759, 0xC773, gbLVT},
+	{0xC774, 0xC774, gbLV},
+	{0xC775, 0xC78F, gbLVT},
+	{0xC790, 0xC790, gbLV},
+	{0xC791, 0xC7AB, gbLVT},
+	{0xC7AC, 0xC7AC, gbLV},
+	{0xC7AD, 0xC7C7, gbLVT},
+	{0xC7C8, 0xC7C8, gbLV},
+	{0xC7C9, 0xC7E3, gbLVT},
+	{0xC7E4, 0xC7E4, gbLV},
+	{0xC7E5, 0xC7FF, gbLVT},
+	{0xC800, 0xC800, gbLV},
+	{0xC801, 0xC81B, gbLVT},
+	{0xC81C, 0xC81C, gbLV},
+	{0xC81D, 0xC837, gbLVT},
+	{0xC838, 0xC838, gbLV},
+	{0xC839, 0xC853, gbLVT},
+	{0xC854, 0xC854, gbLV},
+	{0xC855, 0xC86F, gbLVT},
+	{0xC870, 0xC870, gbLV},
+	{0xC871, 0xC88B, gbLVT},
+	{0xC88C, 0xC88C, gbLV},
+	{0xC88D, 0xC8A7, gbLVT},
+	{0xC8A8, 0xC8A8, gbLV},
+	{0xC8A9, 0xC8C3, gbLVT},
+	{0xC8C4, 0xC8C4, gbLV},
+	{0xC8C5, 0xC8DF, gbLVT},
+	{0xC8E0, 0xC8E0, gbLV},
+	{0xC8E1, 0xC8FB, gbLVT},
+	{0xC8FC, 0xC8FC, gbLV},
+	{0xC8FD, 0xC917, gbLVT},
+	{0xC918, 0xC918, gbLV},
+	{0xC919, 0xC933, gbLVT},
+	{0xC934, 0xC934, gbLV},
+	{0xC935, 0xC94F, gbLVT},
+	{0xC950, 0xC950, gbLV},
+	{0xC951, 0xC96B, gbLVT},
+	{0xC96C, 0xC96C, gbLV},
+	{0xC96D, 0xC987, gbLVT},
+	{0xC988, 0xC988, gbLV},
+	{0xC989, 0xC9A3, gbLVT},
+	{0xC9A4, 0xC9A4, gbLV},
+	{0xC9A5, 0xC9BF, gbLVT},
+	{0xC9C0, 0xC9C0, gbLV},
+	{0xC9C1, 0xC9DB, gbLVT},
+	{0xC9DC, 0xC9DC, gbLV},
+	{0xC9DD, 0xC9F7, gbLVT},
+	{0xC9F8, 0xC9F8, gbLV},
+	{0xC9F9, 0xCA13, gbLVT},
+	{0xCA14, 0xCA14, gbLV},
+	{0xCA15, 0xCA2F, gbLVT},
+	{0xCA30, 0xCA30, gbLV},
+	{0xCA31, 0xCA4B, gbLVT},
+	{0xCA4C, 0xCA4C, gbLV},
+	{0xCA4D, 0xCA67, gbLVT},
+	{0xCA68, 0xCA68, gbLV},
+	{0xCA69, 0xCA83, gbLVT},
+	{0xCA84, 0xCA84, gbLV},
+	{0xCA85, 0xCA9F, gbLVT},
+	{0xCAA0, 0xCAA0, gbLV},
+	{0xCAA1, 0xCABB, gbLVT},
+	{0xCABC, 0xCABC, gbLV},
+	{0xCABD, 0xCAD7, gbLVT},
+	{0xCAD8, 0xCAD8, gbLV},
+	{0xCAD9, 0xCAF3, gbLVT},
+	{0xCAF4, 0xCAF4, gbLV},
+	{0xCAF5, 0xCB0F, gbLVT},
+	{0xCB10, 0xCB10, gbLV},
+	{0xCB11, 0xCB2B, gbLVT},
+	{0xCB2C, 0xCB2C, gbLV},
+	{0xCB2D, 0xCB47, gbLVT},
+	{0xCB48, 0xCB48, gbLV},
+	{0xCB49, 0xCB63, gbLVT},
+	{0xCB64, 0xCB64, gbLV},
+	{0xCB65, 0xCB7F, gbLVT},
+	{0xCB80, 0xCB80, gbLV},
+	{0xCB81, 0xCB9B, gbLVT},
+	{0xCB9C, 0xCB9C, gbLV},
+	{0xCB9D, 0xCBB7, gbLVT},
+	{0xCBB8, 0xCBB8, gbLV},
+	{0xCBB9, 0xCBD3, gbLVT},
+	{0xCBD4, 0xCBD4, gbLV},
+	{0xCBD5, 0xCBEF, gbLVT},
+	{0xCBF0, 0xCBF0, gbLV},
+	{0xCBF1, 0xCC0B, gbLVT},
+	{0xCC0C, 0xCC0C, gbLV},
+	{0xCC0D, 0xCC27, gbLVT},
+	{0xCC28, 0xCC28, gbLV},
+	{0xCC29, 0xCC43, gbLVT},
+	{0xCC44, 0xCC44, gbLV},
+	{0xCC45, 0xCC5F, gbLVT},
+	{0xCC60, 0xCC60, gbLV},
+	{0xCC61, 0xCC7B, gbLVT},
+	{0xCC7C, 0xCC7C, gbLV},
+	{0xCC7D, 0xCC97, gbLVT},
+	{0xCC98, 0xCC98, gbLV},
+	{0xCC99, 0xCCB3, gbLVT},
+	{0xCCB4, 0xCCB4, gbLV},
+	{0xCCB5, 0xCCCF, gbLVT},
+	{0xCCD0, 0xCCD0, gbLV},
+	{0xCCD1, 0xCCEB, gbLVT},
+	{0xCCEC, 0xCCEC, gbLV},
+	{0xCCED, 0xCD07, gbLVT},
+	{0xCD08, 0xCD08, gbLV},
+	{0xCD09, 0xCD23, gbLVT},
+	{0xCD24, 0xCD24, gbLV},
+	{0xCD25, 0xCD3F, gbLVT},
+	{0xCD40, 0xCD40, gbLV},
+	{0xCD41, 0xCD5B, gbLVT},
+	{0xCD5C, 0xCD5C, gbLV},
+	{0xCD5D, 0xCD77, gbLVT},
+	{0xCD78, 0xCD78, gbLV},
+	{0xCD79, 0xCD93, gbLVT},
+	{0xCD94, 0xCD94, gbLV},
+	{0xCD95, 0xCDAF, gbLVT},
+	{0xCDB0, 0xCDB0, gbLV},
+	{0xCDB1, 0xCDCB, gbLVT},
+	{0xCDCC, 0xCDCC, gbLV},
+	{0xCDCD, 0xCDE7, gbLVT},
+	{0xCDE8, 0xCDE8, gbLV},
+	{0xCDE9, 0xCE03, gbLVT},
+	{0xCE04, 0xCE04, gbLV},
+	{0xCE05, 0xCE1F, gbLVT},
+	{0xCE20, 0xCE20, gbLV},
+	{0xCE21, 0xCE3B, gbLVT},
+	{0xCE3C, 0xCE3C, gbLV},
+	{0xCE3D, 0xCE57, gbLVT},
+	{0xCE58, 0xCE58, gbLV},
+	{0xCE59, 0xCE73, gbLVT},
+	{0xCE74, 0xCE74, gbLV},
+	{0xCE75, 0xCE8F, gbLVT},
+	{0xCE90, 0xCE90, gbLV},
+	{0xCE91, 0xCEAB, gbLVT},
+	{0xCEAC, 0xCEAC, gbLV},
+	{0xCEAD, 0xCEC7, gbLVT},
+	{0xCEC8, 0xCEC8, gbLV},
+	{0xCEC9, 0xCEE3, gbLVT},
+	{0xCEE4, 0xCEE4, gbLV},
+	{0xCEE5, 0xCEFF, gbLVT},
+	{0xCF00, 0xCF00, gbLV},
+	{0xCF01, 0xCF1B, gbLVT},
+	{0xCF1C, 0xCF1C, gbLV},
+	{0xCF1D, 0xCF37, gbLVT},
+	{0xCF38, 0xCF38, gbLV},
+	{0xCF39, 0xCF53, gbLVT},
+	{0xCF54, 0xCF54, gbLV},
+	{0xCF55, 0xCF6F, gbLVT},
+	{0xCF70, 0xCF70, gbLV},
+	{0xCF71, 0xCF8B, gbLVT},
+	{0xCF8C, 0xCF8C, gbLV},
+	{0xCF8D, 0xCFA7, gbLVT},
+	{0xCFA8, 0xCFA8, gbLV},
+	{0xCFA9, 0xCFC3, gbLVT},
+	{0xCFC4, 0xCFC4, gbLV},
+	{0xCFC5, 0xCFDF, gbLVT},
+	{0xCFE0, 0xCFE0, gbLV},
+	{0xCFE1, 0xCFFB, gbLVT},
+	{0xCFFC, 0xCFFC, gbLV},
+	{0xCFFD, 0xD017, gbLVT},
+	{0xD018, 0xD018, gbLV},
+	{0xD019, 0xD033, gbLVT},
+	{0xD034, 0xD034, gbLV},
+	{0xD035, 0xD04F, gbLVT},
+	{0xD050, 0xD050, gbLV},
+	{0xD051, 0xD06B, gbLVT},
+	{0xD06C, 0xD06C, gbLV},
+	{0xD06D, 0xD087, gbLVT},
+	{0xD088, 0xD088, gbLV},
+	{0xD089, 0xD0A3, gbLVT},
+	{0xD0A4, 0xD0A4, gbLV},
+	{0xD0A5, 0xD0BF, gbLVT},
+	{0xD0C0, 0xD0C0, gbLV},
+	{0xD0C1, 0xD0DB, gbLVT},
+	{0xD0DC, 0xD0DC, gbLV},
+	{0xD0DD, 0xD0F7, gbLVT},
+	{0xD0F8, 0xD0F8, gbLV},
+	{0xD0F9, 0xD113, gbLVT},
+	{0xD114, 0xD114, gbLV},
+	{0xD115, 0xD12F, gbLVT},
+	{0xD130, 0xD130, gbLV},
+	{0xD131, 0xD14B, gbLVT},
+	{0xD14C, 0xD14C, gbLV},
+	{0xD14D, 0xD167, gbLVT},
+	{0xD168, 0xD168, gbLV},
+	{0xD169, 0xD183, gbLVT},
+	{0xD184, 0xD184, gbLV},
+	{0xD185, 0xD19F, gbLVT},
+	{0xD1A0, 0xD1A0, gbLV},
+	{0xD1A1, 0xD1BB, gbLVT},
+	{0xD1BC, 0xD1BC, gbLV},
+	{0xD1BD, 0xD1D7, gbLVT},
+	{0xD1D8, 0xD1D8, gbLV},
+	{0xD1D9, 0xD1F3, gbLVT},
+	{0xD1F4, 0xD1F4, gbLV},
+	{0xD1F5, 0xD20F, gbLVT},
+	{0xD210, 0xD210, gbLV},
+	{0xD211, 0xD22B, gbLVT},
+	{0xD22C, 0xD22C, gbLV},
+	{0xD22D, 0xD247, gbLVT},
+	{0xD248, 0xD248, gbLV},
+	{0xD249, 0xD263, gbLVT},
+	{0xD264, 0xD264, gbLV},
+	{0xD265, 0xD27F, gbLVT},
+	{0xD280, 0xD280, gbLV},
+	{0xD281, 0xD29B, gbLVT},
+	{0xD29C, 0xD29C, gbLV},
+	{0xD29D, 0xD2B7, gbLVT},
+	{0xD2B8, 0xD2B8, gbLV},
+	{0xD2B9, 0xD2D3, gbLVT},
+	{0xD2D4, 0xD2D4, gbLV},
+	{0xD2D5, 0xD2EF, gbLVT},
+	{0xD2F0, 0xD2F0, gbLV},
+	{0xD2F1, 0xD30B, gbLVT},
+	{0xD30C, 0xD30C, gbLV},
+	{0xD30D, 0xD327, gbLVT},
+	{0xD328, 0xD328, gbLV},
+	{0xD329, 0xD343, gbLVT},
+	{0xD344, 0xD344, gbLV},
+	{0xD345, 0xD35F, gbLVT},
+	{0xD360, 0xD360, gbLV},
+	{0xD361, 0xD37B, gbLVT},
+	{0xD37C, 0xD37C, gbLV},
+	{0xD37D, 0xD397, gbLVT},
+	{0xD398, 0xD398, gbLV},
+	{0xD399, 0xD3B3, gbLVT},
+	{0xD3B4, 0xD3B4, gbLV},
+	{0xD3B5, 0xD3CF, gbLVT},
+	{0xD3D0, 0xD3D0, gbLV},
+	{0xD3D1, 0xD3EB, gbLVT},
+	{0xD3EC, 0xD3EC, gbLV},
+	{0xD3ED, 0xD407, gbLVT},
+	{0xD408, 0xD408, gbLV},
+	{0xD409, 0xD423, gbLVT},
+	{0xD424, 0xD424, gbLV},
+	{0xD425, 0xD43F, gbLVT},
+	{0xD440, 0xD440, gbLV},
+	{0xD441, 0xD45B, gbLVT},
+	{0xD45C, 0xD45C, gbLV},
+	{0xD45D, 0xD477, gbLVT},
+	{0xD478, 0xD478, gbLV},
+	{0xD479, 0xD493, gbLVT},
+	{0xD494, 0xD494, gbLV},
+	{0xD495, 0xD4AF, gbLVT},
+	{0xD4B0, 0xD4B0, gbLV},
+	{0xD4B1, 0xD4CB, gbLVT},
+	{0xD4CC, 0xD4CC, gbLV},
+	{0xD4CD, 0xD4E7, gbLVT},
+	{0xD4E8, 0xD4E8, gbLV},
+	{0xD4E9, 0xD503, gbLVT},
+	{0xD504, 0xD504, gbLV},
+	{0xD505, 0xD51F, gbLVT},
+	{0xD520, 0xD520, gbLV},
+	{0xD521, 0xD53B, gbLVT},
+	{0xD53C, 0xD53C, gbLV},
+	{0xD53D, 0xD557, gbLVT},
+	{0xD558, 0xD558, gbLV},
+	{0xD559, 0xD573, gbLVT},
+	{0xD574, 0xD574, gbLV},
+	{0xD575, 0xD58F, gbLVT},
+	{0xD590, 0xD590, gbLV},
+	{0xD591, 0xD5AB, gbLVT},
+	{0xD5AC, 0xD5AC, gbLV},
+	{0xD5AD, 0xD5C7, gbLVT},
+	{0xD5C8, 0xD5C8, gbLV},
+	{0xD5C9, 0xD5E3, gbLVT},
+	{0xD5E4, 0xD5E4, gbLV},
+	{0xD5E5, 0xD5FF, gbLVT},
+	{0xD600, 0xD600, gbLV},
+	{0xD601, 0xD61B, gbLVT},
+	{0xD61C, 0xD61C, gbLV},
+	{0xD61D, 0xD637, gbLVT},
+	{0xD638, 0xD638, gbLV},
+	{0xD639, 0xD653, gbLVT},
+	{0xD654, 0xD654, gbLV},
+	{0xD655, 0xD66F, gbLVT},
+	{0xD670, 0xD670, gbLV},
+	{0xD671, 0xD68B, gbLVT},
+	{0xD68C, 0xD68C, gbLV},
+	{0xD68D, 0xD6A7, gbLVT},
+	{0xD6A8, 0xD6A8, gbLV},
+	{0xD6A9, 0xD6C3, gbLVT},
+	{0xD6C4, 0xD6C4, gbLV},
+	{0xD6C5, 0xD6DF, gbLVT},
+	{0xD6E0, 0xD6E0, gbLV},
+	{0xD6E1, 0xD6FB, gbLVT},
+	{0xD6FC, 0xD6FC, gbLV},
+	{0xD6FD, 0xD717, gbLVT},
+	{0xD718, 0xD718, gbLV},
+	{0xD719, 0xD733, gbLVT},
+	{0xD734, 0xD734, gbLV},
+	{0xD735, 0xD74F, gbLVT},
+	{0xD750, 0xD750, gbLV},
+	{0xD751, 0xD76B, gbLVT},
+	{0xD76C, 0xD76C, gbLV},
+	{0xD76D, 0xD787, gbLVT},
+	{0xD788, 0xD788, gbLV},
+	{0xD789, 0xD7A3, gbLVT},
+	{0xD7B0, 0xD7C6, gbV},
+	{0xD7CB, 0xD7FB, gbT},
+	{0xFB1E, 0xFB1E, gbExtend},
+	{0xFE00, 0xFE0F, gbExtend},
+	{0xFE20, 0xFE2F, gbExtend},
+	{0xFEFF, 0xFEFF, gbControl},
+	{0xFF9E, 0xFF9F, gbExtend},
+	{0xFFF0, 0xFFFB, gbControl},
+	{0x101FD, 0x101FD, gbExtend},
+	{0x102E0, 0x102E0, gbExtend},
+	{0x10376, 0x1037A, gbExtend},
+	{0x10A01, 0x10A03, gbExtend},
+	{0x10A05, 0x10A06, gbExtend},
+	{0x10A0C, 0x10A0F, gbExtend},
+	{0x10A38, 0x10A3A, gbExtend},
+	{0x10A3F, 0x10A3F, gbExtend},
+	{0x10AE5, 0x10AE6, gbExtend},
+	{0x10D24, 0x10D27, gbExtend},
+	{0x10EAB, 0x10EAC, gbExtend},
+	{0x10EFD, 0x10EFF, gbExtend},
+	{0x10F46, 0x10F50, gbExtend},
+	{0x10F82, 0x10F85, gbExtend},
+	{0x11000, 0x11000, gbSpacingMark},
+	{0x11001, 0x11001, gbExtend},
+	{0x11002, 0x11002, gbSpacingMark},
+	{0x11038, 0x11046, gbExtend},
+	{0x11070, 0x11070, gbExtend},
+	{0x11073, 0x11074, gbExtend},
+	{0x1107F, 0x11081, gbExtend},
+	{0x11082, 0x11082, gbSpacingMark},
+	{0x110B0, 0x110B2, gbSpacingMark},
+	{0x110B3, 0x110B6, gbExtend},
+	{0x110B7, 0x110B8, gbSpacingMark},
+	{0x110B9, 0x110BA, gbExtend},
+	{0x110BD, 0x110BD, gbPrepend},
+	{0x110C2, 0x110C2, gbExtend},
+	{0x110CD, 0x110CD, gbPrepend},
+	{0x11100, 0x11102, gbExtend},
+	{0x11127, 0x1112B, gbExtend},
+	{0x1112C, 0x1112C, gbSpacingMark},
+	{0x1112D, 0x11134, gbExtend},
+	{0x11145, 0x11146, gbSpacingMark},
+	{0x11173, 0x11173, gbExtend},
+	{0x11180, 0x11181, gbExtend},
+	{0x11182, 0x11182, gbSpacingMark},
+	{0x111B3, 0x111B5, gbSpacingMark},
+	{0x111B6, 0x111BE, gbExtend},
+	{0x111BF, 0x111C0, gbSpacingMark},
+	{0x111C2, 0x111C3, gbPrepend},
+	{0x111C9, 0x111CC, gbExtend},
+	{0x111CE, 0x111CE, gbSpacingMark},
+	{0x111CF, 0x111CF, gbExtend},
+	{0x1122C, 0x1122E, gbSpacingMark},
+	{0x1122F, 0x11231, gbExtend},
+	{0x11232, 0x11233, gbSpacingMark},
+	{0x11234, 0x11234, gbExtend},
+	{0x11235, 0x11235, gbSpacingMark},
+	{0x11236, 0x11237, gbExtend},
+	{0x1123E, 0x1123E, gbExtend},
+	{0x11241, 0x11241, gbExtend},
+	{0x112DF, 0x112DF, gbExtend},
+	{0x112E0, 0x112E2, gbSpacingMark},
+	{0x112E3, 0x112EA, gbExtend},
+	{0x11300, 0x11301, gbExtend},
+	{0x11302, 0x11303, gbSpacingMark},
+	{0x1133B, 0x1133C, gbExtend},
+	{0x1133E, 0x1133E, gbExtend},
+	{0x1133F, 0x1133F, gbSpacingMark},
+	{0x11340, 0x11340, gbExtend},
+	{0x11341, 0x11344, gbSpacingMark},
+	{0x11347, 0x11348, gbSpacingMark},
+	{0x1134B, 0x1134D, gbSpacingMark},
+	{0x11357, 0x11357, gbExtend},
+	{0x11362, 0x11363, gbSpacingMark},
+	{0x11366, 0x1136C, gbExtend},
+	{0x11370, 0x11374, gbExtend},
+	{0x11435, 0x11437, gbSpacingMark},
+	{0x11438, 0x1143F, gbExtend},
+	{0x11440, 0x11441, gbSpacingMark},
+	{0x11442, 0x11444, gbExtend},
+	{0x11445, 0x11445, gbSpacingMark},
+	{0x11446, 0x11446, gbExtend},
+	{0x1145E, 0x1145E, gbExtend},
+	{0x114B0, 0x114B0, gbExtend},
+	{0x114B1, 0x114B2, gbSpacingMark},
+	{0x114B3, 0x114B8, gbExtend},
+	{0x114B9, 0x114B9, gbSpacingMark},
+	{0x114BA, 0x114BA, gbExtend},
+	{0x114BB, 0x114BC, gbSpacingMark},
+	{0x114BD, 0x114BD, gbExtend},
+	{0x114BE, 0x114BE, gbSpacingMark},
+	{0x114BF, 0x114C0, gbExtend},
+	{0x114C1, 0x114C1, gbSpacingMark},
+	{0x114C2, 0x114C3, gbExtend},
+	{0x115AF, 0x115AF, gbExtend},
+	{0x115B0, 0x115B1, gbSpacingMark},
+	{0x115B2, 0x115B5, gbExtend},
+	{0x115B8, 0x115BB, gbSpacingMark},
+	{0x115BC, 0x115BD, gbExtend},
+	{0x115BE, 0x115BE, gbSpacingMark},
+	{0x115BF, 0x115C0, gbExtend},
+	{0x115DC, 0x115DD, gbExtend},
+	{0x11630, 0x11632, gbSpacingMark},
+	{0x11633, 0x1163A, gbExtend},
+	{0x1163B, 0x1163C, gbSpacingMark},
+	{0x1163D, 0x1163D, gbExtend},
+	{0x1163E, 0x1163E, gbSpacingMark},
+	{0x1163F, 0x11640, gbExtend},
+	{0x116AB, 0x116AB, gbExtend},
+	{0x116AC, 0x116AC, gbSpacingMark},
+	{0x116AD, 0x116AD, gbExtend},
+	{0x116AE, 0x116AF, gbSpacingMark},
+	{0x116B0, 0x116B5, gbExtend},
+	{0x116B6, 0x116B6, gbSpacingMark},
+	{0x116B7, 0x116B7, gbExtend},
+	{0x1171D, 0x1171F, gbExtend},
+	{0x11722, 0x11725, gbExtend},
+	{0x11726, 0x11726, gbSpacingMark},
+	{0x11727, 0x1172B, gbExtend},
+	{0x1182C, 0x1182E, gbSpacingMark},
+	{0x1182F, 0x11837, gbExtend},
+	{0x11838, 0x11838, gbSpacingMark},
+	{0x11839, 0x1183A, gbExtend},
+	{0x11930, 0x11930, gbExtend},
+	{0x11931, 0x11935, gbSpacingMark},
+	{0x11937, 0x11938, gbSpacingMark},
+	{0x1193B, 0x1193C, gbExtend},
+	{0x1193D, 0x1193D, gbSpacingMark},
+	{0x1193E, 0x1193E, gbExtend},
+	{0x1193F, 0x1193F, gbPrepend},
+	{0x11940, 0x11940, gbSpacingMark},
+	{0x11941, 0x11941, gbPrepend},
+	{0x11942, 0x11942, gbSpacingMark},
+	{0x11943, 0x11943, gbExtend},
+	{0x119D1, 0x119D3, gbSpacingMark},
+	{0x119D4, 0x119D7, gbExtend},
+	{0x119DA, 0x119DB, gbExtend},
+	{0x119DC, 0x119DF, gbSpacingMark},
+	{0x119E0, 0x119E0, gbExtend},
+	{0x119E4, 0x119E4, gbSpacingMark},
+	{0x11A01, 0x11A0A, gbExtend},
+	{0x11A33, 0x11A38, gbExtend},
+	{0x11A39, 0x11A39, gbSpacingMark},
+	{0x11A3A, 0x11A3A, gbPrepend},
+	{0x11A3B, 0x11A3E, gbExtend},
+	{0x11A47, 0x11A47, gbExtend},
+	{0x11A51, 0x11A56, gbExtend},
+	{0x11A57, 0x11A58, gbSpacingMark},
+	{0x11A59, 0x11A5B, gbExtend},
+	{0x11A84, 0x11A89, gbPrepend},
+	{0x11A8A, 0x11A96, gbExtend},
+	{0x11A97, 0x11A97, gbSpacingMark},
+	{0x11A98, 0x11A99, gbExtend},
+	{0x11C2F, 0x11C2F, gbSpacingMark},
+	{0x11C30, 0x11C36, gbExtend},
+	{0x11C38, 0x11C3D, gbExtend},
+	{0x11C3E, 0x11C3E, gbSpacingMark},
+	{0x11C3F, 0x11C3F, gbExtend},
+	{0x11C92, 0x11CA7, gbExtend},
+	{0x11CA9, 0x11CA9, gbSpacingMark},
+	{0x11CAA, 0x11CB0, gbExtend},
+	{0x11CB1, 0x11CB1, gbSpacingMark},
+	{0x11CB2, 0x11CB3, gbExtend},
+	{0x11CB4, 0x11CB4, gbSpacingMark},
+	{0x11CB5, 0x11CB6, gbExtend},
+	{0x11D31, 0x11D36, gbExtend},
+	{0x11D3A, 0x11D3A, gbExtend},
+	{0x11D3C, 0x11D3D, gbExtend},
+	{0x11D3F, 0x11D45, gbExtend},
+	{0x11D46, 0x11D46, gbPrepend},
+	{0x11D47, 0x11D47, gbExtend},
+	{0x11D8A, 0x11D8E, gbSpacingMark},
+	{0x11D90, 0x11D91, gbExtend},
+	{0x11D93, 0x11D94, gbSpacingMark},
+	{0x11D95, 0x11D95, gbExtend},
+	{0x11D96, 0x11D96, gbSpacingMark},
+	{0x11D97, 0x11D97, gbExtend},
+	{0x11EF3, 0x11EF4, gbExtend},
+	{0x11EF5, 0x11EF6, gbSpacingMark},
+	{0x11F00, 0x11F01, gbExtend},
+	{0x11F02, 0x11F02, gbPrepend},
+	{0x11F03, 0x11F03, gbSpacingMark},
+	{0x11F34, 0x11F35, gbSpacingMark},
+	{0x11F36, 0x11F3A, gbExtend},
+	{0x11F3E, 0x11F3F, gbSpacingMark},
+	{0x11F40, 0x11F40, gbExtend},
+	{0x11F41, 0x11F41, gbSpacingMark},
+	{0x11F42, 0x11F42, gbExtend},
+	{0x13430, 0x1343F, gbControl},
+	{0x13440, 0x13440, gbExtend},
+	{0x13447, 0x13455, gbExtend},
+	{0x16AF0, 0x16AF4, gbExtend},
+	{0x16B30, 0x16B36, gbExtend},
+	{0x16F4F, 0x16F4F, gbExtend},
+	{0x16F51, 0x16F87, gbSpacingMark},
+	{0x16F8F, 0x16F92, gbExtend},
+	{0x16FE4, 0x16FE4, gbExtend},
+	{0x16FF0, 0x16FF1, gbSpacingMark},
+	{0x1BC9D, 0x1BC9E, gbExtend},
+	{0x1BCA0, 0x1BCA3, gbControl},
+	{0x1CF00, 0x1CF2D, gbExtend},
+	{0x1CF30, 0x1CF46, gbExtend},
+	{0x1D165, 0x1D165, gbExtend},
+	{0x1D166, 0x1D166, gbSpacingMark},
+	{0x1D167, 0x1D169, gbExtend},
+	{0x1D16D, 0x1D16D, gbSpacingMark},
+	{0x1D16E, 0x1D172, gbExtend},
+	{0x1D173, 0x1D17A, gbControl},
+	{0x1D17B, 0x1D182, gbExtend},
+	{0x1D185, 0x1D18B, gbExtend},
+	{0x1D1AA, 0x1D1AD, gbExtend},
+	{0x1D242, 0x1D244, gbExtend},
+	{0x1DA00, 0x1DA36, gbExtend},
+	{0x1DA3B, 0x1DA6C, gbExtend},
+	{0x1DA75, 0x1DA75, gbExtend},
+	{0x1DA84, 0x1DA84, gbExtend},
+	{0x1DA9B, 0x1DA9F, gbExtend},
+	{0x1DAA1, 0x1DAAF, gbExtend},
+	{0x1E000, 0x1E006, gbExtend},
+	{0x1E008, 0x1E018, gbExtend},
+	{0x1E01B, 0x1E021, gbExtend},
+	{0x1E023, 0x1E024, gbExtend},
+	{0x1E026, 0x1E02A, gbExtend},
+	{0x1E08F, 0x1E08F, gbExtend},
+	{0x1E130, 0x1E136, gbExtend},
+	{0x1E2AE, 0x1E2AE, gbExtend},
+	{0x1E2EC, 0x1E2EF, gbExtend},
+	{0x1E4EC, 0x1E4EF, gbExtend},
+	{0x1E8D0, 0x1E8D6, gbExtend},
+	{0x1E944, 0x1E94A, gbExtend},
+	{0x1F000, 0x1F0FF, gbExtendedPictographic},
+	{0x1F10D, 0x1F10F, gbExtendedPictographic},
+	{0x1F12F, 0x1F12F, gbExtendedPictographic},
+	{0x1F16C, 0x1F171, gbExtendedPictographic},
+	{0x1F17E, 0x1F17F, gbExtendedPictographic},
+	{0x1F18E, 0x1F18E, gbExtendedPictographic},
+	{0x1F191, 0x1F19A, gbExtendedPictographic},
+	{0x1F1AD, 0x1F1E5, gbExtendedPictographic},
+	{0x1F1E6, 0x1F1FF, gbRegionalIndicator},
+	{0x1F201, 0x1F20F, gbExtendedPictographic},
+	{0x1F21A, 0x1F21A, gbExtendedPictographic},
+	{0x1F22F, 0x1F22F, gbExtendedPictographic},
+	{0x1F232, 0x1F23A, gbExtendedPictographic},
+	{0x1F23C, 0x1F23F, gbExtendedPictographic},
+	{0x1F249, 0x1F3FA, gbExtendedPictographic},
+	{0x1F3FB, 0x1F3FF, gbExtend},
+	{0x1F400, 0x1F53D, gbExtendedPictographic},
+	{0x1F546, 0x1F64F, gbExtendedPictographic},
+	{0x1F680, 0x1F6FF, gbExtendedPictographic},
+	{0x1F774, 0x1F77F, gbExtendedPictographic},
+	{0x1F7D5, 0x1F7FF, gbExtendedPictographic},
+	{0x1F80C, 0x1F80F, gbExtendedPictographic},
+	{0x1F848, 0x1F84F, gbExtendedPictographic},
+	{0x1F85A, 0x1F85F, gbExtendedPictographic},
+	{0x1F888, 0x1F88F, gbExtendedPictographic},
+	{0x1F8AE, 0x1F8FF, gbExtendedPictographic},
+	{0x1F90C, 0x1F93A, gbExtendedPictographic},
+	{0x1F93C, 0x1F945, gbExtendedPictographic},
+	{0x1F947, 0x1FAFF, gbExtendedPictographic},
+	{0x1FC00, 0x1FFFD, gbExtendedPictographic},
+	{0xE0000, 0xE001F, gbControl},
+	{0xE0020, 0xE007F, gbExtend},
+	{0xE0080, 0xE00FF, gbControl},
+	{0xE0100, 0xE01EF, gbExtend},
+	{0xE01F0, 0xE0FFF, gbControl},
+}
+
+// runeWidths are the widths of the runes that are not ASCII, other than 1
+var runeWidths = []runeRange{
+	{0x0080, 0x009F, 0},
+	{0x00AD, 0x00AD, 0},
+	{0x0300, 0x036F, 0},
+	{0x0483, 0x0489, 0},
+	{0x0591, 0x05BD, 0},
+	{0x05BF, 0x05BF, 0},
+	{0x05C1, 0x05C2, 0},
+	{0x05C4, 0x05C5, 0},
+	{0x05C7, 0x05C7, 0},
+	{0x0610, 0x061A, 0},
+	{0x061C, 0x061C, 0},
+	{0x064B, 0x065F, 0},
+	{0x0670, 0x0670, 0},
+	{0x06D6, 0x06DC, 0},
+	{0x06DF, 0x06E4, 0},
+	{0x06E7, 0x06E8, 0},
+	{0x06EA, 0x06ED, 0},
+	{0x0711, 0x0711, 0},
+	{0x0730, 0x074A, 0},
+	{0x07A6, 0x07B0, 0},
+	{0x07EB, 0x07F3, 0},
+	{0x07FD, 0x07FD, 0},
+	{0x0816, 0x0819, 0},
+	{0x081B, 0x0823, 0},
+	{0x0825, 0x0827, 0},
+	{0x0829, 0x082D, 0},
+	{0x0859, 0x085B, 0},
+	{0x0898, 0x089F, 0},
+	{0x08CA, 0x08E1, 0},
+	{0x08E3, 0x0902, 0},
+	{0x093A, 0x093A, 0},
+	{0x093C, 0x093C, 0},
+	{0x0941, 0x0948, 0},
+	{0x094D, 0x094D, 0},
+	{0x0951, 0x0957, 0},
+	{0x0962, 0x0963, 0},
+	{0x0981, 0x0981, 0},
+	{0x09BC, 0x09BC, 0},
+	{0x09BE, 0x09BE, 0},
+	{0x09C1, 0x09C4, 0},
+	{0x09CD, 0x09CD, 0},
+	{0x09D7, 0x09D7, 0},
+	{0x09E2, 0x09E3, 0},
+	{0x09FE, 0x09FE, 0},
+	{0x0A01, 0x0A02, 0},
+	{0x0A3C, 0x0A3C, 0},
+	{0x0A41, 0x0A42, 0},
+	{0x0A47, 0x0A48, 0},
+	{0x0A4B, 0x0A4D, 0},
+	{0x0A51, 0x0A51, 0},
+	{0x0A70, 0x0A71, 0},
+	{0x0A75, 0x0A75, 0},
+	{0x0A81, 0x0A82, 0},
+	{0x0ABC, 0x0ABC, 0},
+	{0x0AC1, 0x0AC5, 0},
+	{0x0AC7, 0x0AC8, 0},
+	{0x0ACD, 0x0ACD, 0},
+	{0x0AE2, 0x0AE3, 0},
+	{0x0AFA, 0x0AFF, 0},
+	{0x0B01, 0x0B01, 0},
+	{0x0B3C, 0x0B3C, 0},
+	{0x0B3E, 0x0B3F, 0},
+	{0x0B41, 0x0B44, 0},
+	{0x0B4D, 0x0B4D, 0},
+	{0x0B55, 0x0B57, 0},
+	{0x0B62, 0x0B63, 0},
+	{0x0B82, 0x0B82, 0},
+	{0x0BBE, 0x0BBE, 0},
+	{0x0BC0, 0x0BC0, 0},
+	{0x0BCD, 0x0BCD, 0},
+	{0x0BD7, 0x0BD7, 0},
+	{0x0C00, 0x0C00, 0},
+	{0x0C04, 0x0C04, 0},
+	{0x0C3C, 0x0C3C, 0},
+	{0x0C3E, 0x0C40, 0},
+	{0x0C46, 0x0C48, 0},
+	{0x0C4A, 0x0C4D, 0},
+	{0x0C55, 0x0C56, 0},
+	{0x0C62, 0x0C63, 0},
+	{0x0C81, 0x0C81, 0},
+	{0x0CBC, 0x0CBC, 0},
+	{0x0CBF, 0x0CBF, 0},
+	{0x0CC2, 0x0CC2, 0},
+	{0x0CC6, 0x0CC6, 0},
+	{0x0CCC, 0x0CCD, 0},
+	{0x0CD5, 0x0CD6, 0},
+	{0x0CE2, 0x0CE3, 0},
+	{0x0D00, 0x0D01, 0},
+	{0x0D3B, 0x0D3C, 0},
+	{0x0D3E, 0x0D3E, 0},
+	{0x0D41, 0x0D44, 0},
+	{0x0D4D, 0x0D4D, 0},
+	{0x0D57, 0x0D57, 0},
+	{0x0D62, 0x0D63, 0},
+	{0x0D81, 0x0D81, 0},
+	{0x0DCA, 0x0DCA, 0},
+	{0x0DCF, 0x0DCF, 0},
+	{0x0DD2, 0x0DD4, 0},
+	{0x0DD6, 0x0DD6, 0},
+	{0x0DDF, 0x0DDF, 0},
+	{0x0E31, 0x0E31, 0},
+	{0x0E34, 0x0E3A, 0},
+	{0x0E47, 0x0E4E, 0},
+	{0x0EB1, 0x0EB1, 0},
+	{0x0EB4, 0x0EBC, 0},
+	{0x0EC8, 0x0ECE, 0},
+	{0x0F18, 0x0F19, 0},
+	{0x0F35, 0x0F35, 0},
+	{0x0F37, 0x0F37, 0},
+	{0x0F39, 0x0F39, 0},
+	{0x0F71, 0x0F7E, 0},
+	{0x0F80, 0x0F84, 0},
+	{0x0F86, 0x0F87, 0},
+	{0x0F8D, 0x0F97, 0},
+	{0x0F99, 0x0FBC, 0},
+	{0x0FC6, 0x0FC6, 0},
+	{0x102D, 0x1030, 0},
+	{0x1032, 0x1037, 0},
+	{0x1039, 0x103A, 0},
+	{0x103D, 0x103E, 0},
+	{0x1058, 0x1059, 0},
+	{0x105E, 0x1060, 0},
+	{0x1071, 0x1074, 0},
+	{0x1082, 0x1082, 0},
+	{0x1085, 0x1086, 0},
+	{0x108D, 0x108D, 0},
+	{0x109D, 0x109D, 0},
+	{0x1100, 0x115F, 2},
+	{0x135D, 0x135F, 0},
+	{0x1712, 0x1714, 0},
+	{0x1732, 0x1733, 0},
+	{0x1752, 0x1753, 0},
+	{0x1772, 0x1773, 0},
+	{0x17B4, 0x17B5, 0},
+	{0x17B7, 0x17BD, 0},
+	{0x17C6, 0x17C6, 0},
+	{0x17C9, 0x17D3, 0},
+	{0x17DD, 0x17DD, 0},
+	{0x180B, 0x180F, 0},
+	{0x1885, 0x1886, 0},
+	{0x18A9, 0x18A9, 0},
+	{0x1920, 0x1922, 0},
+	{0x1927, 0x1928, 0},
+	{0x1932, 0x1932, 0},
+	{0x1939, 0x193B, 0},
+	{0x1A17, 0x1A18, 0},
+	{0x1A1B, 0x1A1B, 0},
+	{0x1A56, 0x1A56, 0},
+	{0x1A58, 0x1A5E, 0},
+	{0x1A60, 0x1A60, 0},
+	{0x1A62, 0x1A62, 0},
+	{0x1A65, 0x1A6C, 0},
+	{0x1A73, 0x1A7C, 0},
+	{0x1A7F, 0x1A7F, 0},
+	{0x1AB0, 0x1ACE, 0},
+	{0x1B00, 0x1B03, 0},
+	{0x1B34, 0x1B3A, 0},
+	{0x1B3C, 0x1B3C, 0},
+	{0x1B42, 0x1B42, 0},
+	{0x1B6B, 0x1B73, 0},
+	{0x1B80, 0x1B81, 0},
+	{0x1BA2, 0x1BA5, 0},
+	{0x1BA8, 0x1BA9, 0},
+	{0x1BAB, 0x1BAD, 0},
+	{0x1BE6, 0x1BE6, 0},
+	{0x1BE8, 0x1BE9, 0},
+	{0x1BED, 0x1BED, 0},
+	{0x1BEF, 0x1BF1, 0},
+	{0x1C2C, 0x1C33, 0},
+	{0x1C36, 0x1C37, 0},
+	{0x1CD0, 0x1CD2, 0},
+	{0x1CD4, 0x1CE0, 0},
+	{0x1CE2, 0x1CE8, 0},
+	{0x1CED, 0x1CED, 0},
+	{0x1CF4, 0x1CF4, 0},
+	{0x1CF8, 0x1CF9, 0},
+	{0x1DC0, 0x1DFF, 0},
+	{0x200B, 0x200F, 0},
+	{0x2028, 0x202E, 0},
+	{0x2060, 0x206F, 0},
+	{0x20D0, 0x20F0, 0},
+	{0x231A, 0x231B, 2},
+	{0x2329, 0x232A, 2},
+	{0x23E9, 0x23EC, 2},
+	{0x23F0, 0x23F0, 2},
+	{0x23F3, 0x23F3, 2},
+	{0x25FD, 0x25FE, 2},
+	{0x2614, 0x2615, 2},
+	{0x2648, 0x2653, 2},
+	{0x267F, 0x267F, 2},
+	{0x2693, 0x2693, 2},
+	{0x26A1, 0x26A1, 2},
+	{0x26AA, 0x26AB, 2},
+	{0x26BD, 0x26BE, 2},
+	{0x26C4, 0x26C5, 2},
+	{0x26CE, 0x26CE, 2},
+	{0x26D4, 0x26D4, 2},
+	{0x26EA, 0x26EA, 2},
+	{0x26F2, 0x26F3, 2},
+	{0x26F5, 0x26F5, 2},
+	{0x26FA, 0x26FA, 2},
+	{0x26FD, 0x26FD, 2},
+	{0x2705, 0x2705, 2},
+	{0x270A, 0x270B, 2},
+	{0x2728, 0x2728, 2},
+	{0x274C, 0x274C, 2},
+	{0x274E, 0x274E, 2},
+	{0x2753, 0x2755, 2},
+	{0x2757, 0x2757, 2},
+	{0x2795, 0x2797, 2},
+	{0x27B0, 0x27B0, 2},
+	{0x27BF, 0x27BF, 2},
+	{0x2B1B, 0x2B1C, 2},
+	{0x2B50, 0x2B50, 2},
+	{0x2B55, 0x2B55, 2},
+	{0x2CEF, 0x2CF1, 0},
+	{0x2D7F, 0x2D7F, 0},
+	{0x2DE0, 0x2DFF, 0},
+	{0x2E3A, 0x2E3A, 3},
+	{0x2E3B, 0x2E3B, 4},
+	{0x2E80, 0x2E99, 2},
+	{0x2E9B, 0x2EF3, 2},
+	{0x2F00, 0x2FD5, 2},
+	{0x2FF0, 0x2FFB, 2},
+	{0x3000, 0x3029, 2},
+	{0x302A, 0x302F, 0},
+	{0x3031, 0x303C, 2},
+	{0x303E, 0x303E, 2},
+	{0x3041, 0x3096, 2},
+	{0x3099, 0x309A, 0},
+	{0x309B, 0x30FF, 2},
+	{0x3105, 0x312F, 2},
+	{0x3131, 0x318E, 2},
+	{0x3190, 0x31E3, 2},
+	{0x31F0, 0x321E, 2},
+	{0x3220, 0x3247, 2},
+	{0x3250, 0x3296, 2},
+	{0x3298, 0x3298, 2},
+	{0x329A, 0x4DBF, 2},
+	{0x4E00, 0xA48C, 2},
+	{0xA490, 0xA4C6, 2},
+	{0xA66F, 0xA672, 0},
+	{0xA674, 0xA67D, 0},
+	{0xA69E, 0xA69F, 0},
+	{0xA6F0, 0xA6F1, 0},
+	{0xA802, 0xA802, 0},
+	{0xA806, 0xA806, 0},
+	{0xA80B, 0xA80B, 0},
+	{0xA825, 0xA826, 0},
+	{0xA82C, 0xA82C, 0},
+	{0xA8C4, 0xA8C5, 0},
+	{0xA8E0, 0xA8F1, 0},
+	{0xA8FF, 0xA8FF, 0},
+	{0xA926, 0xA92D, 0},
+	{0xA947, 0xA951, 0},
+	{0xA960, 0xA97C, 2},
+	{0xA980, 0xA982, 0},
+	{0xA9B3, 0xA9B3, 0},
+	{0xA9B6, 0xA9B9, 0},
+	{0xA9BC, 0xA9BD, 0},
+	{0xA9E5, 0xA9E5, 0},
+	{0xAA29, 0xAA2E, 0},
+	{0xAA31, 0xAA32, 0},
+	{0xAA35, 0xAA36, 0},
+	{0xAA43, 0xAA43, 0},
+	{0xAA4C, 0xAA4C, 0},
+	{0xAA7C, 0xAA7C, 0},
+	{0xAAB0, 0xAAB0, 0},
+	{0xAAB2, 0xAAB4, 0},
+	{0xAAB7, 0xAAB8, 0},
+	{0xAABE, 0xAABF, 0},
+	{0xAAC1, 0xAAC1, 0},
+	{0xAAEC, 0xAAED, 0},
+	{0xAAF6, 0xAAF6, 0},
+	{0xABE5, 0xABE5, 0},
+	{0xABE8, 0xABE8, 0},
+	{0xABED, 0xABED, 0},
+	{0xAC00, 0xD7A3, 2},
+	{0xF900, 0xFAFF, 2},
+	{0xFB1E, 0xFB1E, 0},
+	{0xFE00, 0xFE0F, 0},
+	{0xFE10, 0xFE19, 2},
+	{0xFE20, 0xFE2F, 0},
+	{0xFE30, 0xFE52, 2},
+	{0xFE54, 0xFE66, 2},
+	{0xFE68, 0xFE6B, 2},
+	{0xFEFF, 0xFEFF, 0},
+	{0xFF01, 0xFF60, 2},
+	{0xFF9E, 0xFF9F, 0},
+	{0xFFE0, 0xFFE6, 2},
+	{0xFFF0, 0xFFFB, 0},
+	{0x101FD, 0x101FD, 0},
+	{0x102E0, 0x102E0, 0},
+	{0x10376, 0x1037A, 0},
+	{0x10A01, 0x10A03, 0},
+	{0x10A05, 0x10A06, 0},
+	{0x10A0C, 0x10A0F, 0},
+	{0x10A38, 0x10A3A, 0},
+	{0x10A3F, 0x10A3F, 0},
+	{0x10AE5, 0x10AE6, 0},
+	{0x10D24, 0x10D27, 0},
+	{0x10EAB, 0x10EAC, 0},
+	{0x10EFD, 0x10EFF, 0},
+	{0x10F46, 0x10F50, 0},
+	{0x10F82, 0x10F85, 0},
+	{0x11001, 0x11001, 0},
+	{0x11038, 0x11046, 0},
+	{0x11070, 0x11070, 0},
+	{0x11073, 0x11074, 0},
+	{0x1107F, 0x11081, 0},
+	{0x110B3, 0x110B6, 0},
+	{0x110B9, 0x110BA, 0},
+	{0x110C2, 0x110C2, 0},
+	{0x11100, 0x11102, 0},
+	{0x11127, 0x1112B, 0},
+	{0x1112D, 0x11134, 0},
+	{0x11173, 0x11173, 0},
+	{0x11180, 0x11181, 0},
+	{0x111B6, 0x111BE, 0},
+	{0x111C9, 0x111CC, 0},
+	{0x111CF, 0x111CF, 0},
+	{0x1122F, 0x11231, 0},
+	{0x11234, 0x11234, 0},
+	{0x11236, 0x11237, 0},
+	{0x1123E, 0x1123E, 0},
+	{0x11241, 0x11241, 0},
+	{0x112DF, 0x112DF, 0},
+	{0x112E3, 0x112EA, 0},
+	{0x11300, 0x11301, 0},
+	{0x1133B, 0x1133C, 0},
+	{0x1133E, 0x1133E, 0},
+	{0x11340, 0x11340, 0},
+	{0x11357, 0x11357, 0},
+	{0x11366, 0x1136C, 0},
+	{0x11370, 0x11374, 0},
+	{0x11438, 0x1143F, 0},
+	{0x11442, 0x11444, 0},
+	{0x11446, 0x11446, 0},
+	{0x1145E, 0x1145E, 0},
+	{0x114B0, 0x114B0, 0},
+	{0x114B3, 0x114B8, 0},
+	{0x114BA, 0x114BA, 0},
+	{0x114BD, 0x114BD, 0},
+	{0x114BF, 0x114C0, 0},
+	{0x114C2, 0x114C3, 0},
+	{0x115AF, 0x115AF, 0},
+	{0x115B2, 0x115B5, 0},
+	{0x115BC, 0x115BD, 0},
+	{0x115BF, 0x115C0, 0},
+	{0x115DC, 0x115DD, 0},
+	{0x11633, 0x1163A, 0},
+	{0x1163D, 0x1163D, 0},
+	{0x1163F, 0x11640, 0},
+	{0x116AB, 0x116AB, 0},
+	{0x116AD, 0x116AD, 0},
+	{0x116B0, 0x116B5, 0},
+	{0x116B7, 0x116B7, 0},
+	{0x1171D, 0x1171F, 0},
+	{0x11722, 0x11725, 0},
+	{0x11727, 0x1172B, 0},
+	{0x1182F, 0x11837, 0},
+	{0x11839, 0x1183A, 0},
+	{0x11930, 0x11930, 0},
+	{0x1193B, 0x1193C, 0},
+	{0x1193E, 0x1193E, 0},
+	{0x11943, 0x11943, 0},
+	{0x119D4, 0x119D7, 0},
+	{0x119DA, 0x119DB, 0},
+	{0x119E0, 0x119E0, 0},
+	{0x11A01, 0x11A0A, 0},
+	{0x11A33, 0x11A38, 0},
+	{0x11A3B, 0x11A3E, 0},
+	{0x11A47, 0x11A47, 0},
+	{0x11A51, 0x11A56, 0},
+	{0x11A59, 0x11A5B, 0},
+	{0x11A8A, 0x11A96, 0},
+	{0x11A98, 0x11A99, 0},
+	{0x11C30, 0x11C36, 0},
+	{0x11C38, 0x11C3D, 0},
+	{0x11C3F, 0x11C3F, 0},
+	{0x11C92, 0x11CA7, 0},
+	{0x11CAA, 0x11CB0, 0},
+	{0x11CB2, 0x11CB3, 0},
+	{0x11CB5, 0x11CB6, 0},
+	{0x11D31, 0x11D36, 0},
+	{0x11D3A, 0x11D3A, 0},
+	{0x11D3C, 0x11D3D, 0},
+	{0x11D3F, 0x11D45, 0},
+	{0x11D47, 0x11D47, 0},
+	{0x11D90, 0x11D91, 0},
+	{0x11D95, 0x11D95, 0},
+	{0x11D97, 0x11D97, 0},
+	{0x11EF3, 0x11EF4, 0},
+	{0x11F00, 0x11F01, 0},
+	{0x11F36, 0x11F3A, 0},
+	{0x11F40, 0x11F40, 0},
+	{0x11F42, 0x11F42, 0},
+	{0x13430, 0x13440, 0},
+	{0x13447, 0x13455, 0},
+	{0x16AF0, 0x16AF4, 0},
+	{0x16B30, 0x16B36, 0},
+	{0x16F4F, 0x16F4F, 0},
+	{0x16F8F, 0x16F92, 0},
+	{0x16FE0, 0x16FE3, 2},
+	{0x16FE4, 0x16FE4, 0},
+	{0x16FF0, 0x16FF1, 2},
+	{0x17000, 0x187F7, 2},
+	{0x18800, 0x18CD5, 2},
+	{0x18D00, 0x18D08, 2},
+	{0x1AFF0, 0x1AFF3, 2},
+	{0x1AFF5, 0x1AFFB, 2},
+	{0x1AFFD, 0x1AFFE, 2},
+	{0x1B000, 0x1B122, 2},
+	{0x1B132, 0x1B132, 2},
+	{0x1B150, 0x1B152, 2},
+	{0x1B155, 0x1B155, 2},
+	{0x1B164, 0x1B167, 2},
+	{0x1B170, 0x1B2FB, 2},
+	{0x1BC9D, 0x1BC9E, 0},
+	{0x1BCA0, 0x1BCA3, 0},
+	{0x1CF00, 0x1CF2D, 0},
+	{0x1CF30, 0x1CF46, 0},
+	{0x1D165, 0x1D165, 0},
+	{0x1D167, 0x1D169, 0},
+	{0x1D16E, 0x1D182, 0},
+	{0x1D185, 0x1D18B, 0},
+	{0x1D1AA, 0x1D1AD, 0},
+	{0x1D242, 0x1D244, 0},
+	{0x1DA00, 0x1DA36, 0},
+	{0x1DA3B, 0x1DA6C, 0},
+	{0x1DA75, 0x1DA75, 0},
+	{0x1DA84, 0x1DA84, 0},
+	{0x1DA9B, 0x1DA9F, 0},
+	{0x1DAA1, 0x1DAAF, 0},
+	{0x1E000, 0x1E006, 0},
+	{0x1E008, 0x1E018, 0},
+	{0x1E01B, 0x1E021, 0},
+	{0x1E023, 0x1E024, 0},
+	{0x1E026, 0x1E02A, 0},
+	{0x1E08F, 0x1E08F, 0},
+	{0x1E130, 0x1E136, 0},
+	{0x1E2AE, 0x1E2AE, 0},
+	{0x1E2EC, 0x1E2EF, 0},
+	{0x1E4EC, 0x1E4EF, 0},
+	{0x1E8D0, 0x1E8D6, 0},
+	{0x1E944, 0x1E94A, 0},
+	{0x1F004, 0x1F004, 2},
+	{0x1F0CF, 0x1F0CF, 2},
+	{0x1F18E, 0x1F18E, 2},
+	{0x1F191, 0x1F19A, 2},
+	{0x1F1E6, 0x1F201, 2},
+	{0x1F210, 0x1F236, 2},
+	{0x1F238, 0x1F23B, 2},
+	{0x1F240, 0x1F248, 2},
+	{0x1F250, 0x1F251, 2},
+	{0x1F300, 0x1F320, 2},
+	{0x1F32D, 0x1F335, 2},
+	{0x1F337, 0x1F37C, 2},
+	{0x1F37E, 0x1F393, 2},
+	{0x1F3A0, 0x1F3CA, 2},
+	{0x1F3CF, 0x1F3D3, 2},
+	{0x1F3E0, 0x1F3F0, 2},
+	{0x1F3F4, 0x1F3F4, 2},
+	{0x1F3F8, 0x1F3FA, 2},
+	{0x1F3FB, 0x1F3FF, 0},
+	{0x1F400, 0x1F43E, 2},
+	{0x1F440, 0x1F440, 2},
+	{0x1F442, 0x1F4FC, 2},
+	{0x1F4FF, 0x1F53D, 2},
+	{0x1F54B, 0x1F54E, 2},
+	{0x1F550, 0x1F567, 2},
+	{0x1F57A, 0x1F57A, 2},
+	{0x1F595, 0x1F596, 2},
+	{0x1F5A4, 0x1F5A4, 2},
+	{0x1F5FB, 0x1F64F, 2},
+	{0x1F680, 0x1F6C5, 2},
+	{0x1F6CC, 0x1F6CC, 2},
+	{0x1F6D0, 0x1F6D2, 2},
+	{0x1F6D5, 0x1F6D7, 2},
+	{0x1F6DC, 0x1F6DF, 2},
+	{0x1F6EB, 0x1F6EC, 2},
+	{0x1F6F4, 0x1F6FC, 2},
+	{0x1F7E0, 0x1F7EB, 2},
+	{0x1F7F0, 0x1F7F0, 2},
+	{0x1F90C, 0x1F93A, 2},
+	{0x1F93C, 0x1F945, 2},
+	{0x1F947, 0x1F9FF, 2},
+	{0x1FA70, 0x1FA7C, 2},
+	{0x1FA80, 0x1FA88, 2},
+	{0x1FA90, 0x1FABD, 2},
+	{0x1FABF, 0x1FAC5, 2},
+	{0x1FACE, 0x1FADB, 2},
+	{0x1FAE0, 0x1FAE8, 2},
+	{0x1FAF0, 0x1FAF8, 2},
+	{0x20000, 0x2FFFD, 2},
+	{0x30000, 0x3FFFD, 2},
+	{0xE0000, 0xE0FFF, 0},
+}
@@ -1,5 +1,10 @@
 package util
 
+import (
+	"math/bits"
+	"sync"
+)
+
 type Slab struct {
 	I16 []int16
 	I32 []int32
@@ -10,3 +15,65 @@ func MakeSlab(size16 int, size32 int) *Slab {
 		I16: make([]int16, size16),
 		I32: make([]int32, size32)}
 }
+
+// SlabPool keeps slabs around for reuse, so that goroutines that need a slab
+// only for the duration of a search don't have to allocate one each time.
+// Slabs are pooled by size class, with capacities rounded up to powers of
+// two, so that a large slab is neither handed out for a small search nor
+// thrown away for it. Slabs that are not used for a while are freed by the
+// garbage collector.
+type SlabPool struct {
+	pools sync.Map // slabClass -> *sync.Pool
+}
+
+// slabClass is the size class of a slab: the base-2 logarithms of the
+// capacities of its slices
+type slabClass struct {
+	bits16 int
+	bits32 int
+}
+
+// ceilLog2 returns the smallest n for which 1<<n >= size
+func ceilLog2(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// floorLog2 returns the largest n for which 1<<n <= size
+func floorLog2(size int) int {
+	if size <= 1 {
+		return 0
+	}
+	return bits.Len(uint(size)) - 1
+}
+
+// pool returns the pool of the given size class
+func (p *SlabPool) pool(class slabClass) *sync.Pool {
+	if pool, ok := p.pools.Load(class); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := p.pools.LoadOrStore(class, &sync.Pool{})
+	return pool.(*sync.Pool)
+}
+
+// Get returns a slab with at least the given capacities
+func (p *SlabPool) Get(size16 int, size32 int) *Slab {
+	class := slabClass{ceilLog2(size16), ceilLog2(size32)}
+	if slab, ok := p.pool(class).Get().(*Slab); ok {
+		return slab
+	}
+	return MakeSlab(1<<class.bits16, 1<<class.bits32)
+}
+
+// Put returns the slab to the pool of the largest size class it can serve
+func (p *SlabPool) Put(slab *Slab) {
+	if len(slab.I16) == 0 || len(slab.I32) == 0 {
+		return
+	}
+	class := slabClass{floorLog2(len(slab.I16)), floorLog2(len(slab.I32))}
+	slab.I16 = slab.I16[:1<<class.bits16]
+	slab.I32 = slab.I32[:1<<class.bits32]
+	p.pool(class).Put(slab)
+}
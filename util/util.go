@@ -76,6 +76,15 @@ func AsUint16(val int) uint16 {
 	return uint16(val)
 }
 
+func AsUint32(val int) uint32 {
+	if int64(val) > math.MaxUint32 {
+		return math.MaxUint32
+	} else if val < 0 {
+		return 0
+	}
+	return uint32(val)
+}
+
 // DurWithin limits the given time.Duration with the upper and lower bounds
 func DurWithin(
 	val time.Duration, min time.Duration, max time.Duration) time.Duration {